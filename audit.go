@@ -0,0 +1,216 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/candango/httpok"
+)
+
+// AuditEventType identifies a transition in the nonce lifecycle.
+type AuditEventType string
+
+const (
+	// AuditNonceIssued is emitted when a nonce is generated.
+	AuditNonceIssued AuditEventType = "issued"
+	// AuditNonceConsumed is emitted when a nonce is successfully consumed.
+	AuditNonceConsumed AuditEventType = "consumed"
+	// AuditNonceExpired is emitted when an issued nonce is presented but the
+	// wrapped service doesn't accept it anymore.
+	AuditNonceExpired AuditEventType = "expired"
+	// AuditNonceRejected is emitted when a missing or unknown nonce is
+	// presented.
+	AuditNonceRejected AuditEventType = "rejected"
+)
+
+// AuditEvent describes a nonce lifecycle transition.
+type AuditEvent struct {
+	Type   AuditEventType `json:"type"`
+	Nonce  string         `json:"nonce"`
+	Client string         `json:"client"`
+	Method string         `json:"method"`
+	Path   string         `json:"path"`
+	Time   time.Time      `json:"time"`
+}
+
+// AuditSink receives the events emitted by an AuditNonceService.
+type AuditSink interface {
+	// Emit records an audit event. It must be safe for concurrent use.
+	Emit(AuditEvent)
+}
+
+// JsonAuditSink is an AuditSink writing each event as a JSON line.
+type JsonAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJsonAuditSink initializes a new JsonAuditSink writing to w.
+func NewJsonAuditSink(w io.Writer) *JsonAuditSink {
+	return &JsonAuditSink{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Emit writes the event as a JSON line. Write errors are dropped as auditing
+// must not change the outcome of a request.
+func (s *JsonAuditSink) Emit(e AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(e)
+}
+
+// AuditNonceService decorates a NonceService emitting an AuditEvent to the
+// Sink on every nonce lifecycle transition. The wrapped service behavior is
+// not changed.
+//
+// A nonce presented after being issued that the wrapped service doesn't
+// accept is reported as expired, any other refused nonce is reported as
+// rejected. Issued nonces are tracked until they're presented, cleared, or
+// the TTL elapses.
+type AuditNonceService struct {
+	NonceService
+	// Clock provides the time events are stamped with and tracked nonces
+	// expire by.
+	Clock Clock
+	// Extractor reads the nonce from the request. If nil the nonce is read
+	// from the HeaderKey header.
+	Extractor NonceExtractor
+	// HeaderKey is the header the presented nonce is read from.
+	HeaderKey string
+	// Sink receives the audit events.
+	Sink AuditSink
+	// TTL is how long an issued nonce is tracked. It should be at least the
+	// TTL of the wrapped service, otherwise expired nonces presented after
+	// it are reported as rejected.
+	TTL time.Duration
+
+	issued *nonceTracker[struct{}]
+	mu     sync.Mutex
+}
+
+// NewAuditNonceService initializes a new AuditNonceService wrapping the given
+// service and emitting events to the sink.
+func NewAuditNonceService(s NonceService, sink AuditSink) *AuditNonceService {
+	return &AuditNonceService{
+		NonceService: s,
+		Clock:        systemClock{},
+		HeaderKey:    DefaultNonceHeader,
+		Sink:         sink,
+		TTL:          DefaultTrackingTTL,
+		issued:       newNonceTracker[struct{}](),
+	}
+}
+
+// Clear clears the nonce in the wrapped service and stops tracking it.
+func (s *AuditNonceService) Clear(nonce string) error {
+	s.untrack(nonce)
+	return s.NonceService.Clear(nonce)
+}
+
+// Consume consumes the nonce in the wrapped service, emitting a consumed,
+// expired or rejected event depending on the outcome.
+func (s *AuditNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	wrapped := &httpok.WrappedWriter{
+		ResponseWriter: w,
+		StatusCode:     http.StatusOK,
+	}
+	err := s.NonceService.Consume(wrapped, r)
+	if err != nil {
+		return err
+	}
+	nonce := s.nonce(r)
+	tracked := s.untrack(nonce)
+	switch {
+	case wrapped.StatusCode < 300:
+		s.emit(AuditNonceConsumed, nonce, r)
+	case tracked:
+		s.emit(AuditNonceExpired, nonce, r)
+	default:
+		s.emit(AuditNonceRejected, nonce, r)
+	}
+	return nil
+}
+
+// GetNonce generates a nonce with the wrapped service and emits an issued
+// event.
+func (s *AuditNonceService) GetNonce(r *http.Request) (string, error) {
+	nonce, err := s.NonceService.GetNonce(r)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.issued.put(nonce, struct{}{}, s.Clock.Now(), s.TTL)
+	s.mu.Unlock()
+	s.emit(AuditNonceIssued, nonce, r)
+	return nonce, nil
+}
+
+// Provided checks the nonce presence with the wrapped service, emitting
+// a rejected event if it isn't provided.
+func (s *AuditNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	wrapped := &httpok.WrappedWriter{
+		ResponseWriter: w,
+		StatusCode:     http.StatusOK,
+	}
+	err := s.NonceService.Provided(wrapped, r)
+	if err != nil {
+		return err
+	}
+	if wrapped.StatusCode >= 300 {
+		s.emit(AuditNonceRejected, s.nonce(r), r)
+	}
+	return nil
+}
+
+func (s *AuditNonceService) nonce(r *http.Request) string {
+	if s.Extractor != nil {
+		return s.Extractor(r)
+	}
+	return r.Header.Get(s.HeaderKey)
+}
+
+func (s *AuditNonceService) untrack(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.issued.take(nonce, s.Clock.Now())
+	return ok
+}
+
+// emit sends the event to the sink. The request is optional, as nonces can
+// be issued out of a request, leaving the request fields empty.
+func (s *AuditNonceService) emit(t AuditEventType, nonce string,
+	r *http.Request) {
+	e := AuditEvent{
+		Type:  t,
+		Nonce: nonce,
+		Time:  s.Clock.Now(),
+	}
+	if r != nil {
+		e.Client = r.RemoteAddr
+		e.Method = r.Method
+		if r.URL != nil {
+			e.Path = r.URL.Path
+		}
+	}
+	s.Sink.Emit(e)
+}
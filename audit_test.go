@@ -0,0 +1,197 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *FakeAuditSink) Emit(e AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+}
+
+func (s *FakeAuditSink) Types() []AuditEventType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	types := []AuditEventType{}
+	for _, e := range s.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func NewAuditedServeMux(t *testing.T, sink AuditSink) *http.ServeMux {
+	s := NewAuditNonceService(dummy.NewDummyInMemoryNonceService(), sink)
+	nonced := NewNoncedHandler(s)
+	h := http.NewServeMux()
+	h.HandleFunc("/new-nonce", NoncedHandlerFunc(s, nonced.GetNonce))
+	h.HandleFunc("/do-nonced-something",
+		NoncedHandlerFunc(s, nonced.DoNoncedFunc))
+	return h
+}
+
+func TestAuditNonceService(t *testing.T) {
+	newNonce := func(h http.Handler) string {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodHead, "/new-nonce",
+			nil))
+		return res.Header().Get(DefaultNonceHeader)
+	}
+	doSomething := func(h http.Handler, nonce string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Issue then consume", func(t *testing.T) {
+		sink := &FakeAuditSink{}
+		h := NewAuditedServeMux(t, sink)
+		nonce := newNonce(h)
+		res := doSomething(h, nonce)
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, []AuditEventType{
+			AuditNonceIssued,
+			AuditNonceConsumed,
+			AuditNonceIssued,
+		}, sink.Types())
+		assert.Equal(t, nonce, sink.events[0].Nonce)
+		assert.Equal(t, nonce, sink.events[1].Nonce)
+		assert.Equal(t, "192.0.2.1:1234", sink.events[0].Client)
+		assert.Equal(t, "/do-nonced-something", sink.events[1].Path)
+	})
+
+	t.Run("Issue then expire", func(t *testing.T) {
+		sink := &FakeAuditSink{}
+		h := NewAuditedServeMux(t, sink)
+		nonce := newNonce(h)
+		time.Sleep(300 * time.Millisecond)
+		res := doSomething(h, nonce)
+
+		assert.Equal(t, http.StatusForbidden, res.Code)
+		assert.Equal(t, []AuditEventType{
+			AuditNonceIssued,
+			AuditNonceExpired,
+		}, sink.Types())
+		assert.Equal(t, nonce, sink.events[1].Nonce)
+	})
+
+	t.Run("Unknown and missing nonces", func(t *testing.T) {
+		sink := &FakeAuditSink{}
+		h := NewAuditedServeMux(t, sink)
+		assert.Equal(t, http.StatusForbidden,
+			doSomething(h, "unknown-nonce").Code)
+		assert.Equal(t, http.StatusForbidden, doSomething(h, "").Code)
+		assert.Equal(t, []AuditEventType{
+			AuditNonceRejected,
+			AuditNonceRejected,
+		}, sink.Types())
+	})
+
+	t.Run("Issue without a request", func(t *testing.T) {
+		sink := &FakeAuditSink{}
+		s := NewAuditNonceService(dummy.NewDummyInMemoryNonceService(), sink)
+		nonce, err := s.GetNonce(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, []AuditEventType{AuditNonceIssued}, sink.Types())
+		assert.Equal(t, nonce, sink.events[0].Nonce)
+		assert.Equal(t, "", sink.events[0].Client)
+	})
+
+	t.Run("Tracked nonces expire", func(t *testing.T) {
+		sink := &FakeAuditSink{}
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewAuditNonceService(dummy.NewDummyInMemoryNonceService(), sink)
+		s.Clock = clock
+		s.TTL = time.Minute
+		for i := 0; i < 3; i++ {
+			_, err := s.GetNonce(nil)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		assert.Equal(t, 3, s.issued.len())
+		clock.Advance(time.Minute)
+		_, err := s.GetNonce(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 1, s.issued.len())
+		assert.Equal(t, clock.Now(), sink.events[3].Time)
+	})
+
+	t.Run("Nonce read by the extractor", func(t *testing.T) {
+		sink := &FakeAuditSink{}
+		s := NewAuditNonceService(dummy.NewDummyInMemoryNonceService(
+			dummy.WithExtractor(NonceFromQuery("nonce"))), sink)
+		s.Extractor = NonceFromQuery("nonce")
+		nonce, err := s.GetNonce(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		res := httptest.NewRecorder()
+		err = s.Consume(res, httptest.NewRequest(http.MethodGet,
+			"/do-nonced-something?nonce="+nonce, nil))
+		if err != nil {
+			t.Error(err)
+		}
+		res = httptest.NewRecorder()
+		err = s.Consume(res, httptest.NewRequest(http.MethodGet,
+			"/do-nonced-something?nonce=unknown-nonce", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, []AuditEventType{
+			AuditNonceIssued,
+			AuditNonceConsumed,
+			AuditNonceRejected,
+		}, sink.Types())
+		assert.Equal(t, nonce, sink.events[1].Nonce)
+		assert.Equal(t, "unknown-nonce", sink.events[2].Nonce)
+	})
+
+	t.Run("Json lines sink", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		sink := NewJsonAuditSink(buf)
+		sink.Emit(AuditEvent{Type: AuditNonceIssued, Nonce: "a-nonce"})
+		e := AuditEvent{}
+		err := json.Unmarshal(buf.Bytes(), &e)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, AuditNonceIssued, e.Type)
+		assert.Equal(t, "a-nonce", e.Nonce)
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NonceBinding is a set of request attributes a nonce is bound to.
+type NonceBinding int
+
+const (
+	// BindMethod binds the nonce to the request method.
+	BindMethod NonceBinding = 1 << iota
+	// BindPath binds the nonce to the request URL path.
+	BindPath
+)
+
+// BoundNonceService decorates a VerifyingNonceService binding each nonce to
+// the request attributes it was first presented with, either by Verify or
+// Consume. A nonce presented later with different attributes is rejected
+// with 403, so a nonce verified by a read endpoint can't be replayed on
+// a different endpoint.
+//
+// Bindings are dropped when the nonce is consumed or cleared, or when the TTL
+// elapses, so the bindings of nonces never consumed don't pile up.
+type BoundNonceService struct {
+	VerifyingNonceService
+	// Binding is the set of attributes nonces are bound to.
+	Binding NonceBinding
+	// Clock provides the time bindings expire by.
+	Clock Clock
+	// Extractor reads the nonce from the request. If nil the nonce is read
+	// from the HeaderKey header.
+	Extractor NonceExtractor
+	// HeaderKey is the header the presented nonce is read from.
+	HeaderKey string
+	// TTL is how long a binding is kept. It should be at least the TTL of
+	// the wrapped service, otherwise a nonce outliving its binding could be
+	// bound again to different attributes.
+	TTL time.Duration
+
+	bound *nonceTracker[string]
+	mu    sync.Mutex
+}
+
+// NewBoundNonceService initializes a new BoundNonceService wrapping the given
+// service and binding nonces to the given attributes.
+func NewBoundNonceService(s VerifyingNonceService,
+	binding NonceBinding) *BoundNonceService {
+	return &BoundNonceService{
+		VerifyingNonceService: s,
+		Binding:               binding,
+		Clock:                 systemClock{},
+		HeaderKey:             DefaultNonceHeader,
+		TTL:                   DefaultTrackingTTL,
+		bound:                 newNonceTracker[string](),
+	}
+}
+
+// Clear clears the nonce in the wrapped service and drops its binding.
+func (s *BoundNonceService) Clear(nonce string) error {
+	s.unbind(nonce)
+	return s.VerifyingNonceService.Clear(nonce)
+}
+
+// Consume rejects the nonce with 403 if it is bound to different attributes,
+// otherwise it is consumed by the wrapped service and its binding dropped.
+func (s *BoundNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	nonce := s.nonce(r)
+	if !s.bind(nonce, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	s.unbind(nonce)
+	return s.VerifyingNonceService.Consume(w, r)
+}
+
+// Verify reports the nonce as invalid if it is bound to different
+// attributes, otherwise it is verified by the wrapped service. A nonce
+// verified for the first time is bound to the request attributes.
+func (s *BoundNonceService) Verify(r *http.Request) (bool, error) {
+	valid, err := s.VerifyingNonceService.Verify(r)
+	if err != nil || !valid {
+		return valid, err
+	}
+	return s.bind(s.nonce(r), r), nil
+}
+
+// bind binds the nonce to the request attributes if it isn't bound yet and
+// reports if the attributes match the binding.
+func (s *BoundNonceService) bind(nonce string, r *http.Request) bool {
+	if nonce == "" {
+		return true
+	}
+	key := s.bindingKey(r)
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bound, ok := s.bound.get(nonce, now)
+	if !ok {
+		s.bound.put(nonce, key, now, s.TTL)
+		return true
+	}
+	return bound == key
+}
+
+// unbind drops the binding of the nonce.
+func (s *BoundNonceService) unbind(nonce string) {
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bound.take(nonce, now)
+}
+
+func (s *BoundNonceService) bindingKey(r *http.Request) string {
+	key := ""
+	if s.Binding&BindMethod != 0 {
+		key += r.Method
+	}
+	key += " "
+	if s.Binding&BindPath != 0 {
+		key += r.URL.Path
+	}
+	return key
+}
+
+func (s *BoundNonceService) nonce(r *http.Request) string {
+	if s.Extractor != nil {
+		return s.Extractor(r)
+	}
+	return r.Header.Get(s.HeaderKey)
+}
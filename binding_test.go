@@ -0,0 +1,144 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewBoundServeMux(t *testing.T, binding NonceBinding) (*http.ServeMux,
+	*dummy.DummyInMemoryNonceService) {
+	inner := dummy.NewDummyInMemoryNonceService()
+	s := NewBoundNonceService(inner, binding)
+	done := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+	h := http.NewServeMux()
+	h.HandleFunc("/read-something", NoncedReadHandlerFunc(s, done))
+	h.HandleFunc("/write-something", NoncedHandlerFunc(s, done))
+	h.HandleFunc("/write-other-thing", NoncedHandlerFunc(s, done))
+	return h, inner
+}
+
+func TestBoundNonceService(t *testing.T) {
+	present := func(h http.Handler, method, path,
+		nonce string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Same method and path", func(t *testing.T) {
+		h, inner := NewBoundServeMux(t, BindMethod|BindPath)
+		inner.Seed("a-nonce")
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/read-something", "a-nonce").Code)
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/read-something", "a-nonce").Code)
+	})
+
+	t.Run("Replay on a different endpoint", func(t *testing.T) {
+		h, inner := NewBoundServeMux(t, BindMethod|BindPath)
+		inner.Seed("a-nonce")
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/read-something", "a-nonce").Code)
+		assert.Equal(t, http.StatusForbidden,
+			present(h, http.MethodPost, "/write-something", "a-nonce").Code)
+		ok, _ := inner.Verify(func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(DefaultNonceHeader, "a-nonce")
+			return req
+		}())
+		assert.True(t, ok)
+	})
+
+	t.Run("Bind only the method", func(t *testing.T) {
+		h, inner := NewBoundServeMux(t, BindMethod)
+		inner.Seed("a-nonce", "other-nonce")
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/read-something", "a-nonce").Code)
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/write-something", "a-nonce").Code)
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodPost, "/write-something", "other-nonce").Code)
+	})
+
+	t.Run("Bindings expire", func(t *testing.T) {
+		inner := dummy.NewDummyInMemoryNonceService(
+			dummy.WithTTL(time.Hour))
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewBoundNonceService(inner, BindMethod|BindPath)
+		s.Clock = clock
+		s.TTL = time.Minute
+		inner.Seed("a-nonce", "other-nonce")
+		verify := func(nonce string) {
+			req := httptest.NewRequest(http.MethodGet, "/read-something",
+				nil)
+			req.Header.Set(DefaultNonceHeader, nonce)
+			ok, err := s.Verify(req)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.True(t, ok)
+		}
+		verify("a-nonce")
+		assert.Equal(t, 1, s.bound.len())
+		clock.Advance(time.Minute)
+		verify("other-nonce")
+		assert.Equal(t, 1, s.bound.len())
+	})
+
+	t.Run("Nonce read by the extractor", func(t *testing.T) {
+		inner := dummy.NewDummyInMemoryNonceService(
+			dummy.WithExtractor(NonceFromQuery("nonce")))
+		s := NewBoundNonceService(inner, BindMethod|BindPath)
+		s.Extractor = NonceFromQuery("nonce")
+		inner.Seed("a-nonce")
+		ok, err := s.Verify(httptest.NewRequest(http.MethodGet,
+			"/read-something?nonce=a-nonce", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, ok)
+		res := httptest.NewRecorder()
+		err = s.Consume(res, httptest.NewRequest(http.MethodPost,
+			"/write-something?nonce=a-nonce", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Bind only the path", func(t *testing.T) {
+		h, inner := NewBoundServeMux(t, BindPath)
+		inner.Seed("a-nonce")
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/write-something", "a-nonce").Code)
+		inner.Seed("other-nonce")
+		assert.Equal(t, http.StatusOK,
+			present(h, http.MethodGet, "/read-something", "other-nonce").Code)
+		assert.Equal(t, http.StatusForbidden,
+			present(h, http.MethodPost, "/write-other-thing",
+				"other-nonce").Code)
+	})
+}
@@ -0,0 +1,192 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreakerTransport.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every call through to the wrapped transport.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails every call fast with ErrCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe call through at a time to check if
+	// the bastion recovered.
+	CircuitHalfOpen
+)
+
+// String returns the state name.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerTransport decorates a Transport failing fast while the
+// bastion is down, instead of paying the full timeout of every call.
+//
+// The circuit opens after FailureThreshold consecutive failed calls. While
+// open, calls fail with ErrCircuitOpen. After OpenDuration the circuit is
+// half-open and probe calls are let through one at a time: a failed probe
+// opens the circuit again and ProbeSuccesses consecutive successful probes
+// close it. It is safe for concurrent use.
+type CircuitBreakerTransport struct {
+	Transport
+	// Clock provides the time used to expire the open state.
+	Clock Clock
+	// FailureThreshold is the number of consecutive failures opening the
+	// circuit.
+	FailureThreshold int
+	// OpenDuration is how long the circuit stays open before probing.
+	OpenDuration time.Duration
+	// ProbeSuccesses is the number of consecutive successful probes closing
+	// the circuit. Values below one are taken as one.
+	ProbeSuccesses int
+
+	failures  int
+	mu        sync.Mutex
+	openedAt  time.Time
+	probing   bool
+	state     CircuitState
+	successes int
+}
+
+// NewCircuitBreakerTransport initializes a new CircuitBreakerTransport
+// wrapping the given transport, opening after threshold consecutive failures
+// for the given duration.
+func NewCircuitBreakerTransport(tr Transport, threshold int,
+	openDuration time.Duration) *CircuitBreakerTransport {
+	return &CircuitBreakerTransport{
+		Transport:        tr,
+		Clock:            systemClock{},
+		FailureThreshold: threshold,
+		OpenDuration:     openDuration,
+		ProbeSuccesses:   1,
+	}
+}
+
+// Close closes the wrapped transport if it implements io.Closer, regardless
+// of the circuit state.
+func (t *CircuitBreakerTransport) Close() error {
+	c, ok := t.Transport.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+// Directory returns the wrapped transport directory, or ErrCircuitOpen if
+// the circuit is open.
+func (t *CircuitBreakerTransport) Directory() (map[string]interface{},
+	error) {
+	err := t.before()
+	if err != nil {
+		return nil, err
+	}
+	d, err := t.Transport.Directory()
+	t.after(err)
+	return d, err
+}
+
+// NewNonce returns a nonce from the wrapped transport, or ErrCircuitOpen if
+// the circuit is open.
+func (t *CircuitBreakerTransport) NewNonce() (string, error) {
+	err := t.before()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := t.Transport.NewNonce()
+	t.after(err)
+	return nonce, err
+}
+
+// State returns the current circuit state. An open circuit past its
+// OpenDuration is reported as half-open.
+func (t *CircuitBreakerTransport) State() CircuitState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == CircuitOpen &&
+		!t.Clock.Now().Before(t.openedAt.Add(t.OpenDuration)) {
+		return CircuitHalfOpen
+	}
+	return t.state
+}
+
+// before reports if the call can go through, marking it as the probe when
+// the circuit is half-open.
+func (t *CircuitBreakerTransport) before() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == CircuitOpen {
+		if t.Clock.Now().Before(t.openedAt.Add(t.OpenDuration)) {
+			return ErrCircuitOpen
+		}
+		t.state = CircuitHalfOpen
+		t.successes = 0
+	}
+	if t.state == CircuitHalfOpen {
+		if t.probing {
+			return ErrCircuitOpen
+		}
+		t.probing = true
+	}
+	return nil
+}
+
+// after records the outcome of a call let through by before.
+func (t *CircuitBreakerTransport) after(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == CircuitHalfOpen {
+		t.probing = false
+		if err != nil {
+			t.open()
+			return
+		}
+		t.successes++
+		if t.successes >= t.ProbeSuccesses {
+			t.state = CircuitClosed
+			t.failures = 0
+		}
+		return
+	}
+	if err == nil {
+		t.failures = 0
+		return
+	}
+	t.failures++
+	if t.failures >= t.FailureThreshold {
+		t.open()
+	}
+}
+
+// open opens the circuit. It must be called with the mutex held.
+func (t *CircuitBreakerTransport) open() {
+	t.state = CircuitOpen
+	t.openedAt = t.Clock.Now()
+	t.failures = 0
+}
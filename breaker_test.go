@@ -0,0 +1,146 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+// SwitchTransport is a Transport failing while down is set and counting the
+// calls reaching it.
+type SwitchTransport struct {
+	calls int
+	down  bool
+}
+
+func (t *SwitchTransport) Directory() (map[string]interface{}, error) {
+	t.calls++
+	if t.down {
+		return nil, errors.New("bastion down")
+	}
+	return map[string]interface{}{"newNonce": "http://bastion/new-nonce"},
+		nil
+}
+
+func (t *SwitchTransport) NewNonce() (string, error) {
+	t.calls++
+	if t.down {
+		return "", errors.New("bastion down")
+	}
+	return "a-nonce", nil
+}
+
+func TestCircuitBreakerTransport(t *testing.T) {
+	clock := dummy.NewFakeClock(time.Now())
+	inner := &SwitchTransport{down: true}
+	tr := NewCircuitBreakerTransport(inner, 3, time.Minute)
+	tr.Clock = clock
+
+	t.Run("Closed to open after consecutive failures", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, CircuitClosed, tr.State())
+			_, err := tr.NewNonce()
+			assert.EqualError(t, err, "bastion down")
+		}
+		assert.Equal(t, CircuitOpen, tr.State())
+		_, err := tr.NewNonce()
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		_, err = tr.Directory()
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.Equal(t, 3, inner.calls)
+	})
+
+	t.Run("Failed probe opens again", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		assert.Equal(t, CircuitHalfOpen, tr.State())
+		_, err := tr.NewNonce()
+		assert.EqualError(t, err, "bastion down")
+		assert.Equal(t, CircuitOpen, tr.State())
+		assert.Equal(t, 4, inner.calls)
+	})
+
+	t.Run("Successful probe closes", func(t *testing.T) {
+		inner.down = false
+		clock.Advance(time.Minute)
+		assert.Equal(t, CircuitHalfOpen, tr.State())
+		nonce, err := tr.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+		assert.Equal(t, CircuitClosed, tr.State())
+		_, err = tr.Directory()
+		assert.NoError(t, err)
+	})
+
+	t.Run("Successes reset the failure count", func(t *testing.T) {
+		tr := NewCircuitBreakerTransport(inner, 2, time.Minute)
+		inner.down = true
+		_, err := tr.NewNonce()
+		assert.Error(t, err)
+		inner.down = false
+		_, err = tr.NewNonce()
+		assert.NoError(t, err)
+		inner.down = true
+		_, err = tr.NewNonce()
+		assert.Error(t, err)
+		assert.Equal(t, CircuitClosed, tr.State())
+	})
+
+	t.Run("State names", func(t *testing.T) {
+		assert.Equal(t, "closed", CircuitClosed.String())
+		assert.Equal(t, "open", CircuitOpen.String())
+		assert.Equal(t, "half-open", CircuitHalfOpen.String())
+	})
+}
+
+func TestCircuitBreakerTransportClose(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	t.Run("Close the wrapped transport", func(t *testing.T) {
+		ht, err := NewHttpTransport(server.URL, DefaultNonceHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ht.RefillInterval = 10 * time.Millisecond
+		ht.StartNonceRefill(context.Background())
+		ht.refillMu.Lock()
+		done := ht.refillDone
+		ht.refillMu.Unlock()
+		p := &Peasant{Transport: NewCircuitBreakerTransport(ht, 3,
+			time.Minute)}
+		err = p.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		select {
+		case <-done:
+		default:
+			t.Error("the refill loop is still running")
+		}
+	})
+
+	t.Run("Transport without Close", func(t *testing.T) {
+		tr := NewCircuitBreakerTransport(&SwitchTransport{}, 3, time.Minute)
+		assert.NoError(t, tr.Close())
+	})
+}
@@ -15,12 +15,29 @@
 package peasant
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// MaxNonceAttempts is the maximum number of nonces NewNonce fetches when
+// they fail the NonceValidator.
+const MaxNonceAttempts = 3
+
 // Transport defines the interface for handling nonce generation and directory
 // listing.
 type Transport interface {
@@ -34,46 +51,547 @@ type Transport interface {
 type HttpTransport struct {
 	// Client is the HTTP Client used for making requests.
 	http.Client
+	// CompressRequests gzips the bodies of the requests created by
+	// NewNoncedRequest, setting the gzip Content-Encoding.
+	CompressRequests bool
+	// DirectoryProvider resolves the directory. If nil a static directory
+	// based on Url is used.
+	DirectoryProvider DirectoryProvider
+	// DirectoryKeys are the candidate directory keys for the new nonce URL,
+	// in order of preference.
+	DirectoryKeys []string
+	// DirectoryTimeout is the deadline for fetching the directory. Zero
+	// means the client timeout applies.
+	DirectoryTimeout time.Duration
+	// Interceptors are applied in order to every outbound request, nonce,
+	// directory and nonced operation requests alike, before it is sent.
+	// An interceptor error aborts the request.
+	Interceptors []func(*http.Request) error
+	// MaxRetries is the number of times a failed nonce fetch or nonced
+	// operation is retried, each time with a fresh nonce. Operations that
+	// aren't idempotent are only retried when the bastion marks the failure
+	// as safe to retry with RetrySafeHeader. Zero disables retries.
+	MaxRetries int
+	// Marshaler serializes the request bodies sent by NoncedPostJSON. It
+	// defaults to json.Marshal, and can be replaced to produce canonical
+	// JSON, needed for stable signatures, or to disable HTML escaping.
+	Marshaler func(any) ([]byte, error)
+	// NonceCookie, if set, is the name of the cookie the nonce is read from
+	// when a response carries no nonce header, as issued by bastions
+	// configured with a NonceCookie.
+	NonceCookie string
+	// NonceInjector places the nonce in the requests created by
+	// NewNoncedRequest. If nil the nonce is set in the nonce key header.
+	NonceInjector NonceInjector
+	// NonceTimeout is the deadline for the new nonce request. Zero means the
+	// client timeout applies.
+	NonceTimeout time.Duration
+	// NonceValidator, if set, is called with every nonce fetched or
+	// harvested before it is used. Nonces failing the validation, like
+	// garbage injected by a proxy, are discarded.
+	NonceValidator func(string) error
+	// OnRefillError is called with the errors of the nonce fetches of the
+	// refill loop. If nil they're logged with the standard logger.
+	OnRefillError func(error)
+	// Pool buffers the nonces fetched by NewNonces. NewNonce is served from
+	// it before requesting a new nonce.
+	Pool *NoncePool
+	// RefillBatch is the number of nonces fetched at once by the refill
+	// loop.
+	RefillBatch int
+	// RefillInterval is how often the refill loop checks the Pool. If not
+	// positive DefaultRefillInterval is used.
+	RefillInterval time.Duration
+	// RefillLowWater is the Pool size below which the refill loop fetches
+	// more nonces.
+	RefillLowWater int
+	// RefreshOnMissingKey makes a directory key lookup failing because the
+	// key is missing refresh the directory once and retry, as the cached
+	// directory may be stale after the bastion added or renamed endpoints.
+	RefreshOnMissingKey bool
 	// Url is the base URL for the transport.
 	Url string
 	// nonceKey is the header key used to retrieve the nonce from responses.
 	nonceKey string
+
+	epoch      string
+	epochMu    sync.Mutex
+	refill     chan struct{}
+	refillDone chan struct{}
+	refillMu   sync.Mutex
+	stopRefill context.CancelFunc
+}
+
+// TransportOption configures an HttpTransport.
+type TransportOption func(*HttpTransport) error
+
+// WithClientCertificate adds a client certificate presented to bastions
+// requiring mutual TLS.
+func WithClientCertificate(cert tls.Certificate) TransportOption {
+	return func(ht *HttpTransport) error {
+		t, err := ht.httpTransport()
+		if err != nil {
+			return err
+		}
+		c := tlsClientConfig(t)
+		c.Certificates = append(c.Certificates, cert)
+		return nil
+	}
+}
+
+// WithDirectoryProvider sets the DirectoryProvider used by the transport and
+// sets the transport on the provider.
+func WithDirectoryProvider(dp DirectoryProvider) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.DirectoryProvider = dp
+		return dp.SetTransport(ht)
+	}
+}
+
+// WithDirectoryKeys sets the candidate directory keys for the new nonce URL.
+// The first key present in the directory is used.
+func WithDirectoryKeys(keys ...string) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.DirectoryKeys = keys
+		return nil
+	}
+}
+
+// WithDirectoryTimeout sets the deadline for fetching the directory.
+func WithDirectoryTimeout(d time.Duration) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.DirectoryTimeout = d
+		return nil
+	}
+}
+
+// WithForceHTTP2 sets if the client should attempt HTTP/2 even when a custom
+// dialer or TLS config is used.
+func WithForceHTTP2(force bool) TransportOption {
+	return func(ht *HttpTransport) error {
+		t, err := ht.httpTransport()
+		if err != nil {
+			return err
+		}
+		t.ForceAttemptHTTP2 = force
+		return nil
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle connection to the bastion is kept
+// open for reuse.
+func WithIdleConnTimeout(d time.Duration) TransportOption {
+	return func(ht *HttpTransport) error {
+		t, err := ht.httpTransport()
+		if err != nil {
+			return err
+		}
+		t.IdleConnTimeout = d
+		return nil
+	}
+}
+
+// WithInterceptors appends interceptors applied to every outbound request,
+// to set correlation ids or log requests for example.
+func WithInterceptors(interceptors ...func(*http.Request) error,
+) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.Interceptors = append(ht.Interceptors, interceptors...)
+		return nil
+	}
+}
+
+// WithMarshaler sets the function serializing the request bodies.
+func WithMarshaler(m func(any) ([]byte, error)) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.Marshaler = m
+		return nil
+	}
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections kept open for
+// reuse, both overall and per host.
+func WithMaxIdleConns(n int) TransportOption {
+	return func(ht *HttpTransport) error {
+		t, err := ht.httpTransport()
+		if err != nil {
+			return err
+		}
+		t.MaxIdleConns = n
+		t.MaxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// WithNonceCookie reads the nonce from the given cookie when a response
+// carries no nonce header. Combine it with NonceInCookie to send the nonce
+// back in the cookie.
+func WithNonceCookie(name string) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.NonceCookie = name
+		return nil
+	}
+}
+
+// WithNonceInjector sets how NewNoncedRequest places the nonce in the
+// request, matching the NonceExtractor used by the bastion.
+func WithNonceInjector(inj NonceInjector) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.NonceInjector = inj
+		return nil
+	}
+}
+
+// WithRefreshOnMissingKey refreshes the directory once, and retries the
+// lookup, when a directory key is missing.
+func WithRefreshOnMissingKey() TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.RefreshOnMissingKey = true
+		return nil
+	}
+}
+
+// WithRequestCompression gzips the nonced request bodies. The bastion must
+// decompress them, with the Decompress middleware for example.
+func WithRequestCompression() TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.CompressRequests = true
+		return nil
+	}
+}
+
+// WithRetries sets the number of times a failed nonce fetch or nonced
+// operation is retried.
+func WithRetries(n int) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.MaxRetries = n
+		return nil
+	}
+}
+
+// WithRootCAs sets the certificate authorities used to verify the bastion
+// certificate. If not set the system pool is used.
+func WithRootCAs(pool *x509.CertPool) TransportOption {
+	return func(ht *HttpTransport) error {
+		t, err := ht.httpTransport()
+		if err != nil {
+			return err
+		}
+		tlsClientConfig(t).RootCAs = pool
+		return nil
+	}
+}
+
+// WithRoundTripper sets the round tripper used for the nonce, directory and
+// nonced operation requests, like an HTTP/3 round tripper from quic-go,
+// keeping such dependencies out of the module. The options tuning the
+// http.Transport, like WithMaxIdleConns, fail if applied after it.
+func WithRoundTripper(rt http.RoundTripper) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.Client.Transport = rt
+		return nil
+	}
+}
+
+// WithNonceValidator sets the function validating the nonces before they are
+// used, checking their length, charset or signature for example.
+func WithNonceValidator(v func(string) error) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.NonceValidator = v
+		return nil
+	}
+}
+
+// WithNonceTimeout sets the deadline for the new nonce request.
+func WithNonceTimeout(d time.Duration) TransportOption {
+	return func(ht *HttpTransport) error {
+		ht.NonceTimeout = d
+		return nil
+	}
+}
+
+// NewHttpTransport initializes a new HttpTransport with the given URL, nonce
+// key and options. If the nonce key is empty DefaultNonceHeader is used.
+// Unless a CheckRedirect is set by the options, redirects to another host drop
+// the nonce header.
+func NewHttpTransport(url string, nonceKey string,
+	opts ...TransportOption) (*HttpTransport, error) {
+	if nonceKey == "" {
+		nonceKey = DefaultNonceHeader
+	}
+	ht := &HttpTransport{
+		DirectoryKeys:  []string{"newNonce"},
+		Marshaler:      json.Marshal,
+		Pool:           NewNoncePool(),
+		RefillBatch:    10,
+		RefillInterval: DefaultRefillInterval,
+		RefillLowWater: 5,
+		Url:            url,
+		nonceKey:       nonceKey,
+	}
+	for _, opt := range opts {
+		err := opt(ht)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ht.Client.CheckRedirect == nil {
+		ht.Client.CheckRedirect = ht.checkRedirect
+	}
+	return ht, nil
+}
+
+// checkRedirect follows up to 10 redirects, like the default policy, dropping
+// the nonce header when redirected to another host, so nonces don't leak to
+// the redirect target.
+func (ht *HttpTransport) checkRedirect(req *http.Request,
+	via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del(ht.nonceKey)
+	}
+	return nil
+}
+
+// httpTransport returns the *http.Transport used by the client, cloning
+// http.DefaultTransport if the client has none.
+func (ht *HttpTransport) httpTransport() (*http.Transport, error) {
+	if ht.Client.Transport == nil {
+		ht.Client.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	t, ok := ht.Client.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("the client round tripper isn't an http.Transport")
+	}
+	return t, nil
+}
+
+// tlsClientConfig returns the TLS configuration of the transport, creating it
+// if the transport has none.
+func tlsClientConfig(t *http.Transport) *tls.Config {
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	return t.TLSClientConfig
 }
 
-// NewHttpTransport initializes a new HttpTransport with the given URL and
-// nonce key.
-func NewHttpTransport(url string, nonceKey string) *HttpTransport {
-	return &HttpTransport{
-		http.Client{},
-		url,
-		nonceKey,
+// MustNewHttpTransport is like NewHttpTransport but panics if an option
+// fails.
+func MustNewHttpTransport(url string, nonceKey string,
+	opts ...TransportOption) *HttpTransport {
+	ht, err := NewHttpTransport(url, nonceKey, opts...)
+	if err != nil {
+		panic(err)
 	}
+	return ht
 }
 
 // Directory returns a map of available resources, including the URL for new
-// nonce generation. This method should be overridden if the developer needs
-// to retrieve dynamic data from the server's directory.
+// nonce generation. If a DirectoryProvider is set the directory is resolved
+// by it. This method should be overridden if the developer needs to retrieve
+// dynamic data from the server's directory in a different way.
 func (ht *HttpTransport) Directory() (map[string]interface{}, error) {
+	if ht.DirectoryProvider != nil {
+		return ht.DirectoryProvider.Directory()
+	}
 	return map[string]interface{}{
 		"newNonce": ht.Url + "/nonce/new-nonce",
 	}, nil
 }
 
-// NewNonceUrl returns the URL for generating a new nonce. Developers should
+// TypedDirectory returns the directory as a Directory.
+func (ht *HttpTransport) TypedDirectory() (*Directory, error) {
+	d, err := ht.Directory()
+	if err != nil {
+		return nil, err
+	}
+	return NewDirectory(d), nil
+}
+
+// DirectoryMeta returns the meta object of the directory, holding the
+// bastion metadata, like rate limits or supported algorithms. It returns an
+// empty map if the directory has no meta object, and an error if the meta
+// entry isn't an object.
+func (ht *HttpTransport) DirectoryMeta() (map[string]interface{}, error) {
+	d, err := ht.Directory()
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := d["meta"]
+	if !ok {
+		return map[string]interface{}{}, nil
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the directory meta entry is a %T, not an "+
+			"object", meta)
+	}
+	return m, nil
+}
+
+// NewNonceUrl returns the URL for generating a new nonce, found under the
+// first of the DirectoryKeys present in the directory. Developers should
 // override this method if the new nonce URL needs to be resolved differently.
 func (ht *HttpTransport) NewNonceUrl() (string, error) {
+	return ht.refreshingLookup(ErrNonceKeyNotFound, func() (string, error) {
+		d, err := ht.Directory()
+		if err != nil {
+			return "", err
+		}
+		for _, key := range ht.DirectoryKeys {
+			url, err := ht.resolveEndpoint(d, key)
+			if errors.Is(err, ErrDirectoryKeyNotFound) {
+				continue
+			}
+			return url, err
+		}
+		return "", ErrNonceKeyNotFound
+	})
+}
+
+// ResolveEndpoint returns the URL found under the given key in the directory.
+// Relative URLs are resolved against the directory URL. A key missing from
+// the directory returns an error wrapping ErrDirectoryKeyNotFound, after
+// a directory refresh if RefreshOnMissingKey is set.
+func (ht *HttpTransport) ResolveEndpoint(key string) (string, error) {
+	return ht.refreshingLookup(ErrDirectoryKeyNotFound,
+		func() (string, error) {
+			d, err := ht.Directory()
+			if err != nil {
+				return "", err
+			}
+			return ht.resolveEndpoint(d, key)
+		})
+}
+
+// refreshingLookup runs the directory lookup, and if RefreshOnMissingKey is
+// set and it fails with the missing key error, refreshes the directory and
+// runs it once again.
+func (ht *HttpTransport) refreshingLookup(missing error,
+	lookup func() (string, error)) (string, error) {
+	url, err := lookup()
+	if !ht.RefreshOnMissingKey || ht.DirectoryProvider == nil ||
+		!errors.Is(err, missing) {
+		return url, err
+	}
+	rerr := RefreshDirectory(ht.DirectoryProvider)
+	if rerr != nil {
+		return "", fmt.Errorf("%w: %w", err, rerr)
+	}
+	return lookup()
+}
+
+// resolveEndpoint resolves the key in the given directory.
+func (ht *HttpTransport) resolveEndpoint(d map[string]interface{},
+	key string) (string, error) {
+	endpoint, ok := d[key].(string)
+	if !ok || endpoint == "" {
+		return "", fmt.Errorf("%w %q", ErrDirectoryKeyNotFound, key)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.IsAbs() {
+		return endpoint, nil
+	}
+	base, err := url.Parse(ht.directoryUrl())
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+// directoryUrl returns the URL the directory was fetched from, falling back
+// to Url if the directory isn't served over HTTP.
+func (ht *HttpTransport) directoryUrl() string {
+	if ht.DirectoryProvider != nil {
+		location := ht.DirectoryProvider.GetUrl()
+		if strings.HasPrefix(location, "http://") ||
+			strings.HasPrefix(location, "https://") {
+			return location
+		}
+	}
+	return ht.Url
+}
+
+// NewNoncesUrl returns the URL for generating nonces in batch, found under
+// the newNonces directory key.
+func (ht *HttpTransport) NewNoncesUrl() (string, error) {
 	d, err := ht.Directory()
 	if err != nil {
 		return "", err
 	}
-	return d["newNonce"].(string), nil
+	url, ok := d["newNonces"].(string)
+	if !ok || url == "" {
+		return "", errors.New(
+			"the transport wasn't able to find the new nonces key")
+	}
+	return url, nil
+}
+
+// checkEpoch records the NonceEpochHeader of the response, flushing the Pool
+// if the epoch changed, as the pooled nonces were issued under the previous
+// epoch.
+func (ht *HttpTransport) checkEpoch(res *http.Response) {
+	epoch := res.Header.Get(NonceEpochHeader)
+	if epoch == "" {
+		return
+	}
+	ht.epochMu.Lock()
+	defer ht.epochMu.Unlock()
+	if ht.epoch != "" && ht.epoch != epoch && ht.Pool != nil {
+		ht.Pool.Clear()
+	}
+	ht.epoch = epoch
+}
+
+// Ping checks the bastion is alive with a HEAD request to the directory URL,
+// or the new nonce URL if the directory isn't served over HTTP. It returns nil
+// if the bastion answers with a successful status. Network errors wrap
+// ErrBastionUnreachable, unsuccessful statuses are returned as a StatusError.
+func (ht *HttpTransport) Ping(ctx context.Context) error {
+	url := ht.directoryUrl()
+	if dp, ok := ht.DirectoryProvider.(*HttpDirectoryProvider); !ok ||
+		dp.Url == "" {
+		var err error
+		url, err = ht.NewNonceUrl()
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := ht.do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBastionUnreachable, err)
+	}
+	res.Body.Close()
+	if res.StatusCode > 299 {
+		return newStatusError(res)
+	}
+	return nil
 }
 
 // ResolveNonce extracts the nonce from the response headers using the
-// predefined nonceKey. Developers should override this method if the nonce
-// needs to be resolved in a different way.
+// predefined nonceKey, or from the NonceCookie cookie if the header is
+// missing. Developers should override this method if the nonce needs to be
+// resolved in a different way.
 func (ht *HttpTransport) ResolveNonce(res *http.Response) string {
-	return res.Header.Get(ht.nonceKey)
+	nonce := res.Header.Get(ht.nonceKey)
+	if nonce != "" || ht.NonceCookie == "" {
+		return nonce
+	}
+	for _, c := range res.Cookies() {
+		if c.Name == ht.NonceCookie {
+			return c.Value
+		}
+	}
+	return ""
 }
 
 // NewNonce generates a new nonce by making an HTTP HEAD request to the new
@@ -81,23 +599,406 @@ func (ht *HttpTransport) ResolveNonce(res *http.Response) string {
 // implementation is provided, but customization should be done in the
 // dependent methods. If further customization is needed, developers can use
 // this method as a template.
+//
+// A successful response without a nonce, like a 204 No Content missing the
+// nonce header, is returned as an error.
+//
+// If the Pool has nonces buffered by NewNonces the oldest one is returned
+// without making a request.
+//
+// Nonces failing the NonceValidator are discarded and another one is fetched,
+// up to MaxNonceAttempts requests, after which an error wrapping
+// ErrInvalidNonce is returned.
 func (ht *HttpTransport) NewNonce() (string, error) {
+	for ht.Pool != nil {
+		nonce, ok := ht.Pool.Get()
+		ht.wakeRefill()
+		if !ok {
+			break
+		}
+		if ht.validate(nonce) == nil {
+			return nonce, nil
+		}
+	}
+	var err error
+	for i := 0; i < MaxNonceAttempts; i++ {
+		var nonce string
+		nonce, err = ht.fetchNonce()
+		if err != nil {
+			return "", err
+		}
+		err = ht.validate(nonce)
+		if err == nil {
+			return nonce, nil
+		}
+	}
+	return "", err
+}
+
+// fetchNonce requests a new nonce from the new nonce URL.
+func (ht *HttpTransport) fetchNonce() (string, error) {
+	url, err := ht.NewNonceUrl()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := withTimeout(context.Background(), ht.NonceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := ht.do(req)
+	if err != nil {
+		return "", err
+	}
+	// The body of a HEAD response is empty, but it must be closed to release
+	// the connection for reuse.
+	defer res.Body.Close()
+	if res.StatusCode > 299 {
+		return "", newStatusError(res)
+	}
+	ht.checkEpoch(res)
+	nonce := ht.ResolveNonce(res)
+	if nonce == "" {
+		return "", ErrNoNonceReturned
+	}
+	return nonce, nil
+}
+
+// NewBoundNonce posts the body as a JSON challenge, like the client
+// identity, to the new nonce URL and returns the nonce the bastion bound to
+// it. The body is serialized with the Marshaler. Bound nonces aren't pooled.
+func (ht *HttpTransport) NewBoundNonce(body any) (string, error) {
+	b, err := ht.marshal(body)
+	if err != nil {
+		return "", err
+	}
 	url, err := ht.NewNonceUrl()
 	if err != nil {
 		return "", err
 	}
-	req, err := http.NewRequest(http.MethodHead, url, nil)
+	ctx, cancel := withTimeout(context.Background(), ht.NonceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		bytes.NewReader(b))
 	if err != nil {
 		return "", err
 	}
-	res, err := ht.Client.Do(req)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := ht.do(req)
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
 	if res.StatusCode > 299 {
-		return "", errors.New(res.Status)
+		return "", newStatusError(res)
+	}
+	ht.checkEpoch(res)
+	nonce := ht.ResolveNonce(res)
+	if nonce == "" {
+		return "", ErrNoNonceReturned
+	}
+	err = ht.validate(nonce)
+	if err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// NewNonces fetches n nonces in a single GET request to the new nonces URL
+// and buffers them in the Pool, so subsequent NewNonce calls are served
+// without a round trip. The fetched nonces are returned for inspection; they
+// remain in the Pool. Nonces failing the NonceValidator are discarded, so
+// fewer than n nonces may be returned.
+func (ht *HttpTransport) NewNonces(n int) ([]string, error) {
+	return ht.newNonces(context.Background(), n)
+}
+
+func (ht *HttpTransport) newNonces(parent context.Context,
+	n int) ([]string, error) {
+	if n < 1 {
+		return nil, errors.New("the number of nonces must be positive")
+	}
+	url, err := ht.NewNoncesUrl()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(parent, ht.NonceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("n", strconv.Itoa(n))
+	req.URL.RawQuery = q.Encode()
+	res, err := ht.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode > 299 {
+		return nil, newStatusError(res)
+	}
+	nonces := []string{}
+	err = json.NewDecoder(res.Body).Decode(&nonces)
+	if err != nil {
+		return nil, err
+	}
+	valid := nonces[:0]
+	for _, nonce := range nonces {
+		if ht.validate(nonce) == nil {
+			valid = append(valid, nonce)
+		}
+	}
+	if ht.Pool == nil {
+		ht.Pool = NewNoncePool()
+	}
+	ht.checkEpoch(res)
+	ht.Pool.Put(valid...)
+	return valid, nil
+}
+
+// NoncedGet sends a GET request with a fresh nonce to the endpoint found
+// under the given directory key. See NoncedDo.
+func (ht *HttpTransport) NoncedGet(directoryKey string) (*http.Response,
+	error) {
+	return ht.NoncedDo(http.MethodGet, directoryKey, nil)
+}
+
+// NoncedPost sends a POST request with a fresh nonce and the given body to the
+// endpoint found under the given directory key. See NoncedDo.
+func (ht *HttpTransport) NoncedPost(directoryKey string,
+	body io.Reader) (*http.Response, error) {
+	return ht.NoncedDo(http.MethodPost, directoryKey, body)
+}
+
+// NoncedPostJSON serializes v with the Marshaler and posts it to the URL
+// found under the directory key like NoncedPost, with an application/json
+// content type.
+func (ht *HttpTransport) NoncedPostJSON(directoryKey string,
+	v any) (*http.Response, error) {
+	b, err := ht.marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return ht.noncedDo(context.Background(), http.MethodPost, directoryKey,
+		"", bytes.NewReader(b), "application/json")
+}
+
+// NoncedGetWithNonce works like NoncedGet, sending the given nonce instead of
+// fetching a fresh one.
+func (ht *HttpTransport) NoncedGetWithNonce(directoryKey,
+	nonce string) (*http.Response, error) {
+	return ht.NoncedDoWithNonce(http.MethodGet, directoryKey, nonce, nil)
+}
+
+// NoncedPostWithNonce works like NoncedPost, sending the given nonce instead
+// of fetching a fresh one.
+func (ht *HttpTransport) NoncedPostWithNonce(directoryKey, nonce string,
+	body io.Reader) (*http.Response, error) {
+	return ht.NoncedDoWithNonce(http.MethodPost, directoryKey, nonce, body)
+}
+
+// NoncedDoWithNonce works like NoncedDo, sending the given nonce, obtained by
+// the caller, instead of fetching a fresh one. An empty nonce is fetched as
+// usual.
+func (ht *HttpTransport) NoncedDoWithNonce(method, directoryKey, nonce string,
+	body io.Reader) (*http.Response, error) {
+	return ht.noncedDo(context.Background(), method, directoryKey, nonce,
+		body, "")
+}
+
+// NoncedDo sends a request with a fresh nonce to the endpoint found under the
+// given directory key. The nonce issued in the response, if any, is harvested
+// into the Pool to be used by the next request. Unsuccessful statuses aren't
+// errors, the caller must check the response and close its body.
+func (ht *HttpTransport) NoncedDo(method, directoryKey string,
+	body io.Reader) (*http.Response, error) {
+	return ht.noncedDo(context.Background(), method, directoryKey, "", body,
+		"")
+}
+
+// noncedDo works like NoncedDo within the given context, sending the given
+// nonce if not empty and setting the request content type if given. Failed
+// requests are retried up to MaxRetries times with fresh nonces, when
+// retryOperation allows it.
+func (ht *HttpTransport) noncedDo(ctx context.Context, method, directoryKey,
+	nonce string, body io.Reader, contentType string) (*http.Response,
+	error) {
+	d, err := ht.Directory()
+	if err != nil {
+		return nil, err
+	}
+	url, err := ht.resolveEndpoint(d, directoryKey)
+	if err != nil {
+		return nil, err
+	}
+	base, err := ht.newRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		base.Header.Set("Content-Type", contentType)
+	}
+	return ht.sendNonced(ctx, base, nonce)
+}
+
+// sendNonced sends a clone of the base request with the nonce placed by
+// injectNonce, fetching a fresh nonce if the given one is empty. The base
+// request is kept without a nonce, so each retry places its nonce in a fresh
+// clone instead of next to the nonce of the previous attempt. The nonce of
+// the response is harvested into the Pool.
+func (ht *HttpTransport) sendNonced(ctx context.Context, base *http.Request,
+	nonce string) (*http.Response, error) {
+	var err error
+	if nonce == "" {
+		nonce, err = ht.retryNonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req := base.Clone(ctx)
+	ht.injectNonce(req, nonce)
+	res, err := ht.do(req)
+	for attempt := 0; attempt < ht.MaxRetries &&
+		retryOperation(req, res, err); attempt++ {
+		var retryAfter time.Duration
+		if res != nil {
+			retryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+			res.Body.Close()
+		}
+		err = sleep(ctx, retryDelay(attempt, retryAfter))
+		if err != nil {
+			return nil, err
+		}
+		nonce, err = ht.retryNonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req = base.Clone(ctx)
+		if base.GetBody != nil {
+			req.Body, err = base.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		ht.injectNonce(req, nonce)
+		res, err = ht.do(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ht.checkEpoch(res)
+	nonce = ht.ResolveNonce(res)
+	if nonce != "" && ht.Pool != nil && ht.validate(nonce) == nil {
+		ht.Pool.Put(nonce)
+	}
+	return res, nil
+}
+
+// NewNoncedRequest creates a new request with a fresh nonce placed by the
+// NonceInjector, or set under the transport nonce key if there is none.
+//
+// The body is streamed, never buffered, unless CompressRequests is set. In
+// that case the body is gzipped into a buffer and sent with the gzip
+// Content-Encoding. Content-Length is set when the body length is known, from
+// its Len or Stat methods, otherwise the body is sent chunked.
+func (ht *HttpTransport) NewNoncedRequest(ctx context.Context, method,
+	url string, body io.Reader) (*http.Request, error) {
+	nonce, err := ht.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	return ht.NewRequestWithNonce(ctx, method, url, nonce, body)
+}
+
+// NewRequestWithNonce creates a new request carrying the given nonce, placed
+// like NewNoncedRequest does.
+func (ht *HttpTransport) NewRequestWithNonce(ctx context.Context, method,
+	url, nonce string, body io.Reader) (*http.Request, error) {
+	req, err := ht.newRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	ht.injectNonce(req, nonce)
+	return req, nil
+}
+
+// newRequest creates the request sent by NewRequestWithNonce, without the
+// nonce.
+func (ht *HttpTransport) newRequest(ctx context.Context, method, url string,
+	body io.Reader) (*http.Request, error) {
+	compressed := ht.CompressRequests && body != nil
+	if compressed {
+		var err error
+		body, err = gzipBody(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
-	return ht.ResolveNonce(res), nil
+	if body != nil && req.ContentLength == 0 {
+		req.ContentLength = bodyLength(body)
+	}
+	return req, nil
+}
+
+// injectNonce places the nonce in the request with the NonceInjector, or sets
+// it under the transport nonce key if there is none.
+func (ht *HttpTransport) injectNonce(req *http.Request, nonce string) {
+	if ht.NonceInjector != nil {
+		ht.NonceInjector(req, nonce)
+		return
+	}
+	req.Header.Set(ht.nonceKey, nonce)
+}
+
+// validate checks the nonce with the NonceValidator, if any, wrapping its
+// error in ErrInvalidNonce.
+func (ht *HttpTransport) validate(nonce string) error {
+	if ht.NonceValidator == nil {
+		return nil
+	}
+	err := ht.NonceValidator(nonce)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidNonce, err)
+	}
+	return nil
+}
+
+// marshal serializes the request body with the Marshaler, or json.Marshal if
+// there is none.
+func (ht *HttpTransport) marshal(v any) ([]byte, error) {
+	if ht.Marshaler == nil {
+		return json.Marshal(v)
+	}
+	return ht.Marshaler(v)
+}
+
+// do applies the Interceptors to the request and sends it.
+func (ht *HttpTransport) do(req *http.Request) (*http.Response, error) {
+	for _, intercept := range ht.Interceptors {
+		err := intercept(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ht.Client.Do(req)
+}
+
+// Close stops the nonce refill loop and releases idle connections held by the
+// underlying http.Client.
+func (ht *HttpTransport) Close() error {
+	ht.StopNonceRefill()
+	ht.Client.CloseIdleConnections()
+	return nil
 }
 
 // Peasant represents an agent in the Peasant protocol, which communicates with
@@ -106,11 +1007,33 @@ func (ht *HttpTransport) NewNonce() (string, error) {
 // aspects.
 type Peasant struct {
 	Transport
+	// OperationKeys maps the logical operation names used by the
+	// application to the directory keys of their endpoints. Operations not
+	// mapped are looked up in the directory by their name.
+	OperationKeys map[string]string
 }
 
 // NewPeasant initializes a new Peasant with the provided Transport.
 func NewPeasant(tr Transport) *Peasant {
-	return &Peasant{tr}
+	return &Peasant{Transport: tr}
+}
+
+// NewHTTPPeasant initializes a new Peasant backed by an HttpTransport that
+// resolves its directory from the given URL with an HttpDirectoryProvider.
+func NewHTTPPeasant(directoryUrl string,
+	opts ...TransportOption) (*Peasant, error) {
+	u, err := url.Parse(directoryUrl)
+	if err != nil {
+		return nil, err
+	}
+	base := &url.URL{Scheme: u.Scheme, Host: u.Host}
+	dp := NewHttpDirectoryProvider(directoryUrl)
+	ht, err := NewHttpTransport(base.String(), DefaultNonceHeader,
+		append([]TransportOption{WithDirectoryProvider(dp)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return NewPeasant(ht), nil
 }
 
 // NewNonce generates a new nonce by delegating the call to the underlying
@@ -121,6 +1044,184 @@ func (p *Peasant) NewNonce() (string, error) {
 	return p.Transport.NewNonce()
 }
 
+// EndpointResolver is implemented by transports resolving directory keys to
+// endpoint URLs, like HttpTransport.
+type EndpointResolver interface {
+	ResolveEndpoint(key string) (string, error)
+}
+
+// ResolveEndpoint returns the URL found under the given key in the bastion
+// directory. If the Transport implements EndpointResolver the call is
+// delegated to it, otherwise the key is looked up in the Transport directory.
+func (p *Peasant) ResolveEndpoint(key string) (string, error) {
+	r, ok := p.Transport.(EndpointResolver)
+	if ok {
+		return r.ResolveEndpoint(key)
+	}
+	d, err := p.Transport.Directory()
+	if err != nil {
+		return "", err
+	}
+	endpoint, ok := d[key].(string)
+	if !ok || endpoint == "" {
+		return "", fmt.Errorf("%w %q", ErrDirectoryKeyNotFound, key)
+	}
+	return endpoint, nil
+}
+
+// Operations returns the sorted keys of the operations listed in the bastion
+// directory. The "meta" key and entries that aren't URLs, like metadata
+// objects, are excluded. The directory is resolved by the Transport, so any
+// directory cache is reused.
+func (p *Peasant) Operations() ([]string, error) {
+	d, err := p.Transport.Directory()
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]string, 0, len(d))
+	for key, value := range d {
+		if key == "meta" {
+			continue
+		}
+		if _, ok := value.(string); !ok {
+			continue
+		}
+		ops = append(ops, key)
+	}
+	sort.Strings(ops)
+	return ops, nil
+}
+
+// DirectoryKey returns the directory key the operation is mapped to in
+// OperationKeys, or the operation name itself if it isn't mapped.
+func (p *Peasant) DirectoryKey(op string) string {
+	key, ok := p.OperationKeys[op]
+	if !ok {
+		return op
+	}
+	return key
+}
+
+// Do sends a nonced request to the endpoint of the operation, resolving its
+// directory key with DirectoryKey. A nil body is sent as a GET request,
+// otherwise as a POST request. See HttpTransport.NoncedDo.
+//
+// The Peasant Transport must be an HttpTransport.
+func (p *Peasant) Do(op string, body io.Reader) (*http.Response, error) {
+	ht, ok := p.Transport.(*HttpTransport)
+	if !ok {
+		return nil, ErrTransportCast
+	}
+	method := http.MethodGet
+	if body != nil {
+		method = http.MethodPost
+	}
+	return ht.NoncedDo(method, p.DirectoryKey(op), body)
+}
+
+// DoJSON sends a nonced request to the endpoint of the operation, resolving
+// its directory key with DirectoryKey, and decodes the JSON response into
+// a T. A nil body is sent as a GET request, otherwise the body is serialized
+// with the transport Marshaler and sent as a JSON POST request. Unsuccessful
+// statuses are returned as a StatusError.
+//
+// The Peasant Transport must be an HttpTransport.
+func DoJSON[T any](p *Peasant, ctx context.Context, op string,
+	body any) (T, error) {
+	var result T
+	ht, ok := p.Transport.(*HttpTransport)
+	if !ok {
+		return result, ErrTransportCast
+	}
+	method := http.MethodGet
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		b, err := ht.marshal(body)
+		if err != nil {
+			return result, err
+		}
+		method = http.MethodPost
+		reader = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	res, err := ht.noncedDo(ctx, method, p.DirectoryKey(op), "", reader,
+		contentType)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode > 299 {
+		return result, newStatusError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Close stops any background work held by the Peasant and releases its
+// resources. If the underlying Transport implements io.Closer its Close method
+// is called.
+//
+// Callers should defer Close right after creating a Peasant.
+func (p *Peasant) Close() error {
+	c, ok := p.Transport.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+// gzipBody returns a reader over the gzipped body.
+func gzipBody(body io.Reader) (*bytes.Reader, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := io.Copy(zw, body)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// bodyLength returns the number of bytes left in the body, or -1 if it isn't
+// known.
+func bodyLength(body io.Reader) int64 {
+	switch b := body.(type) {
+	case interface{ Len() int }:
+		return int64(b.Len())
+	case interface {
+		io.Seeker
+		Stat() (fs.FileInfo, error)
+	}:
+		info, err := b.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := b.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
+
+// withTimeout returns a context with the given timeout, or the parent context
+// if the timeout is zero.
+func withTimeout(parent context.Context,
+	d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, d)
+}
+
 // BodyAsString reads the entire body of an HTTP response and returns it as a
 // string.
 // It consumes the response body, so the caller should not attempt to read from
@@ -15,12 +15,31 @@
 package peasant
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/candango/gopeasant/dummy"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,7 +75,7 @@ func (tt *TestTransport) DoSomething(t *testing.T) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	req.Header.Add("nonce", nonce)
+	req.Header.Add(DefaultNonceHeader, nonce)
 
 	res, err := tt.Client.Do(req)
 	if err != nil {
@@ -86,8 +105,24 @@ func (p *TestPeasant) DoSomething(t *testing.T) (string, error) {
 	return p.Transport.(*TestTransport).DoSomething(t)
 }
 
+func GetDirectory(w http.ResponseWriter, r *http.Request) {
+	DirectoryHandlerFunc(func(r *http.Request) (map[string]any, error) {
+		base := "http://" + r.Host
+		return map[string]interface{}{
+			"newNonce":      base + "/nonce/new-nonce",
+			"newNonces":     base + "/nonce/new-nonces",
+			"doSomething":   base + "/nonce/do-nonced-something",
+			"postSomething": base + "/nonce/post-nonced-something",
+			"meta": map[string]interface{}{
+				"website": "https://github.com/candango/gopeasant",
+			},
+		}, nil
+	}).ServeHTTP(w, r)
+}
+
 func NewServer(t *testing.T) *httptest.Server {
 	handler := http.NewServeMux()
+	handler.HandleFunc("/directory", GetDirectory)
 	handler.Handle("/nonce/", http.StripPrefix(
 		"/nonce", NewNoncedFuncServeMux(t)))
 	return httptest.NewServer(handler)
@@ -95,7 +130,7 @@ func NewServer(t *testing.T) *httptest.Server {
 
 func TestHttpTransport(t *testing.T) {
 	server := NewServer(t)
-	ht := NewHttpTransport(server.URL, "Nonce")
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
 
 	t.Run("Plain Peasant and Transport", func(t *testing.T) {
 		p := NewPeasant(ht)
@@ -115,4 +150,1328 @@ func TestHttpTransport(t *testing.T) {
 		assert.True(t, strings.HasPrefix(something, "Func done with nonce "))
 
 	})
+
+	t.Run("Nonced request", func(t *testing.T) {
+		req, err := ht.NewNoncedRequest(context.Background(), http.MethodGet,
+			server.URL+"/nonce/do-nonced-something", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		nonce := req.Header.Get(DefaultNonceHeader)
+		assert.Equal(t, 32, len(nonce))
+
+		res, err := ht.Client.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "200 OK", res.Status)
+		assert.Equal(t, "Func done with nonce "+nonce, b)
+	})
+}
+
+func TestPeasantClose(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+	p := NewPeasant(ht)
+	for i := 0; i < 3; i++ {
+		nonce, err := p.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+	}
+	assert.Greater(t, runtime.NumGoroutine(), before)
+
+	err := p.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDefaultNonceHeader(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, "")
+	assert.Equal(t, DefaultNonceHeader, ht.nonceKey)
+
+	t.Run("Client and server agree by default", func(t *testing.T) {
+		p := NewTestPesant(NewPeasant(NewTestTransport(ht)))
+		something, err := p.DoSomething(t)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, strings.HasPrefix(something, "Func done with nonce "))
+	})
+}
+
+func TestNewHTTPPeasant(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	t.Run("Fetch a nonce", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		ht := p.Transport.(*HttpTransport)
+		assert.Equal(t, server.URL, ht.Url)
+		assert.Equal(t, ht, ht.DirectoryProvider.(*HttpDirectoryProvider).HttpTransport)
+
+		nonce, err := p.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 32, len(nonce))
+	})
+
+	t.Run("Option error", func(t *testing.T) {
+		_, err := NewHTTPPeasant(server.URL+"/directory",
+			func(ht *HttpTransport) error {
+				return errors.New("option failed")
+			})
+		assert.EqualError(t, err, "option failed")
+	})
+}
+
+type UnwirableDirectoryProvider struct {
+	*HttpDirectoryProvider
+}
+
+func (p *UnwirableDirectoryProvider) SetTransport(tr Transport) error {
+	return errors.New("can't set the transport")
+}
+
+func TestMustNewHttpTransport(t *testing.T) {
+	t.Run("Transport created", func(t *testing.T) {
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader)
+		assert.Equal(t, "http://bastion", ht.Url)
+	})
+
+	t.Run("Panic on option error", func(t *testing.T) {
+		dp := &UnwirableDirectoryProvider{NewHttpDirectoryProvider("")}
+		assert.PanicsWithError(t, "can't set the transport", func() {
+			MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+				WithDirectoryProvider(dp))
+		})
+	})
+}
+
+func NewSlowDirectoryServer(t *testing.T, delay time.Duration) *httptest.Server {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/directory",
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			GetDirectory(w, r)
+		})
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+		})
+	return httptest.NewServer(handler)
+}
+
+func TestHttpTransportTimeouts(t *testing.T) {
+	server := NewSlowDirectoryServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	t.Run("Distinct directory and nonce timeouts", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL+"/directory",
+			WithDirectoryTimeout(time.Second),
+			WithNonceTimeout(50*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		nonce, err := p.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+	})
+
+	t.Run("Directory timeout exceeded", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL+"/directory",
+			WithDirectoryTimeout(20*time.Millisecond),
+			WithNonceTimeout(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		_, err = p.NewNonce()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestNoContentNonce(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	handler.HandleFunc("/nonced/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	t.Run("No content without a nonce", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		nonce, err := ht.NewNonce()
+		assert.EqualError(t, err, "server returned no nonce")
+		assert.Empty(t, nonce)
+	})
+
+	t.Run("No content with a nonce", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL+"/nonced", DefaultNonceHeader)
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+	})
+}
+
+func TestDirectoryKeys(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/directory",
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"new-nonce": "http://" + r.Host + "/nonce/new-nonce",
+			})
+		})
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	t.Run("Key found in the fallback list", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL+"/directory",
+			WithDirectoryKeys("newNonce", "new-nonce", "nonce"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		nonce, err := p.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+	})
+
+	t.Run("Key not found", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		_, err = p.NewNonce()
+		assert.EqualError(t, err,
+			"the transport wasn't able to find the nonce key")
+	})
+}
+
+func TestConnectionTuning(t *testing.T) {
+	var conns int32
+	handler := http.NewServeMux()
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+		})
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	t.Run("Options configure the round tripper", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithMaxIdleConns(4), WithIdleConnTimeout(time.Minute),
+			WithForceHTTP2(true))
+		tr := ht.Client.Transport.(*http.Transport)
+		assert.Equal(t, 4, tr.MaxIdleConns)
+		assert.Equal(t, 4, tr.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+		assert.True(t, tr.ForceAttemptHTTP2)
+	})
+
+	t.Run("Connection reused across nonce fetches", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithMaxIdleConns(2), WithIdleConnTimeout(time.Minute))
+		defer ht.Close()
+		atomic.StoreInt32(&conns, 0)
+		for i := 0; i < 5; i++ {
+			_, err := ht.NewNonce()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+	})
+
+	t.Run("Custom round tripper", func(t *testing.T) {
+		_, err := NewHttpTransport(server.URL, DefaultNonceHeader,
+			WithRoundTripper(http.NewFileTransport(http.Dir("."))),
+			WithMaxIdleConns(2))
+		assert.EqualError(t, err,
+			"the client round tripper isn't an http.Transport")
+	})
+
+	t.Run("Connection reused by a counting round tripper", func(t *testing.T) {
+		var dials int32
+		dialer := &net.Dialer{}
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithRoundTripper(&http.Transport{
+				DialContext: func(ctx context.Context, network,
+					addr string) (net.Conn, error) {
+					atomic.AddInt32(&dials, 1)
+					return dialer.DialContext(ctx, network, addr)
+				},
+			}))
+		defer ht.Close()
+		for i := 0; i < 5; i++ {
+			_, err := ht.NewNonce()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("Nonce fetched through the round tripper", func(t *testing.T) {
+		var trips int32
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithRoundTripper(RoundTripperFunc(
+				func(r *http.Request) (*http.Response, error) {
+					atomic.AddInt32(&trips, 1)
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, r)
+					return rec.Result(), nil
+				})))
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&trips))
+	})
+}
+
+// RoundTripperFunc adapts a function to an http.RoundTripper.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestNewNonces(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	t.Run("Fill the pool", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		ht := p.Transport.(*HttpTransport)
+		nonces, err := ht.NewNonces(3)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Len(t, nonces, 3)
+		assert.Equal(t, 3, ht.Pool.Len())
+
+		for _, expected := range nonces {
+			nonce, err := p.NewNonce()
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, expected, nonce)
+		}
+		assert.Equal(t, 0, ht.Pool.Len())
+
+		nonce, err := p.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Len(t, nonce, 32)
+		assert.NotContains(t, nonces, nonce)
+	})
+
+	t.Run("Pooled nonces are accepted", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		ht := p.Transport.(*HttpTransport)
+		_, err = ht.NewNonces(2)
+		if err != nil {
+			t.Error(err)
+		}
+		req, err := ht.NewNoncedRequest(context.Background(), http.MethodGet,
+			server.URL+"/nonce/do-nonced-something", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		res, err := ht.Client.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("No new nonces key", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		_, err := ht.NewNonces(3)
+		assert.EqualError(t, err,
+			"the transport wasn't able to find the new nonces key")
+	})
+}
+
+func TestOperations(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	t.Run("Operations from the directory", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		ops, err := p.Operations()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, []string{"doSomething", "newNonce", "newNonces",
+			"postSomething"}, ops)
+	})
+
+	t.Run("Directory error", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		_, err = p.Operations()
+		assert.Error(t, err)
+	})
+}
+
+type PatternReader struct{}
+
+func (PatternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte('a' + i%26)
+	}
+	return len(p), nil
+}
+
+func TestStreamedBody(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+		})
+	handler.HandleFunc("/upload",
+		func(w http.ResponseWriter, r *http.Request) {
+			n, err := io.Copy(io.Discard, r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%d %d", n, r.ContentLength)
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce": server.URL + "/new-nonce",
+				"upload":   server.URL + "/upload",
+			})))
+	size := int64(16 << 20)
+	upload := func(body io.Reader) string {
+		res, err := ht.NoncedPost("upload", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		return b
+	}
+
+	t.Run("Unknown length streamed chunked", func(t *testing.T) {
+		assert.Equal(t, fmt.Sprintf("%d -1", size),
+			upload(io.LimitReader(PatternReader{}, size)))
+	})
+
+	t.Run("Content-Length from a file", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = io.Copy(f, io.LimitReader(PatternReader{}, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Seek(1024, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, fmt.Sprintf("%d %d", size-1024, size-1024),
+			upload(f))
+	})
+}
+
+func TestRedirectNonceHeader(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("nonce: " + r.Header.Get(DefaultNonceHeader)))
+	}
+	target := httptest.NewServer(http.HandlerFunc(echo))
+	defer target.Close()
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader, "a-nonce")
+		})
+	handler.HandleFunc("/echo", echo)
+	handler.HandleFunc("/same-host",
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/echo", http.StatusFound)
+		})
+	handler.HandleFunc("/cross-host",
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target.URL, http.StatusFound)
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce":  server.URL + "/new-nonce",
+				"sameHost":  server.URL + "/same-host",
+				"crossHost": server.URL + "/cross-host",
+			})))
+	get := func(key string) string {
+		res, err := ht.NoncedGet(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		return b
+	}
+
+	t.Run("Keep the nonce on same host redirects", func(t *testing.T) {
+		assert.Equal(t, "nonce: a-nonce", get("sameHost"))
+	})
+
+	t.Run("Drop the nonce on cross host redirects", func(t *testing.T) {
+		assert.Equal(t, "nonce: ", get("crossHost"))
+	})
+}
+
+func TestPing(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	t.Run("Healthy bastion", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		assert.NoError(t, p.Transport.(*HttpTransport).Ping(
+			context.Background()))
+	})
+
+	t.Run("Healthy bastion without a directory URL", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		assert.NoError(t, ht.Ping(context.Background()))
+	})
+
+	t.Run("Unhealthy bastion", func(t *testing.T) {
+		p, err := NewHTTPPeasant(server.URL + "/missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		err = p.Transport.(*HttpTransport).Ping(context.Background())
+		var statusErr *StatusError
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+		assert.False(t, errors.Is(err, ErrBastionUnreachable))
+	})
+
+	t.Run("Unreachable bastion", func(t *testing.T) {
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+		p, err := NewHTTPPeasant(unreachable.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		err = p.Transport.(*HttpTransport).Ping(context.Background())
+		assert.True(t, errors.Is(err, ErrBastionUnreachable))
+	})
+}
+
+func TestExplicitNonce(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	nonced := NewNoncedHandler(s)
+	var fetches atomic.Int32
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			nonced.GetNonce(w, r)
+		})
+	handler.HandleFunc("/do-nonced-something",
+		NoncedHandlerFunc(s, nonced.DoNoncedFunc))
+	handler.HandleFunc("/post-nonced-something",
+		NoncedHandlerFunc(s, nonced.DoNoncedPost))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce":      server.URL + "/new-nonce",
+				"doSomething":   server.URL + "/do-nonced-something",
+				"postSomething": server.URL + "/post-nonced-something",
+			})))
+	body := func(res *http.Response) string {
+		defer res.Body.Close()
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		return b
+	}
+
+	t.Run("Get with a seeded nonce", func(t *testing.T) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		res, err := ht.NoncedGetWithNonce("doSomething", "seeded-nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "Func done with nonce seeded-nonce", body(res))
+		assert.Equal(t, int32(0), fetches.Load())
+	})
+
+	t.Run("Post with a seeded nonce", func(t *testing.T) {
+		ht.Pool.Clear()
+		err := s.Seed("other-seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		res, err := ht.NoncedPostWithNonce("postSomething",
+			"other-seeded-nonce", strings.NewReader("a body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Post done with a body", body(res))
+		assert.Equal(t, int32(0), fetches.Load())
+	})
+
+	t.Run("Fetch without a nonce", func(t *testing.T) {
+		ht.Pool.Clear()
+		res, err := ht.NoncedGetWithNonce("doSomething", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		body(res)
+		assert.Equal(t, int32(1), fetches.Load())
+	})
+}
+
+func TestNewBoundNonce(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce", NewNonceHandler(s).GetNonce)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce": server.URL + "/new-nonce",
+			})))
+
+	t.Run("Nonce bound to the challenge", func(t *testing.T) {
+		nonce, err := ht.NewBoundNonce(map[string]string{
+			"identity": "peasant",
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/do-something", nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		challenge, ok := s.Challenge(req)
+		assert.True(t, ok)
+		assert.JSONEq(t, `{"identity":"peasant"}`, string(challenge))
+	})
+
+	t.Run("Invalid challenge", func(t *testing.T) {
+		_, err := ht.NewBoundNonce(json.RawMessage("not json"))
+		assert.Error(t, err)
+	})
+
+	t.Run("Challenge rejected by the bastion", func(t *testing.T) {
+		ht.Marshaler = func(any) ([]byte, error) {
+			return []byte("not json"), nil
+		}
+		defer func() {
+			ht.Marshaler = nil
+		}()
+		_, err := ht.NewBoundNonce("peasant")
+		statusErr := &StatusError{}
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	})
+}
+
+func TestRequestCompression(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	nonced := NewNoncedHandler(s)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce", nonced.GetNonce)
+	var encoding string
+	handler.Handle("/echo", Decompress(http.HandlerFunc(NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			io.Copy(w, r.Body)
+		}))))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithRequestCompression(),
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce": server.URL + "/new-nonce",
+				"echo":     server.URL + "/echo",
+			})))
+
+	t.Run("Gzipped body read decompressed", func(t *testing.T) {
+		payload := strings.Repeat(`{"peasant":"bastion"}`, 100)
+		var sent int64
+		ht.Interceptors = []func(*http.Request) error{
+			func(r *http.Request) error {
+				if r.Method == http.MethodPost {
+					sent = r.ContentLength
+					assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+				}
+				return nil
+			},
+		}
+		defer func() {
+			ht.Interceptors = nil
+		}()
+		res, err := ht.NoncedPost("echo", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, payload, b)
+		assert.Empty(t, encoding)
+		assert.Greater(t, int64(len(payload)), sent)
+	})
+}
+
+func TestPeasantDo(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+	p, err := NewHTTPPeasant(server.URL + "/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.OperationKeys = map[string]string{
+		"greet":  "doSomething",
+		"submit": "postSomething",
+	}
+	body := func(res *http.Response) string {
+		defer res.Body.Close()
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		return b
+	}
+
+	t.Run("Operation resolved by its logical name", func(t *testing.T) {
+		assert.Equal(t, "doSomething", p.DirectoryKey("greet"))
+		res, err := p.Do("greet", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.True(t, strings.HasPrefix(body(res), "Func done with nonce "))
+		res, err = p.Do("submit", strings.NewReader("a body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Post done with a body", body(res))
+	})
+
+	t.Run("Unmapped operation resolved by the directory",
+		func(t *testing.T) {
+			assert.Equal(t, "doSomething", p.DirectoryKey("doSomething"))
+			res, err := p.Do("doSomething", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			res.Body.Close()
+			_, err = p.Do("missing", nil)
+			assert.ErrorIs(t, err, ErrDirectoryKeyNotFound)
+		})
+}
+
+func TestDoJSON(t *testing.T) {
+	type Order struct {
+		Id     int    `json:"id"`
+		Status string `json:"status"`
+	}
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	nonced := NewNoncedHandler(s)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce", nonced.GetNonce)
+	handler.HandleFunc("/order", NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			order := Order{Id: 1, Status: "pending"}
+			if r.Method == http.MethodPost {
+				err := json.NewDecoder(r.Body).Decode(&order)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				order.Status = "created"
+			}
+			json.NewEncoder(w).Encode(order)
+		}))
+	handler.HandleFunc("/missing", NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce": server.URL + "/new-nonce",
+				"order":    server.URL + "/order",
+				"missing":  server.URL + "/missing",
+			})))
+	p := NewPeasant(ht)
+	ctx := context.Background()
+
+	t.Run("Decode a struct response", func(t *testing.T) {
+		order, err := DoJSON[Order](p, ctx, "order", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, Order{Id: 1, Status: "pending"}, order)
+		order, err = DoJSON[Order](p, ctx, "order", Order{Id: 2})
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, Order{Id: 2, Status: "created"}, order)
+	})
+
+	t.Run("Error response", func(t *testing.T) {
+		_, err := DoJSON[Order](p, ctx, "missing", nil)
+		statusErr := &StatusError{}
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	})
+
+	t.Run("Transport isn't an HttpTransport", func(t *testing.T) {
+		_, err := DoJSON[Order](NewPeasant(&DirectoryOnlyTransport{}), ctx,
+			"order", nil)
+		assert.Equal(t, ErrTransportCast, err)
+	})
+}
+
+func TestNonceValidator(t *testing.T) {
+	var fetches atomic.Int32
+	var garbage atomic.Int32
+	handler := http.NewServeMux()
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			if garbage.Add(-1) >= 0 {
+				w.Header().Set(DefaultNonceHeader, "<injected>")
+				return
+			}
+			w.Header().Set(DefaultNonceHeader, "a-valid-nonce")
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	invalid := errors.New("the nonce has invalid characters")
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithNonceValidator(func(nonce string) error {
+			if strings.ContainsAny(nonce, "<>") {
+				return invalid
+			}
+			return nil
+		}))
+
+	t.Run("Injected nonce replaced by a valid one", func(t *testing.T) {
+		fetches.Store(0)
+		garbage.Store(1)
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-valid-nonce", nonce)
+		assert.Equal(t, int32(2), fetches.Load())
+	})
+
+	t.Run("Give up after the attempts limit", func(t *testing.T) {
+		fetches.Store(0)
+		garbage.Store(MaxNonceAttempts)
+		_, err := ht.NewNonce()
+		assert.ErrorIs(t, err, ErrInvalidNonce)
+		assert.ErrorIs(t, err, invalid)
+		assert.Equal(t, int32(MaxNonceAttempts), fetches.Load())
+	})
+
+	t.Run("Invalid pooled nonces discarded", func(t *testing.T) {
+		fetches.Store(0)
+		garbage.Store(0)
+		ht.Pool = NewNoncePool()
+		defer func() {
+			ht.Pool = nil
+		}()
+		ht.Pool.Put("<injected>", "a-pooled-nonce")
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-pooled-nonce", nonce)
+		assert.Equal(t, int32(0), fetches.Load())
+	})
+}
+
+func TestInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]string{}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/directory", GetDirectory)
+	handler.Handle("/nonce/", http.StripPrefix("/nonce",
+		NewNoncedFuncServeMux(t)))
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[r.Method+" "+r.URL.Path] = r.Header.Get("X-Correlation-Id")
+			mu.Unlock()
+			handler.ServeHTTP(w, r)
+		}))
+	defer server.Close()
+	order := []string{}
+	p, err := NewHTTPPeasant(server.URL+"/directory",
+		WithInterceptors(func(r *http.Request) error {
+			order = append(order, "first")
+			r.Header.Set("X-Correlation-Id", "correlation-id")
+			return nil
+		}, func(r *http.Request) error {
+			order = append(order, "second")
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ht := p.Transport.(*HttpTransport)
+
+	t.Run("Stamp every outbound request", func(t *testing.T) {
+		res, err := ht.NoncedGet("doSomething")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, map[string]string{
+			"GET /directory":                 "correlation-id",
+			"HEAD /nonce/new-nonce":          "correlation-id",
+			"GET /nonce/do-nonced-something": "correlation-id",
+		}, seen)
+		assert.Equal(t, []string{"first", "second"}, order[:2])
+	})
+
+	t.Run("Abort on an interceptor error", func(t *testing.T) {
+		ht.Interceptors = append(ht.Interceptors,
+			func(r *http.Request) error {
+				return errors.New("request refused")
+			})
+		_, err := ht.NoncedGet("doSomething")
+		assert.EqualError(t, err, "request refused")
+	})
+}
+
+type DirectoryOnlyTransport struct {
+	directory map[string]interface{}
+}
+
+func (tr *DirectoryOnlyTransport) NewNonce() (string, error) {
+	return "", errors.New("no nonce")
+}
+
+func (tr *DirectoryOnlyTransport) Directory() (map[string]interface{},
+	error) {
+	return tr.directory, nil
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	dp := NewMemoryDirectoryProvider(map[string]interface{}{
+		"newNonce": "http://bastion/nonce/new-nonce",
+		"newOrder": "/acme/new-order",
+	})
+	ht := MustNewHttpTransport("http://bastion/base/", DefaultNonceHeader,
+		WithDirectoryProvider(dp))
+
+	t.Run("Present endpoint key", func(t *testing.T) {
+		url, err := NewPeasant(ht).ResolveEndpoint("newNonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", url)
+	})
+
+	t.Run("Absent endpoint key", func(t *testing.T) {
+		_, err := ht.ResolveEndpoint("revokeCert")
+		assert.True(t, errors.Is(err, ErrDirectoryKeyNotFound))
+		assert.EqualError(t, err, `the transport wasn't able to find the `+
+			`directory key "revokeCert"`)
+	})
+
+	t.Run("Relative endpoint key", func(t *testing.T) {
+		url, err := ht.ResolveEndpoint("newOrder")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/acme/new-order", url)
+	})
+
+	t.Run("Relative to the directory URL", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"newOrder": "new-order"}`))
+			}))
+		defer server.Close()
+		p, err := NewHTTPPeasant(server.URL + "/acme/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		url, err := p.ResolveEndpoint("newOrder")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, server.URL+"/acme/new-order", url)
+	})
+
+	t.Run("Transport without a resolver", func(t *testing.T) {
+		p := NewPeasant(&DirectoryOnlyTransport{
+			directory: map[string]interface{}{"newOrder": "/new-order"},
+		})
+		url, err := p.ResolveEndpoint("newOrder")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "/new-order", url)
+		_, err = p.ResolveEndpoint("missing")
+		assert.True(t, errors.Is(err, ErrDirectoryKeyNotFound))
+	})
+}
+
+func TestNoncedGetAndPost(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+	p, err := NewHTTPPeasant(server.URL + "/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ht := p.Transport.(*HttpTransport)
+
+	t.Run("Nonced get harvesting the response nonce", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			res, err := ht.NoncedGet("doSomething")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := BodyAsString(res)
+			if err != nil {
+				t.Error(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.True(t, strings.HasPrefix(b, "Func done with nonce "))
+			assert.Equal(t, 1, ht.Pool.Len())
+		}
+	})
+
+	t.Run("Nonced post", func(t *testing.T) {
+		res, err := ht.NoncedPost("postSomething",
+			strings.NewReader("a body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "Post done with a body", b)
+	})
+
+	t.Run("Nonced post with the default marshaler", func(t *testing.T) {
+		res, err := ht.NoncedPostJSON("postSomething",
+			map[string]string{"html": "<b>"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, `Post done with {"html":"\u003cb\u003e"}`, b)
+	})
+
+	t.Run("Nonced post with a custom marshaler", func(t *testing.T) {
+		ht.Marshaler = func(v any) ([]byte, error) {
+			buf := &bytes.Buffer{}
+			enc := json.NewEncoder(buf)
+			enc.SetEscapeHTML(false)
+			err := enc.Encode(v)
+			return bytes.TrimSpace(buf.Bytes()), err
+		}
+		defer func() {
+			ht.Marshaler = json.Marshal
+		}()
+		res, err := ht.NoncedPostJSON("postSomething",
+			map[string]string{"html": "<b>"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, `Post done with {"html":"<b>"}`, b)
+	})
+
+	t.Run("Marshaler error", func(t *testing.T) {
+		ht, err := NewHttpTransport(server.URL, DefaultNonceHeader,
+			WithMarshaler(func(v any) ([]byte, error) {
+				return nil, errors.New("can't marshal")
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ht.NoncedPostJSON("postSomething", "value")
+		assert.EqualError(t, err, "can't marshal")
+	})
+
+	t.Run("Unknown directory key", func(t *testing.T) {
+		_, err := ht.NoncedGet("unknown")
+		assert.True(t, errors.Is(err, ErrDirectoryKeyNotFound))
+		assert.EqualError(t, err, `the transport wasn't able to find the `+
+			`directory key "unknown"`)
+	})
+}
+
+func NewClientCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "peasant"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	cert, leaf := NewClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(DefaultNonceHeader,
+				"nonce-for-"+r.TLS.PeerCertificates[0].Subject.CommonName)
+		})
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	t.Run("Client certificate presented", func(t *testing.T) {
+		ht, err := NewHttpTransport(server.URL, DefaultNonceHeader,
+			WithClientCertificate(cert), WithRootCAs(rootCAs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ht.Close()
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "nonce-for-peasant", nonce)
+	})
+
+	t.Run("No client certificate", func(t *testing.T) {
+		ht, err := NewHttpTransport(server.URL, DefaultNonceHeader,
+			WithRootCAs(rootCAs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ht.Close()
+		_, err = ht.NewNonce()
+		assert.Error(t, err)
+	})
+}
+
+func TestRefreshOnMissingKey(t *testing.T) {
+	newProviders := func() (*MemoryDirectoryProvider,
+		*CachingDirectoryProvider) {
+		inner := NewMemoryDirectoryProvider(map[string]interface{}{
+			"newNonce": "http://bastion/nonce/new-nonce",
+		})
+		dp := NewCachingDirectoryProvider(inner, time.Hour)
+		_, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		return inner, dp
+	}
+
+	t.Run("Missing key found after a refresh", func(t *testing.T) {
+		inner, dp := newProviders()
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp), WithDirectoryKeys("newNonceV2"),
+			WithRefreshOnMissingKey())
+		inner.Set("newNonceV2", "http://bastion/v2/new-nonce")
+		inner.Set("newAccount", "http://bastion/new-account")
+		url, err := ht.NewNonceUrl()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/v2/new-nonce", url)
+		url, err = ht.ResolveEndpoint("newAccount")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/new-account", url)
+	})
+
+	t.Run("Stale directory without the option", func(t *testing.T) {
+		inner, dp := newProviders()
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp), WithDirectoryKeys("newNonceV2"))
+		inner.Set("newNonceV2", "http://bastion/v2/new-nonce")
+		_, err := ht.NewNonceUrl()
+		assert.ErrorIs(t, err, ErrNonceKeyNotFound)
+		_, err = ht.ResolveEndpoint("newAccount")
+		assert.ErrorIs(t, err, ErrDirectoryKeyNotFound)
+	})
+
+	t.Run("Key missing after a refresh", func(t *testing.T) {
+		_, dp := newProviders()
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp), WithRefreshOnMissingKey())
+		_, err := ht.ResolveEndpoint("newAccount")
+		assert.ErrorIs(t, err, ErrDirectoryKeyNotFound)
+	})
+
+	t.Run("Refresh failure", func(t *testing.T) {
+		inner := &CountingDirectoryProvider{
+			HttpDirectoryProvider: NewHttpDirectoryProvider(""),
+		}
+		dp := NewCachingDirectoryProvider(inner, time.Hour)
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp), WithRefreshOnMissingKey())
+		_, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		refreshErr := errors.New("unavailable")
+		inner.err = refreshErr
+		_, err = ht.ResolveEndpoint("newAccount")
+		assert.ErrorIs(t, err, ErrDirectoryKeyNotFound)
+		assert.ErrorIs(t, err, refreshErr)
+	})
 }
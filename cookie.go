@@ -0,0 +1,62 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import "net/http"
+
+// DefaultNonceCookie is the name of the cookie carrying the nonce when no
+// other name is configured.
+const DefaultNonceCookie = "nonce"
+
+// NonceCookie configures the HttpOnly cookie issued nonces are delivered in,
+// for browser clients that can't read custom response headers. The browser
+// sends the cookie back with the next request, where NonceFromCookie reads
+// it.
+type NonceCookie struct {
+	// Name is the cookie name. If empty DefaultNonceCookie is used.
+	Name string
+	// OmitHeader delivers the nonce only in the cookie, instead of in
+	// addition to the nonce header.
+	OmitHeader bool
+	// Path is the cookie path. If empty the cookie is sent to every path.
+	Path string
+	// SameSite is the cookie SameSite attribute.
+	SameSite http.SameSite
+	// Secure restricts the cookie to HTTPS requests.
+	Secure bool
+}
+
+// Cookie returns the HttpOnly cookie carrying the nonce.
+func (c NonceCookie) Cookie(nonce string) *http.Cookie {
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	return &http.Cookie{
+		Name:     c.name(),
+		Value:    nonce,
+		Path:     path,
+		HttpOnly: true,
+		SameSite: c.SameSite,
+		Secure:   c.Secure,
+	}
+}
+
+func (c NonceCookie) name() string {
+	if c.Name == "" {
+		return DefaultNonceCookie
+	}
+	return c.Name
+}
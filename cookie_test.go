@@ -0,0 +1,142 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewCookieServeMux(t *testing.T, cookie NonceCookie) *http.ServeMux {
+	s := dummy.NewDummyInMemoryNonceService(
+		dummy.WithExtractor(NonceFromCookie(cookie.name())))
+	h := http.NewServeMux()
+	h.HandleFunc("/new-nonce", (&NonceHandler{
+		Cookie:  &cookie,
+		Service: s,
+	}).GetNonce)
+	h.HandleFunc("/operation", NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("done"))
+		}, WithCookieNonce(cookie)))
+	return h
+}
+
+func TestNonceCookie(t *testing.T) {
+	cookie := NonceCookie{
+		OmitHeader: true,
+		SameSite:   http.SameSiteStrictMode,
+		Secure:     true,
+	}
+
+	t.Run("Cookie attributes", func(t *testing.T) {
+		h := NewCookieServeMux(t, cookie)
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/new-nonce",
+			nil))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "", res.Header().Get(DefaultNonceHeader))
+		assert.Equal(t, "", res.Body.String())
+		cookies := res.Result().Cookies()
+		assert.Equal(t, 1, len(cookies))
+		assert.Equal(t, DefaultNonceCookie, cookies[0].Name)
+		assert.NotEqual(t, "", cookies[0].Value)
+		assert.Equal(t, "/", cookies[0].Path)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.True(t, cookies[0].Secure)
+		assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+	})
+
+	t.Run("Cookie in addition to the header", func(t *testing.T) {
+		h := NewCookieServeMux(t, NonceCookie{Name: "peasant-nonce"})
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/new-nonce",
+			nil))
+		nonce := res.Header().Get(DefaultNonceHeader)
+		assert.NotEqual(t, "", nonce)
+		assert.Contains(t, res.Body.String(), nonce)
+		cookies := res.Result().Cookies()
+		assert.Equal(t, 1, len(cookies))
+		assert.Equal(t, "peasant-nonce", cookies[0].Name)
+		assert.Equal(t, nonce, cookies[0].Value)
+	})
+
+	t.Run("Browser round trip", func(t *testing.T) {
+		server := httptest.NewServer(NewCookieServeMux(t,
+			NonceCookie{OmitHeader: true}))
+		defer server.Close()
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Jar: jar}
+		res, err := client.Get(server.URL + "/new-nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		issued := res.Cookies()[0]
+		for i := 0; i < 2; i++ {
+			res, err = client.Post(server.URL+"/operation", "text/plain",
+				nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "", res.Header.Get(DefaultNonceHeader))
+		}
+		// Replaying the consumed nonce is rejected.
+		req := httptest.NewRequest(http.MethodPost, "/operation", nil)
+		req.AddCookie(issued)
+		rec := httptest.NewRecorder()
+		server.Config.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Transport round trip", func(t *testing.T) {
+		server := httptest.NewServer(NewCookieServeMux(t, cookie))
+		defer server.Close()
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithNonceCookie(DefaultNonceCookie),
+			WithNonceInjector(NonceInCookie(DefaultNonceCookie)),
+			WithDirectoryProvider(NewMemoryDirectoryProvider(
+				map[string]interface{}{
+					"newNonce":  server.URL + "/new-nonce",
+					"operation": server.URL + "/operation",
+				})))
+		for i := 0; i < 2; i++ {
+			res, err := ht.NoncedDo(http.MethodPost, "operation",
+				strings.NewReader("a body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := BodyAsString(res)
+			if err != nil {
+				t.Error(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "done", body)
+			assert.NotEqual(t, "", ht.ResolveNonce(res))
+		}
+	})
+}
@@ -0,0 +1,611 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirectoryProvider defines the interface for resolving the directory of
+// resources a bastion offers.
+type DirectoryProvider interface {
+	// Directory returns the map of available resources.
+	Directory() (map[string]interface{}, error)
+	// GetUrl returns the location the directory is resolved from.
+	GetUrl() string
+	// SetTransport sets the Transport used to resolve the directory.
+	SetTransport(Transport) error
+}
+
+// Refresher is implemented by the DirectoryProviders caching the directory,
+// to force the next resolution to bypass the cache.
+type Refresher interface {
+	// Refresh drops or reloads the cached directory.
+	Refresh() error
+}
+
+// RefreshDirectory refreshes the provider if it is a Refresher, otherwise it
+// does nothing.
+func RefreshDirectory(p DirectoryProvider) error {
+	r, ok := p.(Refresher)
+	if !ok {
+		return nil
+	}
+	return r.Refresh()
+}
+
+// NewDirectoryProvider returns the DirectoryProvider matching the scheme of
+// the given location:
+//
+//   - http:// and https:// return an HttpDirectoryProvider
+//   - file:// returns a FileDirectoryProvider reading the file path
+//   - env: returns an EnvDirectoryProvider reading the named variable, like
+//     env:PEASANT_DIRECTORY
+//   - mem: returns an empty MemoryDirectoryProvider
+//
+// Unknown schemes return an error.
+func NewDirectoryProvider(location string) (DirectoryProvider, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHttpDirectoryProvider(location), nil
+	case "file":
+		return NewFileDirectoryProvider(u.Host + u.Path), nil
+	case "env":
+		if u.Opaque == "" {
+			return nil, errors.New("the env directory location has no " +
+				"variable name")
+		}
+		return NewEnvDirectoryProvider(u.Opaque), nil
+	case "mem":
+		return NewMemoryDirectoryProvider(nil), nil
+	}
+	return nil, fmt.Errorf("unsupported directory location scheme %q",
+		u.Scheme)
+}
+
+// Directory is a typed view of a bastion directory. The newNonce entry is
+// mapped to NewNonce, the meta object to Meta and the other string entries
+// are kept in Extra. Other entries that aren't strings are ignored.
+type Directory struct {
+	// NewNonce is the URL for new nonce generation.
+	NewNonce string
+	// Extra holds the remaining string entries of the directory.
+	Extra map[string]string
+	// Meta holds the directory metadata object, like ACME's terms of
+	// service and website, or nil if there is none.
+	Meta map[string]interface{}
+}
+
+// NewDirectory builds a Directory from a directory map.
+func NewDirectory(d map[string]interface{}) *Directory {
+	dir := &Directory{
+		Extra: map[string]string{},
+	}
+	for key, value := range d {
+		if key == "meta" {
+			dir.Meta, _ = value.(map[string]interface{})
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if key == "newNonce" {
+			dir.NewNonce = s
+			continue
+		}
+		dir.Extra[key] = s
+	}
+	return dir
+}
+
+// UnmarshalJSON decodes a JSON directory document into the Directory.
+func (d *Directory) UnmarshalJSON(b []byte) error {
+	m := map[string]interface{}{}
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return err
+	}
+	*d = *NewDirectory(m)
+	return nil
+}
+
+// UnmarshalDirectory reads the body of an HTTP response and decodes it into
+// a Directory. It consumes the response body.
+func UnmarshalDirectory(res *http.Response) (*Directory, error) {
+	body, err := uncompressedBody(res)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	d := &Directory{}
+	err = json.NewDecoder(body).Decode(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// HttpDirectoryProvider implements the DirectoryProvider interface by
+// fetching the directory as a JSON document from a bastion.
+//
+// The ETag and Last-Modified validators of the last directory response are
+// kept and sent back as If-None-Match and If-Modified-Since, so a 304 Not
+// Modified answer is served from the last fetched document.
+type HttpDirectoryProvider struct {
+	// HttpTransport is the transport used to fetch the directory.
+	*HttpTransport
+	// Url is the location of the directory document.
+	Url string
+
+	document     []byte
+	etag         string
+	lastModified string
+	mu           sync.Mutex
+}
+
+// HttpDirectoryProviderOption configures an HttpDirectoryProvider.
+type HttpDirectoryProviderOption func(*HttpDirectoryProvider)
+
+// WithTransport sets the HttpTransport used to fetch the directory, so the
+// provider can share the HTTP client of an existing transport.
+func WithTransport(ht *HttpTransport) HttpDirectoryProviderOption {
+	return func(p *HttpDirectoryProvider) {
+		p.HttpTransport = ht
+	}
+}
+
+// NewHttpDirectoryProvider initializes a new HttpDirectoryProvider with the
+// given directory URL. Unless WithTransport is used, the transport must be set
+// with SetTransport before fetching the directory.
+func NewHttpDirectoryProvider(url string,
+	opts ...HttpDirectoryProviderOption) *HttpDirectoryProvider {
+	p := &HttpDirectoryProvider{
+		Url: url,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Directory fetches the directory from the provider URL within the transport
+// DirectoryTimeout. Responses with a gzip Content-Encoding are decompressed
+// before being decoded. If the transport isn't set an error is returned.
+func (p *HttpDirectoryProvider) Directory() (map[string]interface{}, error) {
+	d := map[string]interface{}{}
+	err := p.DirectoryInto(&d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DirectoryInto fetches the directory like Directory, decoding it into v
+// instead of a map. The v parameter should be a pointer to a struct matching
+// the directory schema.
+func (p *HttpDirectoryProvider) DirectoryInto(v interface{}) error {
+	if p.HttpTransport == nil {
+		return errors.New("the directory provider has no transport, " +
+			"set it with SetTransport or WithTransport")
+	}
+	ctx, cancel := withTimeout(context.Background(),
+		p.HttpTransport.DirectoryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Url, nil)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	document := p.document
+	if document != nil {
+		if p.etag != "" {
+			req.Header.Set("If-None-Match", p.etag)
+		}
+		if p.lastModified != "" {
+			req.Header.Set("If-Modified-Since", p.lastModified)
+		}
+	}
+	p.mu.Unlock()
+	res, err := p.HttpTransport.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && document != nil {
+		return json.Unmarshal(document, v)
+	}
+	if res.StatusCode > 299 {
+		return newStatusError(res)
+	}
+	body, err := uncompressedBody(res)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	document, err = io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(document, v)
+	if err != nil {
+		return err
+	}
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.document = nil
+	if etag != "" || lastModified != "" {
+		p.document = document
+	}
+	p.etag = etag
+	p.lastModified = lastModified
+	return nil
+}
+
+// Refresh drops the cached document and its validators, so the next fetch
+// isn't conditional.
+func (p *HttpDirectoryProvider) Refresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.document = nil
+	p.etag = ""
+	p.lastModified = ""
+	return nil
+}
+
+// GetUrl returns the directory URL.
+func (p *HttpDirectoryProvider) GetUrl() string {
+	return p.Url
+}
+
+// SetTransport sets the HttpTransport used to fetch the directory.
+func (p *HttpDirectoryProvider) SetTransport(tr Transport) error {
+	ht, ok := tr.(*HttpTransport)
+	if !ok {
+		return ErrTransportCast
+	}
+	p.HttpTransport = ht
+	return nil
+}
+
+// FileDirectoryProvider implements the DirectoryProvider interface reading the
+// directory from a JSON file.
+type FileDirectoryProvider struct {
+	// Path is the location of the directory file.
+	Path string
+}
+
+// NewFileDirectoryProvider initializes a new FileDirectoryProvider reading
+// the directory from the given path.
+func NewFileDirectoryProvider(path string) *FileDirectoryProvider {
+	return &FileDirectoryProvider{
+		Path: path,
+	}
+}
+
+// Directory reads and decodes the directory file.
+func (p *FileDirectoryProvider) Directory() (map[string]interface{}, error) {
+	b, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	d := map[string]interface{}{}
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetUrl returns the file URL of the directory.
+func (p *FileDirectoryProvider) GetUrl() string {
+	return "file://" + p.Path
+}
+
+// SetTransport does nothing as the file is read without a transport.
+func (p *FileDirectoryProvider) SetTransport(tr Transport) error {
+	return nil
+}
+
+// EnvDirectoryProvider implements the DirectoryProvider interface decoding
+// the directory from a JSON document held by an environment variable.
+type EnvDirectoryProvider struct {
+	// Name is the environment variable holding the directory.
+	Name string
+}
+
+// NewEnvDirectoryProvider initializes a new EnvDirectoryProvider reading the
+// directory from the given environment variable.
+func NewEnvDirectoryProvider(name string) *EnvDirectoryProvider {
+	return &EnvDirectoryProvider{
+		Name: name,
+	}
+}
+
+// Directory decodes the directory from the environment variable. A missing
+// variable is an error.
+func (p *EnvDirectoryProvider) Directory() (map[string]interface{}, error) {
+	v, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return nil, errors.New("the environment variable " + p.Name +
+			" isn't set")
+	}
+	d := map[string]interface{}{}
+	err := json.Unmarshal([]byte(v), &d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetUrl returns the env location of the directory.
+func (p *EnvDirectoryProvider) GetUrl() string {
+	return "env:" + p.Name
+}
+
+// SetTransport does nothing as the variable is read without a transport.
+func (p *EnvDirectoryProvider) SetTransport(tr Transport) error {
+	return nil
+}
+
+// MemoryDirectoryProvider implements the DirectoryProvider interface serving
+// a directory held in memory. It is safe for concurrent use.
+type MemoryDirectoryProvider struct {
+	directory map[string]interface{}
+	mu        sync.RWMutex
+}
+
+// NewMemoryDirectoryProvider initializes a new MemoryDirectoryProvider
+// serving a copy of the given directory.
+func NewMemoryDirectoryProvider(
+	d map[string]interface{}) *MemoryDirectoryProvider {
+	p := &MemoryDirectoryProvider{
+		directory: map[string]interface{}{},
+	}
+	for key, value := range d {
+		p.directory[key] = value
+	}
+	return p
+}
+
+// Directory returns a copy of the directory.
+func (p *MemoryDirectoryProvider) Directory() (map[string]interface{},
+	error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	d := make(map[string]interface{}, len(p.directory))
+	for key, value := range p.directory {
+		d[key] = value
+	}
+	return d, nil
+}
+
+// GetUrl returns the mem location of the directory.
+func (p *MemoryDirectoryProvider) GetUrl() string {
+	return "mem:"
+}
+
+// Set sets a directory entry.
+func (p *MemoryDirectoryProvider) Set(key string, value interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.directory[key] = value
+}
+
+// SetTransport does nothing as the directory is held in memory.
+func (p *MemoryDirectoryProvider) SetTransport(tr Transport) error {
+	return nil
+}
+
+// TemplateDirectoryProvider implements the DirectoryProvider interface
+// producing the endpoints of operations following a URL pattern from
+// a template, instead of storing each of them. In the Template, {base} is
+// replaced by Base and {op} by the operation name, so a "{base}/v2/{op}"
+// template maps the newNonce operation to Base + "/v2/newNonce".
+//
+// Explicit Entries take precedence over the templated endpoints.
+type TemplateDirectoryProvider struct {
+	// Base is the base URL replacing {base} in the template.
+	Base string
+	// Entries are the explicit directory entries.
+	Entries map[string]interface{}
+	// Ops are the operations the template produces endpoints for.
+	Ops []string
+	// Template is the endpoint template.
+	Template string
+}
+
+// NewTemplateDirectoryProvider initializes a new TemplateDirectoryProvider
+// producing the endpoints of the given operations from the base URL and
+// template.
+func NewTemplateDirectoryProvider(base, template string,
+	ops ...string) *TemplateDirectoryProvider {
+	return &TemplateDirectoryProvider{
+		Base:     base,
+		Entries:  map[string]interface{}{},
+		Ops:      ops,
+		Template: template,
+	}
+}
+
+// Directory returns the templated endpoints of the operations merged with the
+// explicit entries.
+func (p *TemplateDirectoryProvider) Directory() (map[string]interface{},
+	error) {
+	d := make(map[string]interface{}, len(p.Ops)+len(p.Entries))
+	for _, op := range p.Ops {
+		d[op] = p.Endpoint(op)
+	}
+	for key, value := range p.Entries {
+		d[key] = value
+	}
+	return d, nil
+}
+
+// Endpoint returns the explicit entry of the operation if it is a string,
+// otherwise the endpoint produced by the template.
+func (p *TemplateDirectoryProvider) Endpoint(op string) string {
+	value, ok := p.Entries[op].(string)
+	if ok {
+		return value
+	}
+	return strings.NewReplacer("{base}", strings.TrimSuffix(p.Base, "/"),
+		"{op}", op).Replace(p.Template)
+}
+
+// GetUrl returns the base URL.
+func (p *TemplateDirectoryProvider) GetUrl() string {
+	return p.Base
+}
+
+// SetTransport does nothing as the directory is produced without
+// a transport.
+func (p *TemplateDirectoryProvider) SetTransport(tr Transport) error {
+	return nil
+}
+
+// CachingDirectoryProvider decorates a DirectoryProvider memoizing its
+// directory for a TTL. Concurrent calls while the directory is being fetched
+// wait for that single fetch instead of calling the wrapped provider again.
+// Errors are not cached. GetUrl and SetTransport are passed through to the
+// wrapped provider.
+type CachingDirectoryProvider struct {
+	DirectoryProvider
+	// Clock provides the time used to expire the cached directory.
+	Clock Clock
+	// OnChange, if set, is called with the changed keys when a refresh
+	// yields a directory different from the cached one.
+	OnChange func(changed []string)
+	// TTL is how long the directory is cached.
+	TTL time.Duration
+
+	directory map[string]interface{}
+	expiry    time.Time
+	mu        sync.Mutex
+}
+
+// NewCachingDirectoryProvider initializes a new CachingDirectoryProvider
+// caching the directory of the given provider for the given ttl.
+func NewCachingDirectoryProvider(dp DirectoryProvider,
+	ttl time.Duration) *CachingDirectoryProvider {
+	return &CachingDirectoryProvider{
+		DirectoryProvider: dp,
+		Clock:             systemClock{},
+		TTL:               ttl,
+	}
+}
+
+// Directory returns a copy of the cached directory, fetching it from the
+// wrapped provider if it isn't cached or the TTL expired. If OnChange is set
+// it is called, without holding the cache lock, when a refresh changes the
+// directory.
+func (p *CachingDirectoryProvider) Directory() (map[string]interface{},
+	error) {
+	return p.load(false)
+}
+
+// Refresh refreshes the wrapped provider, if it is a Refresher, and reloads
+// the cached directory from it regardless of the TTL. On error the cached
+// directory is kept.
+func (p *CachingDirectoryProvider) Refresh() error {
+	_, err := p.load(true)
+	return err
+}
+
+// load returns a copy of the cached directory, fetching it if it isn't cached,
+// the TTL expired or force is set.
+func (p *CachingDirectoryProvider) load(force bool) (map[string]interface{},
+	error) {
+	p.mu.Lock()
+	var changed []string
+	if force || p.directory == nil || !p.Clock.Now().Before(p.expiry) {
+		if force {
+			err := RefreshDirectory(p.DirectoryProvider)
+			if err != nil {
+				p.mu.Unlock()
+				return nil, err
+			}
+		}
+		d, err := p.DirectoryProvider.Directory()
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		if p.directory != nil {
+			changed = DirectoryChanged(p.directory, d)
+		}
+		p.directory = d
+		p.expiry = p.Clock.Now().Add(p.TTL)
+	}
+	d := make(map[string]interface{}, len(p.directory))
+	for key, value := range p.directory {
+		d[key] = value
+	}
+	p.mu.Unlock()
+	if len(changed) > 0 && p.OnChange != nil {
+		p.OnChange(changed)
+	}
+	return d, nil
+}
+
+// DirectoryChanged returns the sorted keys added, removed or changed between
+// the old and the new directory.
+func DirectoryChanged(old, new map[string]interface{}) []string {
+	changed := []string{}
+	for key, value := range old {
+		newValue, ok := new[key]
+		if !ok || !reflect.DeepEqual(value, newValue) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range new {
+		_, ok := old[key]
+		if !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// uncompressedBody returns a reader for the response body, wrapping it in a
+// gzip.Reader when the server compressed it and the http.Client didn't
+// decompress it already.
+func uncompressedBody(res *http.Response) (io.ReadCloser, error) {
+	if res.Uncompressed ||
+		!strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return io.NopCloser(res.Body), nil
+	}
+	return gzip.NewReader(res.Body)
+}
@@ -0,0 +1,675 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewGzipDirectoryServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			err := json.NewEncoder(gz).Encode(map[string]interface{}{
+				"newNonce": "http://bastion/nonce/new-nonce",
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}))
+}
+
+func TestHttpDirectoryProvider(t *testing.T) {
+	server := NewGzipDirectoryServer(t)
+	defer server.Close()
+
+	t.Run("Gzipped directory decompressed by the client", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		dp := NewHttpDirectoryProvider(server.URL)
+		err := dp.SetTransport(ht)
+		if err != nil {
+			t.Error(err)
+		}
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+	})
+
+	t.Run("Gzipped directory with a custom round tripper", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		ht.Client.Transport = &http.Transport{DisableCompression: true}
+		dp := NewHttpDirectoryProvider(server.URL)
+		err := dp.SetTransport(ht)
+		if err != nil {
+			t.Error(err)
+		}
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+	})
+}
+
+func TestDirectory(t *testing.T) {
+	doc := `{
+		"keyChange": "https://bastion/acme/key-change",
+		"meta": {
+			"termsOfService": "https://bastion/terms",
+			"website": "https://bastion"
+		},
+		"newAccount": "https://bastion/acme/new-acct",
+		"newNonce": "https://bastion/acme/new-nonce",
+		"newOrder": "https://bastion/acme/new-order",
+		"revokeCert": "https://bastion/acme/revoke-cert"
+	}`
+
+	t.Run("Unmarshal a directory response", func(t *testing.T) {
+		res := &http.Response{
+			Header: http.Header{},
+			Body:   io.NopCloser(strings.NewReader(doc)),
+		}
+		d, err := UnmarshalDirectory(res)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/acme/new-nonce", d.NewNonce)
+		assert.Equal(t, map[string]string{
+			"keyChange":  "https://bastion/acme/key-change",
+			"newAccount": "https://bastion/acme/new-acct",
+			"newOrder":   "https://bastion/acme/new-order",
+			"revokeCert": "https://bastion/acme/revoke-cert",
+		}, d.Extra)
+	})
+
+	t.Run("Invalid directory document", func(t *testing.T) {
+		res := &http.Response{
+			Header: http.Header{},
+			Body:   io.NopCloser(strings.NewReader("[]")),
+		}
+		_, err := UnmarshalDirectory(res)
+		assert.Error(t, err)
+	})
+
+	t.Run("Typed directory from the transport", func(t *testing.T) {
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader)
+		d, err := ht.TypedDirectory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d.NewNonce)
+		assert.Empty(t, d.Extra)
+	})
+}
+
+type CountingDirectoryProvider struct {
+	*HttpDirectoryProvider
+	calls int32
+	delay time.Duration
+	err   error
+}
+
+func (p *CountingDirectoryProvider) Directory() (map[string]interface{},
+	error) {
+	atomic.AddInt32(&p.calls, 1)
+	time.Sleep(p.delay)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return map[string]interface{}{
+		"newNonce": "http://bastion/nonce/new-nonce",
+	}, nil
+}
+
+func TestDirectoryMeta(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{
+				"newNonce": "https://bastion/acme/new-nonce",
+				"newOrder": "https://bastion/acme/new-order",
+				"meta": {
+					"termsOfService": "https://bastion/terms",
+					"rateLimits": {"newOrder": 300},
+					"algorithms": ["ES256", "EdDSA"]
+				}
+			}`))
+		}))
+	defer server.Close()
+	p, err := NewHTTPPeasant(server.URL + "/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ht := p.Transport.(*HttpTransport)
+
+	t.Run("Resolve string endpoints", func(t *testing.T) {
+		url, err := ht.NewNonceUrl()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/acme/new-nonce", url)
+		url, err = ht.ResolveEndpoint("newOrder")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/acme/new-order", url)
+		_, err = ht.ResolveEndpoint("meta")
+		assert.True(t, errors.Is(err, ErrDirectoryKeyNotFound))
+	})
+
+	t.Run("Nested meta object", func(t *testing.T) {
+		meta, err := ht.DirectoryMeta()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/terms", meta["termsOfService"])
+		assert.Equal(t, map[string]interface{}{"newOrder": float64(300)},
+			meta["rateLimits"])
+		assert.Equal(t, []interface{}{"ES256", "EdDSA"}, meta["algorithms"])
+	})
+
+	t.Run("Typed directory", func(t *testing.T) {
+		d, err := ht.TypedDirectory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/terms", d.Meta["termsOfService"])
+		assert.Equal(t, map[string]string{
+			"newOrder": "https://bastion/acme/new-order",
+		}, d.Extra)
+	})
+
+	t.Run("No meta object", func(t *testing.T) {
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader)
+		meta, err := ht.DirectoryMeta()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Empty(t, meta)
+	})
+
+	t.Run("Invalid meta entry", func(t *testing.T) {
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(NewMemoryDirectoryProvider(
+				map[string]interface{}{"meta": "terms"})))
+		_, err := ht.DirectoryMeta()
+		assert.EqualError(t, err,
+			"the directory meta entry is a string, not an object")
+	})
+}
+
+func TestCachingDirectoryProvider(t *testing.T) {
+	t.Run("Concurrent calls are deduplicated", func(t *testing.T) {
+		inner := &CountingDirectoryProvider{delay: 20 * time.Millisecond}
+		dp := NewCachingDirectoryProvider(inner, time.Minute)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d, err := dp.Directory()
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), atomic.LoadInt32(&inner.calls))
+	})
+
+	t.Run("Directory refetched after the TTL", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		inner := &CountingDirectoryProvider{}
+		dp := NewCachingDirectoryProvider(inner, time.Minute)
+		dp.Clock = clock
+		dp.Directory()
+		clock.Advance(59 * time.Second)
+		dp.Directory()
+		assert.Equal(t, int32(1), atomic.LoadInt32(&inner.calls))
+		clock.Advance(time.Second)
+		dp.Directory()
+		assert.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+	})
+
+	t.Run("Errors are not cached", func(t *testing.T) {
+		inner := &CountingDirectoryProvider{err: errors.New("unavailable")}
+		dp := NewCachingDirectoryProvider(inner, time.Minute)
+		_, err := dp.Directory()
+		assert.EqualError(t, err, "unavailable")
+		_, err = dp.Directory()
+		assert.EqualError(t, err, "unavailable")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+	})
+
+	t.Run("Returned directory doesn't change the cache", func(t *testing.T) {
+		dp := NewCachingDirectoryProvider(&CountingDirectoryProvider{},
+			time.Minute)
+		d, _ := dp.Directory()
+		d["newNonce"] = "changed"
+		d, _ = dp.Directory()
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+	})
+
+	t.Run("Url and transport passed through", func(t *testing.T) {
+		inner := &CountingDirectoryProvider{
+			HttpDirectoryProvider: NewHttpDirectoryProvider(
+				"http://bastion/directory"),
+		}
+		dp := NewCachingDirectoryProvider(inner, time.Minute)
+		assert.Equal(t, "http://bastion/directory", dp.GetUrl())
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp))
+		assert.Equal(t, ht, inner.HttpTransport)
+	})
+}
+
+func TestNewDirectoryProvider(t *testing.T) {
+	doc := `{"newNonce": "http://bastion/nonce/new-nonce"}`
+
+	t.Run("Http location", func(t *testing.T) {
+		dp, err := NewDirectoryProvider("https://bastion/directory")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.IsType(t, &HttpDirectoryProvider{}, dp)
+		assert.Equal(t, "https://bastion/directory", dp.GetUrl())
+	})
+
+	t.Run("File location", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "directory.json")
+		err := os.WriteFile(path, []byte(doc), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dp, err := NewDirectoryProvider("file://" + path)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.IsType(t, &FileDirectoryProvider{}, dp)
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+	})
+
+	t.Run("Env location", func(t *testing.T) {
+		t.Setenv("PEASANT_TEST_DIRECTORY", doc)
+		dp, err := NewDirectoryProvider("env:PEASANT_TEST_DIRECTORY")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.IsType(t, &EnvDirectoryProvider{}, dp)
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+
+		_, err = NewEnvDirectoryProvider("PEASANT_TEST_UNSET").Directory()
+		assert.EqualError(t, err,
+			"the environment variable PEASANT_TEST_UNSET isn't set")
+	})
+
+	t.Run("Memory location", func(t *testing.T) {
+		dp, err := NewDirectoryProvider("mem:")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.IsType(t, &MemoryDirectoryProvider{}, dp)
+		dp.(*MemoryDirectoryProvider).Set("newNonce",
+			"http://bastion/nonce/new-nonce")
+		ht := MustNewHttpTransport("http://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp))
+		url, err := ht.NewNonceUrl()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", url)
+	})
+
+	t.Run("Unknown scheme", func(t *testing.T) {
+		_, err := NewDirectoryProvider("ftp://bastion/directory")
+		assert.EqualError(t, err,
+			`unsupported directory location scheme "ftp"`)
+		_, err = NewDirectoryProvider("env:")
+		assert.EqualError(t, err,
+			"the env directory location has no variable name")
+	})
+}
+
+func TestHttpDirectoryProviderTransport(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	t.Run("Unwired provider", func(t *testing.T) {
+		dp := NewHttpDirectoryProvider(server.URL + "/directory")
+		_, err := dp.Directory()
+		assert.EqualError(t, err, "the directory provider has no "+
+			"transport, set it with SetTransport or WithTransport")
+	})
+
+	t.Run("Transport set at construction", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		dp := NewHttpDirectoryProvider(server.URL+"/directory",
+			WithTransport(ht))
+		assert.Equal(t, ht, dp.HttpTransport)
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, server.URL+"/nonce/new-nonce", d["newNonce"])
+	})
+}
+
+func TestDirectoryChanged(t *testing.T) {
+	old := map[string]interface{}{
+		"keyChange": "https://bastion/acme/key-change",
+		"meta": map[string]interface{}{
+			"website": "https://bastion",
+		},
+		"newNonce":   "https://bastion/acme/new-nonce",
+		"revokeCert": "https://bastion/acme/revoke-cert",
+	}
+
+	t.Run("Same directory", func(t *testing.T) {
+		assert.Empty(t, DirectoryChanged(old, map[string]interface{}{
+			"keyChange": "https://bastion/acme/key-change",
+			"meta": map[string]interface{}{
+				"website": "https://bastion",
+			},
+			"newNonce":   "https://bastion/acme/new-nonce",
+			"revokeCert": "https://bastion/acme/revoke-cert",
+		}))
+	})
+
+	t.Run("Added, removed and changed keys", func(t *testing.T) {
+		assert.Equal(t, []string{"meta", "newNonce", "newOrder",
+			"revokeCert"}, DirectoryChanged(old, map[string]interface{}{
+			"keyChange": "https://bastion/acme/key-change",
+			"meta": map[string]interface{}{
+				"website": "https://other-bastion",
+			},
+			"newNonce": "https://bastion/acme/nonce",
+			"newOrder": "https://bastion/acme/new-order",
+		}))
+	})
+}
+
+type SequenceDirectoryProvider struct {
+	*MemoryDirectoryProvider
+	directories []map[string]interface{}
+}
+
+func (p *SequenceDirectoryProvider) Directory() (map[string]interface{},
+	error) {
+	d := p.directories[0]
+	if len(p.directories) > 1 {
+		p.directories = p.directories[1:]
+	}
+	return d, nil
+}
+
+func TestCachingDirectoryProviderOnChange(t *testing.T) {
+	clock := dummy.NewFakeClock(time.Now())
+	dp := NewCachingDirectoryProvider(&SequenceDirectoryProvider{
+		directories: []map[string]interface{}{
+			{"newNonce": "http://bastion/nonce/new-nonce"},
+			{"newNonce": "http://bastion/nonce/new-nonce"},
+			{"newNonce": "http://bastion/nonce/other-nonce"},
+		},
+	}, time.Minute)
+	dp.Clock = clock
+	calls := [][]string{}
+	dp.OnChange = func(changed []string) {
+		calls = append(calls, changed)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+	}
+	assert.Equal(t, [][]string{{"newNonce"}}, calls)
+}
+
+func TestDirectoryInto(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{
+				"meta": {
+					"caaIdentities": ["bastion"],
+					"termsOfService": "https://bastion/terms"
+				},
+				"newNonce": "https://bastion/acme/new-nonce"
+			}`))
+		}))
+	defer server.Close()
+
+	type acmeDirectory struct {
+		Meta struct {
+			CaaIdentities  []string `json:"caaIdentities"`
+			TermsOfService string   `json:"termsOfService"`
+		} `json:"meta"`
+		NewNonce string `json:"newNonce"`
+	}
+
+	t.Run("Decode into a custom struct", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+		dp := NewHttpDirectoryProvider(server.URL, WithTransport(ht))
+		d := acmeDirectory{}
+		err := dp.DirectoryInto(&d)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/acme/new-nonce", d.NewNonce)
+		assert.Equal(t, []string{"bastion"}, d.Meta.CaaIdentities)
+		assert.Equal(t, "https://bastion/terms", d.Meta.TermsOfService)
+	})
+
+	t.Run("Unwired provider", func(t *testing.T) {
+		d := acmeDirectory{}
+		err := NewHttpDirectoryProvider(server.URL).DirectoryInto(&d)
+		assert.Error(t, err)
+	})
+}
+
+func TestHttpDirectoryProviderRevalidation(t *testing.T) {
+	var fetches, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			atomic.AddInt32(&fetches, 1)
+			w.Header().Set("ETag", `"v1"`)
+			GetDirectory(w, r)
+		}))
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader)
+	dp := NewHttpDirectoryProvider(server.URL, WithTransport(ht))
+
+	for i := 0; i < 3; i++ {
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, server.URL+"/nonce/new-nonce", d["newNonce"])
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&notModified))
+}
+
+func TestTemplateDirectoryProvider(t *testing.T) {
+	dp := NewTemplateDirectoryProvider("https://bastion/", "{base}/v2/{op}",
+		"newNonce", "newAccount", "revokeCert")
+	dp.Entries["revokeCert"] = "https://legacy.bastion/revoke"
+	dp.Entries["meta"] = map[string]interface{}{"website": "https://bastion"}
+
+	t.Run("Templated and explicit endpoints", func(t *testing.T) {
+		assert.Equal(t, "https://bastion/v2/newAccount",
+			dp.Endpoint("newAccount"))
+		assert.Equal(t, "https://legacy.bastion/revoke",
+			dp.Endpoint("revokeCert"))
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, map[string]interface{}{
+			"newNonce":   "https://bastion/v2/newNonce",
+			"newAccount": "https://bastion/v2/newAccount",
+			"revokeCert": "https://legacy.bastion/revoke",
+			"meta": map[string]interface{}{
+				"website": "https://bastion",
+			},
+		}, d)
+		assert.Equal(t, "https://bastion/", dp.GetUrl())
+	})
+
+	t.Run("Resolved by the transport", func(t *testing.T) {
+		ht := MustNewHttpTransport("https://bastion", DefaultNonceHeader,
+			WithDirectoryProvider(dp))
+		url, err := ht.NewNonceUrl()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion/v2/newNonce", url)
+		url, err = ht.ResolveEndpoint("revokeCert")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://legacy.bastion/revoke", url)
+	})
+}
+
+func TestRefreshDirectory(t *testing.T) {
+	t.Run("Refreshable caching provider", func(t *testing.T) {
+		inner := NewMemoryDirectoryProvider(map[string]interface{}{
+			"newNonce": "http://bastion/nonce/new-nonce",
+		})
+		dp := NewCachingDirectoryProvider(inner, time.Hour)
+		changes := [][]string{}
+		dp.OnChange = func(changed []string) {
+			changes = append(changes, changed)
+		}
+		_, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		inner.Set("newNonce", "http://bastion/v2/new-nonce")
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+		err = RefreshDirectory(dp)
+		if err != nil {
+			t.Error(err)
+		}
+		d, err = dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/v2/new-nonce", d["newNonce"])
+		assert.Equal(t, [][]string{{"newNonce"}}, changes)
+	})
+
+	t.Run("Refresh errors keep the cache", func(t *testing.T) {
+		inner := &CountingDirectoryProvider{
+			HttpDirectoryProvider: NewHttpDirectoryProvider(""),
+		}
+		dp := NewCachingDirectoryProvider(inner, time.Hour)
+		_, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		inner.err = errors.New("unavailable")
+		assert.EqualError(t, dp.Refresh(), "unavailable")
+		inner.err = nil
+		_, err = dp.Directory()
+		assert.NoError(t, err)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+	})
+
+	t.Run("Refreshed HTTP provider fetches unconditionally",
+		func(t *testing.T) {
+			conditional := []bool{}
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					conditional = append(conditional,
+						r.Header.Get("If-None-Match") != "")
+					w.Header().Set("ETag", `"v1"`)
+					w.Write([]byte(`{"newNonce": "/new-nonce"}`))
+				}))
+			defer server.Close()
+			dp := NewHttpDirectoryProvider(server.URL)
+			MustNewHttpTransport(server.URL, DefaultNonceHeader,
+				WithDirectoryProvider(dp))
+			for i := 0; i < 2; i++ {
+				_, err := dp.Directory()
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			err := RefreshDirectory(dp)
+			if err != nil {
+				t.Error(err)
+			}
+			_, err = dp.Directory()
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, []bool{false, true, false}, conditional)
+		})
+
+	t.Run("Non-refreshable memory provider", func(t *testing.T) {
+		dp := NewMemoryDirectoryProvider(map[string]interface{}{
+			"newNonce": "http://bastion/nonce/new-nonce",
+		})
+		_, ok := interface{}(dp).(Refresher)
+		assert.False(t, ok)
+		assert.NoError(t, RefreshDirectory(dp))
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TXTResolver resolves the TXT records of a domain. It is satisfied by
+// *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNSDirectoryProvider implements the DirectoryProvider interface discovering
+// the bastion base URL from the TXT records of a domain. The first record
+// holding an absolute http or https URL, either bare or as "url=<url>", is
+// used.
+//
+// If DirectoryPath is empty a static directory based on the discovered URL is
+// returned, otherwise the directory is fetched over HTTP from the discovered
+// URL joined with DirectoryPath.
+//
+// The discovered URL is cached for TTL, as the records TTL isn't exposed by
+// the resolver.
+type DNSDirectoryProvider struct {
+	// HttpTransport is the transport used to fetch the directory.
+	*HttpTransport
+	// Clock provides the time used to expire the cached URL.
+	Clock Clock
+	// DirectoryPath is the path of the directory document on the bastion.
+	DirectoryPath string
+	// Domain is the domain whose TXT records are looked up.
+	Domain string
+	// Resolver resolves the TXT records.
+	Resolver TXTResolver
+	// TTL is how long the discovered URL is cached.
+	TTL time.Duration
+
+	base   string
+	expiry time.Time
+	mu     sync.Mutex
+}
+
+// NewDNSDirectoryProvider initializes a new DNSDirectoryProvider looking up
+// the given domain with net.DefaultResolver and caching the discovered URL for
+// the given ttl.
+func NewDNSDirectoryProvider(domain string,
+	ttl time.Duration) *DNSDirectoryProvider {
+	return &DNSDirectoryProvider{
+		Clock:    systemClock{},
+		Domain:   domain,
+		Resolver: net.DefaultResolver,
+		TTL:      ttl,
+	}
+}
+
+// BaseUrl returns the bastion base URL discovered from the domain TXT
+// records, looking them up if the URL isn't cached or the TTL expired.
+func (p *DNSDirectoryProvider) BaseUrl() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.base != "" && p.Clock.Now().Before(p.expiry) {
+		return p.base, nil
+	}
+	ctx := context.Background()
+	if p.HttpTransport != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, p.HttpTransport.DirectoryTimeout)
+		defer cancel()
+	}
+	records, err := p.Resolver.LookupTXT(ctx, p.Domain)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		base := strings.TrimPrefix(strings.TrimSpace(record), "url=")
+		u, err := url.Parse(base)
+		if err != nil || u.Host == "" ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		p.base = strings.TrimSuffix(base, "/")
+		p.expiry = p.Clock.Now().Add(p.TTL)
+		return p.base, nil
+	}
+	return "", errors.New("no bastion url found in the TXT records of " +
+		p.Domain)
+}
+
+// Directory returns the directory of the discovered bastion.
+func (p *DNSDirectoryProvider) Directory() (map[string]interface{}, error) {
+	base, err := p.BaseUrl()
+	if err != nil {
+		return nil, err
+	}
+	if p.DirectoryPath == "" {
+		return map[string]interface{}{
+			"newNonce": base + "/nonce/new-nonce",
+		}, nil
+	}
+	dp := &HttpDirectoryProvider{
+		HttpTransport: p.HttpTransport,
+		Url:           base + p.DirectoryPath,
+	}
+	return dp.Directory()
+}
+
+// GetUrl returns the discovered bastion base URL, or an empty string if it
+// can't be discovered.
+func (p *DNSDirectoryProvider) GetUrl() string {
+	base, _ := p.BaseUrl()
+	return base
+}
+
+// SetTransport sets the HttpTransport used to fetch the directory.
+func (p *DNSDirectoryProvider) SetTransport(tr Transport) error {
+	ht, ok := tr.(*HttpTransport)
+	if !ok {
+		return ErrTransportCast
+	}
+	p.HttpTransport = ht
+	return nil
+}
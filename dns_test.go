@@ -0,0 +1,105 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeResolver struct {
+	calls   int
+	records map[string][]string
+}
+
+func (r *FakeResolver) LookupTXT(ctx context.Context,
+	name string) ([]string, error) {
+	r.calls++
+	return r.records[name], nil
+}
+
+func TestDNSDirectoryProvider(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	newProvider := func(records ...string) (*DNSDirectoryProvider,
+		*FakeResolver) {
+		resolver := &FakeResolver{records: map[string][]string{
+			"_peasant.bastion.test": records,
+		}}
+		dp := NewDNSDirectoryProvider("_peasant.bastion.test", time.Minute)
+		dp.Resolver = resolver
+		return dp, resolver
+	}
+
+	t.Run("Static directory from the discovered url", func(t *testing.T) {
+		dp, _ := newProvider("v=spf1 -all", "url=https://bastion.test/")
+		d, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion.test/nonce/new-nonce", d["newNonce"])
+		assert.Equal(t, "https://bastion.test", dp.GetUrl())
+	})
+
+	t.Run("Surrounding spaces trimmed from the record", func(t *testing.T) {
+		dp, _ := newProvider(" url=https://bastion.test/ ")
+		_, err := dp.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "https://bastion.test", dp.GetUrl())
+	})
+
+	t.Run("Fetch the directory from the discovered url", func(t *testing.T) {
+		dp, _ := newProvider(server.URL)
+		dp.DirectoryPath = "/directory"
+		tr, err := NewHttpTransport("", DefaultNonceHeader,
+			WithDirectoryProvider(dp))
+		if err != nil {
+			t.Error(err)
+		}
+		nonce, err := tr.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Len(t, nonce, 32)
+	})
+
+	t.Run("Lookups cached for the TTL", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		dp, resolver := newProvider("https://bastion.test")
+		dp.Clock = clock
+		dp.Directory()
+		clock.Advance(59 * time.Second)
+		dp.Directory()
+		assert.Equal(t, 1, resolver.calls)
+		clock.Advance(time.Second)
+		dp.Directory()
+		assert.Equal(t, 2, resolver.calls)
+	})
+
+	t.Run("No url in the records", func(t *testing.T) {
+		dp, _ := newProvider("v=spf1 -all", "url=ftp://bastion.test")
+		_, err := dp.Directory()
+		assert.EqualError(t, err,
+			"no bastion url found in the TXT records of _peasant.bastion.test")
+		assert.Empty(t, dp.GetUrl())
+	})
+}
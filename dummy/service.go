@@ -15,28 +15,265 @@
 package dummy
 
 import (
-	"math/rand"
+	"container/list"
+	"crypto/rand"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func randomString(s int) string {
-	asciiLower := "abcdefghijklmnopqrstuvwxyz"
-	asciiUpper := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	digits := "012345679"
-	chars := []rune(asciiLower + asciiUpper + digits)
-	r := make([]rune, s)
-	for i := range r {
-		r[i] = chars[rand.Intn(len(chars))]
+// NonceHeader is the header the nonce is read from. It mirrors
+// peasant.DefaultNonceHeader, which can't be imported here because the
+// peasant tests depend on this package.
+const NonceHeader = "Nonce"
+
+var (
+	// ErrConflictingNonces is returned by the writer-free checks when the
+	// request carries differing nonce headers.
+	ErrConflictingNonces = errors.New("the request carries conflicting nonces")
+
+	// ErrNonceNotProvided is returned by CheckProvided when the request
+	// carries no nonce.
+	ErrNonceNotProvided = errors.New("the request carries no nonce")
+)
+
+const nonceChars = "abcdefghijklmnopqrstuvwxyz" +
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// randomString returns a string of s characters from nonceChars using the
+// entropy read from r into buf, which must hold at least s bytes. Bytes that
+// would bias the distribution are skipped. The string is the only allocation.
+func randomString(r io.Reader, buf []byte, s int) (string, error) {
+	limit := byte(256 - 256%len(nonceChars))
+	var out strings.Builder
+	out.Grow(s)
+	for out.Len() < s {
+		b := buf[:s-out.Len()]
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if c < limit {
+				out.WriteByte(nonceChars[int(c)%len(nonceChars)])
+			}
+		}
+	}
+	return out.String(), nil
+}
+
+// conflicting reports if the extractor finds many differing nonces in the
+// request, signaling a confused client or an attack. Identical duplicates are
+// fine.
+func conflicting(values []string) bool {
+	for i := 1; i < len(values); i++ {
+		if values[i] != values[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// EvictionPolicy defines what GetNonce does when the service already holds the
+// maximum number of outstanding nonces.
+type EvictionPolicy int
+
+const (
+	// EvictOldest drops the oldest outstanding nonce to make room for the new
+	// one.
+	EvictOldest EvictionPolicy = iota
+	// RejectWhenFull makes GetNonce return an error until a nonce is consumed,
+	// cleared or expired.
+	RejectWhenFull
+)
+
+// NonceStats is a snapshot of the DummyInMemoryNonceService counters.
+type NonceStats struct {
+	// Issued is the number of nonces generated by GetNonce.
+	Issued uint64
+	// Consumed is the number of nonces successfully consumed.
+	Consumed uint64
+	// Rejected is the number of missing or unknown nonces presented to
+	// Consume.
+	Rejected uint64
+	// Expired is the number of nonces dropped after their expiry, either
+	// swept or presented too late.
+	Expired uint64
+	// Evicted is the number of outstanding nonces dropped by the EvictOldest
+	// policy to make room for a new one.
+	Evicted uint64
+	// DroppedEvents is the number of events not published because the events
+	// channel was full.
+	DroppedEvents uint64
+	// Outstanding is the number of nonces currently held.
+	Outstanding int
+}
+
+// ConsumedInfo describes the first consume of a nonce, retained for replay
+// diagnostics.
+type ConsumedInfo struct {
+	// At is when the nonce was consumed, according to the service clock.
+	At time.Time
+	// Client is the remote address of the request consuming the nonce.
+	Client string
+}
+
+// NonceEventType identifies a transition in the nonce lifecycle.
+type NonceEventType string
+
+const (
+	// EventIssued is published when GetNonce generates a nonce.
+	EventIssued NonceEventType = "issued"
+	// EventConsumed is published when a nonce is successfully consumed.
+	EventConsumed NonceEventType = "consumed"
+	// EventExpired is published when a nonce is dropped after its expiry,
+	// either swept or presented too late.
+	EventExpired NonceEventType = "expired"
+	// EventEvicted is published when an outstanding nonce is dropped by the
+	// EvictOldest policy to make room for a new one.
+	EventEvicted NonceEventType = "evicted"
+	// EventRejected is published when a missing, unknown or conflicting nonce
+	// is presented to Consume.
+	EventRejected NonceEventType = "rejected"
+)
+
+// NonceEvent describes a nonce lifecycle transition published on the
+// channel returned by Events.
+type NonceEvent struct {
+	// Type is the transition.
+	Type NonceEventType
+	// Nonce is the nonce involved, empty if none was presented.
+	Nonce string
+	// Time is when the transition happened, according to the service clock.
+	Time time.Time
+}
+
+// Option configures a DummyInMemoryNonceService.
+type Option func(*DummyInMemoryNonceService)
+
+// WithClock sets the Clock used to check the nonces expiry.
+func WithClock(c Clock) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.clock = c
+	}
+}
+
+// WithConsumedRetention keeps the ConsumedInfo of consumed nonces for the
+// given window, so LookupConsumed can tell when and by whom a replayed nonce
+// was first consumed. A zero window, the default, retains nothing.
+func WithConsumedRetention(d time.Duration) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.retention = d
+	}
+}
+
+// WithEvents publishes the nonce lifecycle events on a channel buffering up
+// to size events, returned by Events. Events are dropped and counted when the
+// channel is full, so slow consumers never stall the requests.
+func WithEvents(size int) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.events = make(chan NonceEvent, size)
+	}
+}
+
+// WithExtractor sets the function reading the nonce from the request, so it
+// can be carried in a query parameter or path segment instead of the
+// NonceHeader header. It matches peasant.NonceExtractor. As the function
+// reads a single nonce, conflicting nonces are only detected by the default
+// extractor, reading all the NonceHeader values.
+func WithExtractor(f func(*http.Request) string) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.extractor = func(r *http.Request) []string {
+			return []string{f(r)}
+		}
+	}
+}
+
+// WithMaxOutstanding caps the number of outstanding nonces to max, applying
+// the given policy when the cap is reached. A max of zero means no cap.
+func WithMaxOutstanding(max int, policy EvictionPolicy) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.maxOutstanding = max
+		s.policy = policy
+	}
+}
+
+// WithRandom sets the entropy source nonces are generated from. Tests can use
+// a deterministic reader to get known nonces.
+func WithRandom(r io.Reader) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.random = r
+	}
+}
+
+// WithTenant sets the function reading the tenant from the request, from
+// a header or the request context. Nonces are stored per tenant, so a nonce
+// issued to a tenant can only be verified and consumed by the same tenant.
+// Requests without a tenant share the default namespace, also used by Seed,
+// Touch, Clear and ClearExisting.
+func WithTenant(f func(*http.Request) string) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.tenant = f
+	}
+}
+
+// WithTTL sets how long a nonce is valid after being issued.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *DummyInMemoryNonceService) {
+		s.ttl = ttl
 	}
-	return string(r)
 }
 
 // DummyInMemoryNonceService implements the NonceService interface for managing
 // nonces in an in-memory map.
 type DummyInMemoryNonceService struct {
-	nonceMap map[string]*interface{}
+	// buf is the entropy buffer reused by GetNonce under the mutex.
+	buf [32]byte
+	// challenges holds the challenges the nonces issued by GetBoundNonce
+	// are bound to.
+	challenges     map[string][]byte
+	clock          Clock
+	events         chan NonceEvent
+	extractor      func(*http.Request) []string
+	maxOutstanding int
+	mu             sync.Mutex
+	nonceMap       map[string]*list.Element
+	// nonces keeps the outstanding nonces ordered from the oldest to the
+	// newest.
+	nonces *list.List
+	policy EvictionPolicy
+	random io.Reader
+	// retained keeps the consumed nonces ordered from the oldest to the
+	// newest.
+	retained    *list.List
+	retainedMap map[string]*list.Element
+	retention   time.Duration
+	tenant      func(*http.Request) string
+	ttl         time.Duration
+
+	consumed atomic.Uint64
+	dropped  atomic.Uint64
+	evicted  atomic.Uint64
+	expired  atomic.Uint64
+	issued   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// consumedEntry is a consumed nonce retained for diagnostics.
+type consumedEntry struct {
+	nonce string
+	info  ConsumedInfo
+}
+
+// nonceEntry is an outstanding nonce, namespaced by its tenant, and its
+// expiry.
+type nonceEntry struct {
+	nonce  string
+	expiry time.Time
 }
 
 func (s *DummyInMemoryNonceService) Block(resp http.ResponseWriter,
@@ -47,56 +284,375 @@ func (s *DummyInMemoryNonceService) Block(resp http.ResponseWriter,
 // Clear clears the nonce associated with the specified key in the in-memory
 // map.
 func (s *DummyInMemoryNonceService) Clear(nonce string) error {
-	_, ok := s.nonceMap[nonce]
-	if !ok {
-		return nil
-	}
-	delete(s.nonceMap, nonce)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(nonce)
 	return nil
 }
 
+// ClearExisting clears the nonce like Clear, reporting if it was held by the
+// service. Clearing an unknown or already cleared nonce returns false.
+func (s *DummyInMemoryNonceService) ClearExisting(nonce string) (bool,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.remove(nonce)
+	return ok, nil
+}
+
 // Consume consumes the nonce associated with a specified key and returns
 // whether the nonce was successfully consumed and any error that occurred.
+// Nonces past their expiry, according to the service clock, are rejected.
+// Requests carrying differing nonce headers are rejected with 400 Bad Request.
 func (s *DummyInMemoryNonceService) Consume(res http.ResponseWriter,
 	req *http.Request) error {
-	nonce := req.Header.Get("nonce")
-	if nonce == "" {
-		res.WriteHeader(http.StatusForbidden)
-		return nil
-	}
-	_, ok := s.nonceMap[nonce]
-	if !ok {
-		res.WriteHeader(http.StatusForbidden)
+	ok, err := s.TryConsume(req)
+	if errors.Is(err, ErrConflictingNonces) {
+		res.WriteHeader(http.StatusBadRequest)
 		return nil
 	}
-	err := s.Clear(nonce)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		res.WriteHeader(http.StatusForbidden)
+	}
 	return nil
 }
 
-func (s *DummyInMemoryNonceService) GetNonce(req *http.Request) (string, error) {
-	nonce := randomString(32)
-	s.nonceMap[nonce] = nil
-	ticker := time.NewTicker(250 * time.Millisecond)
-	done := make(chan bool)
-
-	go func(nonce string) {
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				s.Clear(nonce)
-				done <- true
-			}
+// TryConsume consumes the nonce carried by the request without writing any
+// response, reporting if it was consumed. Missing, unknown and expired nonces
+// return false with no error, and differing nonce headers return
+// ErrConflictingNonces.
+func (s *DummyInMemoryNonceService) TryConsume(req *http.Request) (bool,
+	error) {
+	nonce, conflict := s.nonce(req)
+	if conflict {
+		s.record(&s.rejected, EventRejected, "")
+		return false, ErrConflictingNonces
+	}
+	if nonce == "" {
+		s.record(&s.rejected, EventRejected, "")
+		return false, nil
+	}
+	s.mu.Lock()
+	expiry, ok := s.remove(s.tenantKey(req, nonce))
+	s.mu.Unlock()
+	if !ok {
+		s.record(&s.rejected, EventRejected, nonce)
+		return false, nil
+	}
+	if !s.clock.Now().Before(expiry) {
+		s.record(&s.expired, EventExpired, nonce)
+		return false, nil
+	}
+	s.record(&s.consumed, EventConsumed, nonce)
+	if s.retention > 0 {
+		s.retain(nonce, ConsumedInfo{
+			At:     s.clock.Now(),
+			Client: req.RemoteAddr,
+		})
+	}
+	return true, nil
+}
+
+// LookupConsumed returns the info of the first consume of the nonce, if it
+// was consumed within the retention window set with WithConsumedRetention.
+func (s *DummyInMemoryNonceService) LookupConsumed(
+	nonce string) (*ConsumedInfo, bool) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepRetained(now)
+	e, ok := s.retainedMap[nonce]
+	if !ok {
+		return nil, false
+	}
+	info := e.Value.(*consumedEntry).info
+	return &info, true
+}
+
+// retain retains the consumed nonce info, dropping the entries past the
+// retention window.
+func (s *DummyInMemoryNonceService) retain(nonce string, info ConsumedInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepRetained(info.At)
+	if _, ok := s.retainedMap[nonce]; ok {
+		return
+	}
+	s.retainedMap[nonce] = s.retained.PushBack(&consumedEntry{
+		nonce: nonce,
+		info:  info,
+	})
+}
+
+// sweepRetained drops the consumed nonces past the retention window. It must
+// be called with the mutex held.
+func (s *DummyInMemoryNonceService) sweepRetained(now time.Time) {
+	for e := s.retained.Front(); e != nil; e = s.retained.Front() {
+		entry := e.Value.(*consumedEntry)
+		if now.Before(entry.info.At.Add(s.retention)) {
+			break
 		}
-	}(nonce)
+		delete(s.retainedMap, entry.nonce)
+		s.retained.Remove(e)
+	}
+}
 
+// GetNonce generates a new nonce valid for the service TTL. Expired nonces are
+// swept from the map. As nonces are kept ordered by expiry the sweep stops at
+// the first valid one. If the service holds the maximum outstanding nonces the
+// oldest one is evicted, or an error is returned, depending on the eviction
+// policy.
+func (s *DummyInMemoryNonceService) GetNonce(req *http.Request) (string, error) {
+	return s.issue(req, nil)
+}
+
+// GetBoundNonce works like GetNonce, binding the nonce to the challenge posted
+// by the client, like its identity. The challenge can be read back with
+// Challenge before the nonce is consumed, to check the request comes from the
+// same identity.
+func (s *DummyInMemoryNonceService) GetBoundNonce(req *http.Request,
+	challenge []byte) (string, error) {
+	if len(challenge) == 0 {
+		return "", errors.New("can't bind a nonce to an empty challenge")
+	}
+	return s.issue(req, challenge)
+}
+
+// Challenge returns the challenge the nonce carried by the request was bound
+// to by GetBoundNonce, if the nonce is held and was bound.
+func (s *DummyInMemoryNonceService) Challenge(req *http.Request) ([]byte,
+	bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.challenges[s.tenantKey(req, s.first(req))]
+	return challenge, ok
+}
+
+// issue generates and stores a new nonce, bound to the challenge if it isn't
+// nil.
+func (s *DummyInMemoryNonceService) issue(req *http.Request,
+	challenge []byte) (string, error) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nonce, err := randomString(s.random, s.buf[:], len(s.buf))
+	if err != nil {
+		return "", err
+	}
+	for e := s.nonces.Front(); e != nil; e = s.nonces.Front() {
+		entry := e.Value.(*nonceEntry)
+		if now.Before(entry.expiry) {
+			break
+		}
+		s.remove(entry.nonce)
+		s.record(&s.expired, EventExpired, s.untenant(entry.nonce))
+	}
+	if s.maxOutstanding > 0 && s.nonces.Len() >= s.maxOutstanding {
+		if s.policy == RejectWhenFull {
+			return "", errors.New("too many outstanding nonces")
+		}
+		key := s.nonces.Front().Value.(*nonceEntry).nonce
+		s.remove(key)
+		s.record(&s.evicted, EventEvicted, s.untenant(key))
+	}
+	key := s.tenantKey(req, nonce)
+	s.store(key, now.Add(s.ttl))
+	if challenge != nil {
+		s.challenges[key] = append([]byte(nil), challenge...)
+	}
+	s.record(&s.issued, EventIssued, nonce)
 	return nonce, nil
 }
 
+// Seed stores the given nonces as valid for the service TTL, so they can be
+// consumed without being issued by GetNonce. It is meant for warmup and
+// deterministic tests, so the outstanding nonces cap isn't applied.
+func (s *DummyInMemoryNonceService) Seed(nonces ...string) error {
+	expiry := s.clock.Now().Add(s.ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nonce := range nonces {
+		if nonce == "" {
+			return errors.New("can't seed an empty nonce")
+		}
+		s.store(nonce, expiry)
+	}
+	return nil
+}
+
+// Put stores the nonce as valid for the service TTL, like Seed. Along with
+// Take it satisfies peasant.NonceStore, so the service can be used as a shard
+// of a peasant.ShardedNonceService.
+func (s *DummyInMemoryNonceService) Put(nonce string) error {
+	return s.Seed(nonce)
+}
+
+// Take removes the nonce, reporting if it was held and not expired.
+func (s *DummyInMemoryNonceService) Take(nonce string) (bool, error) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	expiry, ok := s.remove(nonce)
+	s.mu.Unlock()
+	return ok && now.Before(expiry), nil
+}
+
+// Touch resets the nonce expiry to the service TTL from now without
+// consuming it, keeping it valid across a slow multi-step flow. An unknown or
+// expired nonce is an error.
+func (s *DummyInMemoryNonceService) Touch(nonce string) error {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.nonceMap[nonce]
+	if !ok || !now.Before(e.Value.(*nonceEntry).expiry) {
+		return errors.New("nonce not found")
+	}
+	s.store(nonce, now.Add(s.ttl))
+	return nil
+}
+
+// Verify reports if the nonce provided in the request is known and not
+// expired, without consuming it.
+func (s *DummyInMemoryNonceService) Verify(r *http.Request) (bool, error) {
+	nonce := s.first(r)
+	s.mu.Lock()
+	e, ok := s.nonceMap[s.tenantKey(r, nonce)]
+	var expiry time.Time
+	if ok {
+		expiry = e.Value.(*nonceEntry).expiry
+	}
+	s.mu.Unlock()
+	return ok && s.clock.Now().Before(expiry), nil
+}
+
+// Events returns the channel the nonce lifecycle events are published on, or
+// nil if WithEvents wasn't used.
+func (s *DummyInMemoryNonceService) Events() <-chan NonceEvent {
+	return s.events
+}
+
+// record increments the counter and publishes the event, if events are
+// enabled, without blocking.
+func (s *DummyInMemoryNonceService) record(counter *atomic.Uint64,
+	t NonceEventType, nonce string) {
+	counter.Add(1)
+	if s.events == nil {
+		return
+	}
+	select {
+	case s.events <- NonceEvent{Type: t, Nonce: nonce, Time: s.clock.Now()}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// NonceAge returns the age of the nonce carried by the request, according to
+// the service clock, if the nonce is held. Touching a nonce makes it fresh
+// again.
+func (s *DummyInMemoryNonceService) NonceAge(r *http.Request) (time.Duration,
+	bool) {
+	s.mu.Lock()
+	e, ok := s.nonceMap[s.tenantKey(r, s.first(r))]
+	var expiry time.Time
+	if ok {
+		expiry = e.Value.(*nonceEntry).expiry
+	}
+	s.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	return s.clock.Now().Sub(expiry.Add(-s.ttl)), true
+}
+
+// Outstanding returns the number of nonces held by the service, including
+// expired ones not swept yet.
+func (s *DummyInMemoryNonceService) Outstanding() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nonces.Len()
+}
+
+// Stats returns a snapshot of the service counters.
+func (s *DummyInMemoryNonceService) Stats() NonceStats {
+	return NonceStats{
+		Issued:        s.issued.Load(),
+		Consumed:      s.consumed.Load(),
+		Rejected:      s.rejected.Load(),
+		Expired:       s.expired.Load(),
+		Evicted:       s.evicted.Load(),
+		DroppedEvents: s.dropped.Load(),
+		Outstanding:   s.Outstanding(),
+	}
+}
+
+// nonce returns the first nonce found by the extractor in the request, and
+// reports if the request carries conflicting nonces.
+func (s *DummyInMemoryNonceService) nonce(r *http.Request) (string, bool) {
+	values := s.extractor(r)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], conflicting(values)
+}
+
+// first returns the first nonce found by the extractor in the request.
+func (s *DummyInMemoryNonceService) first(r *http.Request) string {
+	nonce, _ := s.nonce(r)
+	return nonce
+}
+
+// tenantKey returns the nonce namespaced by the request tenant, if any.
+func (s *DummyInMemoryNonceService) tenantKey(r *http.Request,
+	nonce string) string {
+	if s.tenant == nil {
+		return nonce
+	}
+	tenant := s.tenant(r)
+	if tenant == "" {
+		return nonce
+	}
+	return tenant + "\x00" + nonce
+}
+
+// untenant returns the nonce namespaced by tenantKey, as the client received
+// it.
+func (s *DummyInMemoryNonceService) untenant(key string) string {
+	if s.tenant == nil {
+		return key
+	}
+	i := strings.LastIndexByte(key, 0)
+	if i < 0 {
+		return key
+	}
+	return key[i+1:]
+}
+
+// store stores the nonce as the newest one. It must be called with the mutex
+// held.
+func (s *DummyInMemoryNonceService) store(nonce string, expiry time.Time) {
+	s.remove(nonce)
+	s.nonceMap[nonce] = s.nonces.PushBack(&nonceEntry{
+		nonce:  nonce,
+		expiry: expiry,
+	})
+}
+
+// remove removes the nonce returning its expiry and if it was held. It must be
+// called with the mutex held.
+func (s *DummyInMemoryNonceService) remove(nonce string) (time.Time, bool) {
+	e, ok := s.nonceMap[nonce]
+	if !ok {
+		return time.Time{}, false
+	}
+	delete(s.nonceMap, nonce)
+	delete(s.challenges, nonce)
+	s.nonces.Remove(e)
+	return e.Value.(*nonceEntry).expiry, true
+}
+
 func (s *DummyInMemoryNonceService) Skip(r *http.Request) bool {
 	if strings.Contains(r.URL.String(), "new-nonce") {
 		return true
@@ -104,18 +660,57 @@ func (s *DummyInMemoryNonceService) Skip(r *http.Request) bool {
 	return false
 }
 
+// Provided checks the request carries a nonce, otherwise the response status
+// is set to forbidden. Requests carrying differing nonce headers are answered
+// with 400 Bad Request.
 func (s *DummyInMemoryNonceService) Provided(w http.ResponseWriter,
 	r *http.Request) error {
-	nonce := r.Header.Get("nonce")
-	if nonce == "" {
+	err := s.CheckProvided(r)
+	if errors.Is(err, ErrConflictingNonces) {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	if errors.Is(err, ErrNonceNotProvided) {
 		w.WriteHeader(http.StatusForbidden)
 		return nil
 	}
+	return err
+}
+
+// CheckProvided checks the request carries a nonce without writing any
+// response. It returns ErrNonceNotProvided if no nonce is carried and
+// ErrConflictingNonces if differing nonce headers are.
+func (s *DummyInMemoryNonceService) CheckProvided(r *http.Request) error {
+	nonce, conflict := s.nonce(r)
+	if conflict {
+		return ErrConflictingNonces
+	}
+	if nonce == "" {
+		return ErrNonceNotProvided
+	}
 	return nil
 }
 
-func NewDummyInMemoryNonceService() *DummyInMemoryNonceService {
-	return &DummyInMemoryNonceService{
-		nonceMap: make(map[string]*interface{}),
+// NewDummyInMemoryNonceService initializes a new DummyInMemoryNonceService.
+// Nonces are valid for 250 milliseconds unless WithTTL is used, and the number
+// of outstanding nonces isn't capped unless WithMaxOutstanding is used. Nonces
+// are generated from crypto/rand unless WithRandom is used.
+func NewDummyInMemoryNonceService(opts ...Option) *DummyInMemoryNonceService {
+	s := &DummyInMemoryNonceService{
+		challenges: make(map[string][]byte),
+		clock:      systemClock{},
+		extractor: func(r *http.Request) []string {
+			return r.Header.Values(NonceHeader)
+		},
+		nonceMap:    make(map[string]*list.Element),
+		nonces:      list.New(),
+		random:      rand.Reader,
+		retained:    list.New(),
+		retainedMap: make(map[string]*list.Element),
+		ttl:         250 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
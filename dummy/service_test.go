@@ -0,0 +1,636 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dummy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func consume(s *DummyInMemoryNonceService, nonce string) int {
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+	req.Header.Set(NonceHeader, nonce)
+	err := s.Consume(res, req)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return res.Code
+}
+
+func TestDummyInMemoryNonceService(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+
+	t.Run("Consume before the TTL", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock),
+			WithTTL(time.Minute))
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(59 * time.Second)
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+		assert.Equal(t, http.StatusForbidden, consume(s, nonce))
+	})
+
+	t.Run("Reject after the TTL", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock),
+			WithTTL(time.Minute))
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+		assert.Equal(t, http.StatusForbidden, consume(s, nonce))
+	})
+
+	t.Run("Sweep expired nonces", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock))
+		_, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Second)
+		_, err = s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 1, s.Outstanding())
+	})
+}
+
+func TestSeed(t *testing.T) {
+	t.Run("Consume a seeded nonce", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService()
+		err := s.Seed("seeded-nonce", "other-seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, consume(s, "seeded-nonce"))
+		assert.Equal(t, http.StatusForbidden, consume(s, "seeded-nonce"))
+		assert.Equal(t, http.StatusOK, consume(s, "other-seeded-nonce"))
+	})
+
+	t.Run("Seeded nonces respect the TTL", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock),
+			WithTTL(time.Minute))
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+		assert.Equal(t, http.StatusForbidden, consume(s, "seeded-nonce"))
+	})
+
+	t.Run("Empty nonce", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService()
+		assert.EqualError(t, s.Seed(""), "can't seed an empty nonce")
+	})
+}
+
+func TestMaxOutstanding(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+
+	t.Run("Evict the oldest nonce", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(WithTTL(time.Minute),
+			WithMaxOutstanding(2, EvictOldest))
+		nonces := []string{}
+		for i := 0; i < 3; i++ {
+			nonce, err := s.GetNonce(req)
+			if err != nil {
+				t.Error(err)
+			}
+			nonces = append(nonces, nonce)
+		}
+		assert.Equal(t, 2, s.Outstanding())
+		assert.Equal(t, http.StatusForbidden, consume(s, nonces[0]))
+		assert.Equal(t, http.StatusOK, consume(s, nonces[1]))
+		assert.Equal(t, http.StatusOK, consume(s, nonces[2]))
+		assert.Equal(t, uint64(1), s.Stats().Evicted)
+	})
+
+	t.Run("Error when full", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(WithTTL(time.Minute),
+			WithMaxOutstanding(2, RejectWhenFull))
+		first, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = s.GetNonce(req)
+		assert.EqualError(t, err, "too many outstanding nonces")
+		assert.Equal(t, http.StatusOK, consume(s, first))
+		_, err = s.GetNonce(req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Expired nonces don't count", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock),
+			WithTTL(time.Minute), WithMaxOutstanding(1, RejectWhenFull))
+		_, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+		_, err = s.GetNonce(req)
+		assert.NoError(t, err)
+	})
+}
+
+func TestStats(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+	clock := NewFakeClock(time.Now())
+	s := NewDummyInMemoryNonceService(WithClock(clock), WithTTL(time.Minute))
+	nonces := []string{}
+	for i := 0; i < 4; i++ {
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		nonces = append(nonces, nonce)
+	}
+	assert.Equal(t, http.StatusOK, consume(s, nonces[0]))
+	assert.Equal(t, http.StatusOK, consume(s, nonces[1]))
+	assert.Equal(t, http.StatusForbidden, consume(s, nonces[1]))
+	assert.Equal(t, http.StatusForbidden, consume(s, ""))
+	clock.Advance(time.Minute)
+	assert.Equal(t, http.StatusForbidden, consume(s, nonces[2]))
+
+	assert.Equal(t, NonceStats{
+		Issued:      4,
+		Consumed:    2,
+		Rejected:    2,
+		Expired:     1,
+		Outstanding: 1,
+	}, s.Stats())
+}
+
+func TestWithRandom(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+
+	t.Run("Known nonce from a fixed reader", func(t *testing.T) {
+		entropy := []byte{}
+		for i := 0; i < 32; i++ {
+			entropy = append(entropy, byte(i))
+		}
+		// Bytes past the unbiased range are skipped.
+		entropy = append([]byte{255, 248}, entropy...)
+		s := NewDummyInMemoryNonceService(
+			WithRandom(bytes.NewReader(entropy)))
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "abcdefghijklmnopqrstuvwxyzABCDEF", nonce)
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+	})
+
+	t.Run("Exhausted reader", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(
+			WithRandom(bytes.NewReader([]byte{1, 2, 3})))
+		_, err := s.GetNonce(req)
+		assert.Error(t, err)
+		assert.Equal(t, 0, s.Outstanding())
+	})
+}
+
+func TestClearExisting(t *testing.T) {
+	s := NewDummyInMemoryNonceService()
+	err := s.Seed("seeded-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Run("Present nonce", func(t *testing.T) {
+		cleared, err := s.ClearExisting("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, cleared)
+		assert.Equal(t, http.StatusForbidden, consume(s, "seeded-nonce"))
+	})
+
+	t.Run("Absent nonce", func(t *testing.T) {
+		cleared, err := s.ClearExisting("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.False(t, cleared)
+		cleared, err = s.ClearExisting("unknown-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.False(t, cleared)
+	})
+}
+
+func TestTouch(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+
+	t.Run("Touched nonce survives the original deadline", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock),
+			WithTTL(time.Second))
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(900 * time.Millisecond)
+		err = s.Touch(nonce)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(900 * time.Millisecond)
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+	})
+
+	t.Run("Unknown or expired nonce", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithClock(clock),
+			WithTTL(time.Second))
+		assert.EqualError(t, s.Touch("unknown-nonce"), "nonce not found")
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Second)
+		assert.EqualError(t, s.Touch(nonce), "nonce not found")
+	})
+}
+
+func TestWithTenant(t *testing.T) {
+	s := NewDummyInMemoryNonceService(WithTTL(time.Minute),
+		WithTenant(func(r *http.Request) string {
+			return r.Header.Get("Tenant")
+		}))
+	tenantRequest := func(tenant, nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		req.Header.Set("Tenant", tenant)
+		req.Header.Set(NonceHeader, nonce)
+		return req
+	}
+	consumeAs := func(tenant, nonce string) int {
+		res := httptest.NewRecorder()
+		err := s.Consume(res, tenantRequest(tenant, nonce))
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		return res.Code
+	}
+
+	t.Run("Consume within the same tenant", func(t *testing.T) {
+		nonce, err := s.GetNonce(tenantRequest("tenant-a", ""))
+		if err != nil {
+			t.Error(err)
+		}
+		valid, err := s.Verify(tenantRequest("tenant-a", nonce))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, valid)
+		assert.Equal(t, http.StatusOK, consumeAs("tenant-a", nonce))
+	})
+
+	t.Run("Reject another tenant", func(t *testing.T) {
+		nonce, err := s.GetNonce(tenantRequest("tenant-a", ""))
+		if err != nil {
+			t.Error(err)
+		}
+		valid, err := s.Verify(tenantRequest("tenant-b", nonce))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.False(t, valid)
+		assert.Equal(t, http.StatusForbidden, consumeAs("tenant-b", nonce))
+		assert.Equal(t, http.StatusForbidden, consumeAs("", nonce))
+		assert.Equal(t, http.StatusOK, consumeAs("tenant-a", nonce))
+	})
+
+	t.Run("Default namespace", func(t *testing.T) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden,
+			consumeAs("tenant-a", "seeded-nonce"))
+		assert.Equal(t, http.StatusOK, consumeAs("", "seeded-nonce"))
+	})
+}
+
+func TestLookupConsumed(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := NewDummyInMemoryNonceService(WithClock(clock), WithTTL(time.Minute),
+		WithConsumedRetention(time.Minute))
+	consumeFrom := func(client, nonce string) int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		req.RemoteAddr = client
+		req.Header.Set(NonceHeader, nonce)
+		err := s.Consume(res, req)
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		return res.Code
+	}
+	err := s.Seed("seeded-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+	first := clock.Now()
+
+	t.Run("Look up the first consume", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK,
+			consumeFrom("10.0.0.1:1234", "seeded-nonce"))
+		clock.Advance(time.Second)
+		assert.Equal(t, http.StatusForbidden,
+			consumeFrom("10.0.0.2:4321", "seeded-nonce"))
+		info, ok := s.LookupConsumed("seeded-nonce")
+		assert.True(t, ok)
+		assert.Equal(t, &ConsumedInfo{
+			At:     first,
+			Client: "10.0.0.1:1234",
+		}, info)
+	})
+
+	t.Run("Unknown nonce", func(t *testing.T) {
+		_, ok := s.LookupConsumed("unknown-nonce")
+		assert.False(t, ok)
+	})
+
+	t.Run("Past the retention window", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		_, ok := s.LookupConsumed("seeded-nonce")
+		assert.False(t, ok)
+	})
+
+	t.Run("Nothing retained by default", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService()
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, consume(s, "seeded-nonce"))
+		_, ok := s.LookupConsumed("seeded-nonce")
+		assert.False(t, ok)
+	})
+}
+
+func TestPutAndTake(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := NewDummyInMemoryNonceService(WithClock(clock), WithTTL(time.Minute))
+	for _, nonce := range []string{"first-nonce", "second-nonce"} {
+		err := s.Put(nonce)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	taken, err := s.Take("first-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+	assert.True(t, taken)
+	taken, _ = s.Take("first-nonce")
+	assert.False(t, taken)
+	clock.Advance(time.Minute)
+	taken, _ = s.Take("second-nonce")
+	assert.False(t, taken)
+}
+
+func TestConflictingNonces(t *testing.T) {
+	s := NewDummyInMemoryNonceService(WithTTL(time.Minute))
+	err := s.Seed("first-nonce", "second-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+	request := func(nonces ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		for _, nonce := range nonces {
+			req.Header.Add(NonceHeader, nonce)
+		}
+		return req
+	}
+
+	t.Run("Differing nonce headers", func(t *testing.T) {
+		req := request("first-nonce", "second-nonce")
+		res := httptest.NewRecorder()
+		err := s.Provided(res, req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		res = httptest.NewRecorder()
+		err = s.Consume(res, req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, 2, s.Outstanding())
+	})
+
+	t.Run("Identical nonce headers", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		err := s.Consume(res, request("first-nonce", "first-nonce"))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, http.StatusOK, consume(s, "second-nonce"))
+	})
+
+	t.Run("Nonce headers ignored by the extractor", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(WithTTL(time.Minute),
+			WithExtractor(func(r *http.Request) string {
+				return r.URL.Query().Get("nonce")
+			}))
+		err := s.Seed("a-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		req := request("first-nonce", "second-nonce")
+		req.URL.RawQuery = "nonce=a-nonce"
+		res := httptest.NewRecorder()
+		err = s.Consume(res, req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+}
+
+func TestWriterFreeChecks(t *testing.T) {
+	s := NewDummyInMemoryNonceService(WithTTL(time.Minute))
+	err := s.Seed("a-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+	request := func(nonces ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		for _, nonce := range nonces {
+			req.Header.Add(NonceHeader, nonce)
+		}
+		return req
+	}
+
+	t.Run("Check provided", func(t *testing.T) {
+		assert.NoError(t, s.CheckProvided(request("a-nonce")))
+		assert.ErrorIs(t, s.CheckProvided(request()), ErrNonceNotProvided)
+		assert.ErrorIs(t, s.CheckProvided(request("a-nonce", "b-nonce")),
+			ErrConflictingNonces)
+	})
+
+	t.Run("Try consume", func(t *testing.T) {
+		ok, err := s.TryConsume(request("a-nonce", "b-nonce"))
+		assert.ErrorIs(t, err, ErrConflictingNonces)
+		assert.False(t, ok)
+		ok, err = s.TryConsume(request("a-nonce"))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, ok)
+		ok, err = s.TryConsume(request("a-nonce"))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.False(t, ok)
+		ok, err = s.TryConsume(request())
+		if err != nil {
+			t.Error(err)
+		}
+		assert.False(t, ok)
+	})
+}
+
+func TestEvents(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+
+	t.Run("Issue then consume", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(WithEvents(4),
+			WithTTL(time.Minute))
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+		assert.Equal(t, http.StatusForbidden, consume(s, nonce))
+		types := []NonceEventType{}
+		for i := 0; i < 3; i++ {
+			e := <-s.Events()
+			assert.Equal(t, nonce, e.Nonce)
+			types = append(types, e.Type)
+		}
+		assert.Equal(t, []NonceEventType{EventIssued, EventConsumed,
+			EventRejected}, types)
+	})
+
+	t.Run("Evict the oldest nonce", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(WithEvents(4),
+			WithTTL(time.Minute), WithMaxOutstanding(1, EvictOldest))
+		first, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, EventIssued, (<-s.Events()).Type)
+		e := <-s.Events()
+		assert.Equal(t, EventEvicted, e.Type)
+		assert.Equal(t, first, e.Nonce)
+	})
+
+	t.Run("Expire a tenant nonce", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		s := NewDummyInMemoryNonceService(WithEvents(4), WithClock(clock),
+			WithTTL(time.Minute), WithTenant(func(r *http.Request) string {
+				return r.Header.Get("Tenant")
+			}))
+		tenantReq := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+		tenantReq.Header.Set("Tenant", "tenant-a")
+		nonce, err := s.GetNonce(tenantReq)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+		_, err = s.GetNonce(tenantReq)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, EventIssued, (<-s.Events()).Type)
+		e := <-s.Events()
+		assert.Equal(t, EventExpired, e.Type)
+		assert.Equal(t, nonce, e.Nonce)
+	})
+
+	t.Run("Drop events when full", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService(WithEvents(1),
+			WithTTL(time.Minute))
+		for i := 0; i < 3; i++ {
+			_, err := s.GetNonce(req)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		assert.Equal(t, uint64(2), s.Stats().DroppedEvents)
+		assert.Equal(t, EventIssued, (<-s.Events()).Type)
+	})
+
+	t.Run("No events by default", func(t *testing.T) {
+		s := NewDummyInMemoryNonceService()
+		assert.Nil(t, s.Events())
+	})
+}
+
+func TestGetBoundNonce(t *testing.T) {
+	s := NewDummyInMemoryNonceService(WithTTL(time.Minute))
+	req := httptest.NewRequest(http.MethodPost, "/new-nonce", nil)
+
+	t.Run("Challenge held until consumed", func(t *testing.T) {
+		nonce, err := s.GetBoundNonce(req, []byte(`{"identity":"peasant"}`))
+		if err != nil {
+			t.Error(err)
+		}
+		nonced := httptest.NewRequest(http.MethodPost, "/do-something", nil)
+		nonced.Header.Set(NonceHeader, nonce)
+		challenge, ok := s.Challenge(nonced)
+		assert.True(t, ok)
+		assert.Equal(t, `{"identity":"peasant"}`, string(challenge))
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+		_, ok = s.Challenge(nonced)
+		assert.False(t, ok)
+	})
+
+	t.Run("Empty challenge", func(t *testing.T) {
+		_, err := s.GetBoundNonce(req, nil)
+		assert.EqualError(t, err, "can't bind a nonce to an empty challenge")
+	})
+}
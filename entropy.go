@@ -0,0 +1,101 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// EntropyNonceService decorates a NonceService checking that every generated
+// nonce has at least MinLength characters and an estimated entropy of at
+// least MinEntropy bits. A nonce failing the check is never issued, GetNonce
+// returns an error instead.
+//
+// The entropy is estimated as the Shannon entropy of the nonce characters
+// times its length, which is an upper bound for the real entropy. It catches
+// broken generators, like constant or repeating output, not subtle bias.
+type EntropyNonceService struct {
+	NonceService
+	// MinEntropy is the minimum estimated entropy in bits.
+	MinEntropy float64
+	// MinLength is the minimum nonce length.
+	MinLength int
+}
+
+// NewEntropyNonceService initializes a new EntropyNonceService wrapping the
+// given service with the given thresholds.
+func NewEntropyNonceService(s NonceService, minLength int,
+	minEntropy float64) *EntropyNonceService {
+	return &EntropyNonceService{
+		NonceService: s,
+		MinEntropy:   minEntropy,
+		MinLength:    minLength,
+	}
+}
+
+// GetNonce generates a nonce with the wrapped service and returns an error if
+// it doesn't meet the thresholds. A rejected nonce is cleared from the wrapped
+// service, so it can't be consumed.
+func (s *EntropyNonceService) GetNonce(r *http.Request) (string, error) {
+	nonce, err := s.NonceService.GetNonce(r)
+	if err != nil {
+		return "", err
+	}
+	err = s.check(nonce)
+	if err != nil {
+		cerr := s.NonceService.Clear(nonce)
+		if cerr != nil {
+			return "", fmt.Errorf("%w: %w", err, cerr)
+		}
+		return "", err
+	}
+	return nonce, nil
+}
+
+// check returns an error if the nonce doesn't meet the thresholds.
+func (s *EntropyNonceService) check(nonce string) error {
+	if len(nonce) < s.MinLength {
+		return fmt.Errorf("the generated nonce has %d characters, "+
+			"at least %d are required", len(nonce), s.MinLength)
+	}
+	entropy := EstimateEntropy(nonce)
+	if entropy < s.MinEntropy {
+		return fmt.Errorf("the generated nonce has %.1f bits of "+
+			"entropy, at least %.1f are required", entropy, s.MinEntropy)
+	}
+	return nil
+}
+
+// EstimateEntropy returns the Shannon entropy of the characters of s, in bits,
+// times the length of s.
+func EstimateEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := map[rune]int{}
+	n := 0
+	for _, c := range s {
+		counts[c]++
+		n++
+	}
+	perChar := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		perChar -= p * math.Log2(p)
+	}
+	return perChar * float64(n)
+}
@@ -0,0 +1,95 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+type FixedNonceService struct {
+	*dummy.DummyInMemoryNonceService
+	nonce string
+}
+
+func (s *FixedNonceService) GetNonce(r *http.Request) (string, error) {
+	err := s.Seed(s.nonce)
+	if err != nil {
+		return "", err
+	}
+	return s.nonce, nil
+}
+
+func TestEntropyNonceService(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+	fixed := func(nonce string) *EntropyNonceService {
+		return NewEntropyNonceService(&FixedNonceService{
+			DummyInMemoryNonceService: dummy.NewDummyInMemoryNonceService(),
+			nonce:                     nonce,
+		}, 16, 64)
+	}
+
+	t.Run("Strong nonce", func(t *testing.T) {
+		s := NewEntropyNonceService(dummy.NewDummyInMemoryNonceService(), 16,
+			64)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Len(t, nonce, 32)
+	})
+
+	t.Run("Too short nonce", func(t *testing.T) {
+		_, err := fixed("short").GetNonce(req)
+		assert.EqualError(t, err,
+			"the generated nonce has 5 characters, at least 16 are required")
+	})
+
+	t.Run("Low entropy nonce", func(t *testing.T) {
+		_, err := fixed("abababababababababababababababab").GetNonce(req)
+		assert.EqualError(t, err, "the generated nonce has 32.0 bits of "+
+			"entropy, at least 64.0 are required")
+	})
+
+	t.Run("Rejected nonce can't be consumed", func(t *testing.T) {
+		s := fixed("abababababababababababababababab")
+		_, err := s.GetNonce(req)
+		assert.Error(t, err)
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+		req.Header.Set(DefaultNonceHeader, "abababababababababababababababab")
+		err = s.Consume(res, req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Rejected nonce isn't issued by the chain", func(t *testing.T) {
+		s := fixed("short")
+		s.NonceService.(*FixedNonceService).Seed("a-nonce")
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+		req.Header.Set(DefaultNonceHeader, "a-nonce")
+		NoncedHandlerFunc(s, func(w http.ResponseWriter, r *http.Request) {})(
+			res, req)
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+		assert.Empty(t, res.Header().Get(DefaultNonceHeader))
+	})
+}
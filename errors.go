@@ -0,0 +1,98 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrBastionUnreachable is wrapped by the errors of requests that didn't
+	// get a response from the bastion, like connection failures.
+	ErrBastionUnreachable = errors.New("the bastion is unreachable")
+	// ErrCircuitOpen is returned by a CircuitBreakerTransport failing fast
+	// while its circuit is open.
+	ErrCircuitOpen = errors.New("the circuit is open")
+	// ErrDirectoryKeyNotFound is returned when an endpoint key isn't found in
+	// the directory.
+	ErrDirectoryKeyNotFound = errors.New(
+		"the transport wasn't able to find the directory key")
+	// ErrInvalidNonce is wrapped by the errors of nonces failing the
+	// transport NonceValidator.
+	ErrInvalidNonce = errors.New("the nonce failed validation")
+	// ErrNoShards is returned by a ShardedNonceService without shards.
+	ErrNoShards = errors.New("the sharded nonce service has no shards")
+	// ErrNonceKeyNotFound is returned when none of the directory keys for the
+	// new nonce URL is found in the directory.
+	ErrNonceKeyNotFound = errors.New(
+		"the transport wasn't able to find the nonce key")
+	// ErrNoNonceReturned is returned when a successful new nonce response
+	// carries no nonce.
+	ErrNoNonceReturned = errors.New("server returned no nonce")
+	// ErrTransportCast is returned when a provider is given a Transport that
+	// isn't an HttpTransport.
+	ErrTransportCast = errors.New(
+		"was not able to cast Transport to HttpTransport")
+)
+
+// StatusError is returned when a bastion answers with an unsuccessful status.
+type StatusError struct {
+	// RetryAfter is how long the bastion asked to wait before retrying,
+	// parsed from the Retry-After header, or zero if it wasn't sent.
+	RetryAfter time.Duration
+	// Status is the response status line, like "403 Forbidden".
+	Status string
+	// StatusCode is the response status code.
+	StatusCode int
+}
+
+func newStatusError(res *http.Response) *StatusError {
+	return &StatusError{
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		Status:     res.Status,
+		StatusCode: res.StatusCode,
+	}
+}
+
+// parseRetryAfter parses a Retry-After value, either delay seconds or an HTTP
+// date. Invalid values and dates in the past return zero.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(v)
+	if err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(v)
+	if err != nil {
+		return 0
+	}
+	d := time.Until(date)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
@@ -0,0 +1,106 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/empty/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	handler.HandleFunc("/seconds/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+	handler.HandleFunc("/date/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After",
+				time.Now().Add(2*time.Minute).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+	handler.HandleFunc("/forbidden/nonce/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	t.Run("Nonce key not found", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithDirectoryKeys("missing"))
+		_, err := ht.NewNonce()
+		assert.True(t, errors.Is(err, ErrNonceKeyNotFound))
+	})
+
+	t.Run("No nonce returned", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL+"/empty", DefaultNonceHeader)
+		_, err := ht.NewNonce()
+		assert.True(t, errors.Is(err, ErrNoNonceReturned))
+	})
+
+	t.Run("Transport cast", func(t *testing.T) {
+		err := NewHttpDirectoryProvider(server.URL).SetTransport(
+			NewWebSocketTransport("ws://bastion/nonces", nil))
+		assert.True(t, errors.Is(err, ErrTransportCast))
+		_, err = NewHTTPPeasant(server.URL,
+			WithDirectoryProvider(NewDNSDirectoryProvider("bastion", 0)),
+			func(ht *HttpTransport) error {
+				return ht.DirectoryProvider.SetTransport(NewPeasant(ht))
+			})
+		assert.True(t, errors.Is(err, ErrTransportCast))
+	})
+
+	t.Run("Unsuccessful status", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL+"/forbidden",
+			DefaultNonceHeader)
+		_, err := ht.NewNonce()
+		statusErr := &StatusError{}
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+		assert.Equal(t, time.Duration(0), statusErr.RetryAfter)
+		assert.EqualError(t, err, "403 Forbidden")
+	})
+
+	t.Run("Retry-After in seconds", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL+"/seconds",
+			DefaultNonceHeader)
+		_, err := ht.NewNonce()
+		statusErr := &StatusError{}
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusTooManyRequests, statusErr.StatusCode)
+		assert.Equal(t, 2*time.Minute, statusErr.RetryAfter)
+	})
+
+	t.Run("Retry-After as an HTTP date", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL+"/date", DefaultNonceHeader)
+		_, err := ht.NewNonce()
+		statusErr := &StatusError{}
+		assert.True(t, errors.As(err, &statusErr))
+		// HTTP dates have a one second resolution.
+		assert.InDelta(t, float64(2*time.Minute),
+			float64(statusErr.RetryAfter), float64(2*time.Second))
+	})
+}
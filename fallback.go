@@ -0,0 +1,146 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+)
+
+// FallbackNonceService chains a primary NonceService, like one backed by
+// Redis, with a Fallback one, like an in-memory service, used while the
+// primary is unavailable.
+//
+// Only errors returned by the primary, meaning its store failed, make a call
+// fall back. A nonce rejected by the primary, answered with a status like
+// 403, is a legitimate rejection and is never retried with the fallback, so
+// invalid nonces aren't accepted during a degradation. Nonces issued by one
+// service are unknown to the other, so they are rejected if the primary
+// becomes unavailable, or recovers, before they are consumed.
+type FallbackNonceService struct {
+	// Fallback is used when the primary returns an error.
+	Fallback NonceService
+	// Logger logs the degradations. If nil the standard logger is used.
+	Logger *log.Logger
+	// Primary is the service used while it doesn't return errors.
+	Primary NonceService
+}
+
+// NewFallbackNonceService initializes a new FallbackNonceService using the
+// fallback service when the primary fails.
+func NewFallbackNonceService(primary,
+	fallback NonceService) *FallbackNonceService {
+	return &FallbackNonceService{
+		Fallback: fallback,
+		Primary:  primary,
+	}
+}
+
+// Block blocks the request with the primary, or the fallback if the primary
+// fails.
+func (s *FallbackNonceService) Block(w http.ResponseWriter,
+	r *http.Request) error {
+	return s.held(w, "block", s.Primary.Block, s.Fallback.Block, r)
+}
+
+// Clear clears the nonce in the primary, or the fallback if the primary
+// fails.
+func (s *FallbackNonceService) Clear(nonce string) error {
+	err := s.Primary.Clear(nonce)
+	if err == nil {
+		return nil
+	}
+	s.degraded("clear", err)
+	return s.Fallback.Clear(nonce)
+}
+
+// Consume consumes the nonce with the primary, or the fallback if the primary
+// fails. A nonce rejected by the primary isn't tried with the fallback.
+func (s *FallbackNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	return s.held(w, "consume", s.Primary.Consume, s.Fallback.Consume, r)
+}
+
+// GetNonce issues a nonce with the primary, or the fallback if the primary
+// fails.
+func (s *FallbackNonceService) GetNonce(r *http.Request) (string, error) {
+	nonce, err := s.Primary.GetNonce(r)
+	if err == nil {
+		return nonce, nil
+	}
+	s.degraded("get nonce", err)
+	return s.Fallback.GetNonce(r)
+}
+
+// Provided checks the nonce is provided with the primary, or the fallback if
+// the primary fails.
+func (s *FallbackNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	return s.held(w, "provided", s.Primary.Provided, s.Fallback.Provided, r)
+}
+
+// Skip reports if the request should not be nonced according to the primary.
+func (s *FallbackNonceService) Skip(r *http.Request) bool {
+	return s.Primary.Skip(r)
+}
+
+func (s *FallbackNonceService) degraded(op string, err error) {
+	logf(s.Logger, "peasant: the primary nonce service failed to %s, "+
+		"falling back: %v", op, err)
+}
+
+// held calls the primary holding its response, which is written only if it
+// doesn't fail. If it fails the fallback is called with the response writer.
+func (s *FallbackNonceService) held(w http.ResponseWriter, op string,
+	primary, fallback func(http.ResponseWriter, *http.Request) error,
+	r *http.Request) error {
+	hw := &heldWriter{ResponseWriter: w}
+	err := primary(hw, r)
+	if err == nil {
+		hw.release()
+		return nil
+	}
+	s.degraded(op, err)
+	return fallback(w, r)
+}
+
+// heldWriter holds the status and body written to it until released, so they
+// can be discarded. Headers are set in the wrapped ResponseWriter.
+type heldWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+	code int
+}
+
+func (w *heldWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *heldWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// release writes the held status and body to the wrapped ResponseWriter.
+func (w *heldWriter) release() {
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	if w.body.Len() > 0 {
+		w.ResponseWriter.Write(w.body.Bytes())
+	}
+}
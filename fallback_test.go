@@ -0,0 +1,102 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbackNonceService(t *testing.T) {
+	primary := &FailingNonceService{
+		DummyInMemoryNonceService: dummy.NewDummyInMemoryNonceService(
+			dummy.WithTTL(time.Minute)),
+	}
+	fallback := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	s := NewFallbackNonceService(primary, fallback)
+	var logs bytes.Buffer
+	s.Logger = log.New(&logs, "", 0)
+	consume := func(nonce string) int {
+		req := httptest.NewRequest(http.MethodPost, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		res := httptest.NewRecorder()
+		err := s.Consume(res, req)
+		if err != nil {
+			t.Error(err)
+		}
+		return res.Code
+	}
+	newNonce := func() string {
+		nonce, err := s.GetNonce(httptest.NewRequest(http.MethodHead,
+			"/new-nonce", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		return nonce
+	}
+	err := fallback.Seed("fallback-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Run("Primary serves while available", func(t *testing.T) {
+		nonce := newNonce()
+		assert.Equal(t, 1, primary.Outstanding())
+		assert.Equal(t, http.StatusOK, consume(nonce))
+		assert.Equal(t, http.StatusForbidden, consume(nonce))
+		assert.Equal(t, http.StatusForbidden, consume("fallback-nonce"))
+		assert.Equal(t, 1, fallback.Outstanding())
+		assert.Empty(t, logs.String())
+	})
+
+	t.Run("Fallback serves while primary fails", func(t *testing.T) {
+		primaryNonce := newNonce()
+		primary.stage = StageGetNonce
+		nonce := newNonce()
+		assert.Equal(t, 2, fallback.Outstanding())
+		primary.stage = StageConsume
+		assert.Equal(t, http.StatusOK, consume(nonce))
+		assert.Equal(t, http.StatusForbidden, consume(nonce))
+		assert.Equal(t, http.StatusForbidden, consume("invalid-nonce"))
+		assert.Equal(t, http.StatusForbidden, consume(primaryNonce))
+		assert.Contains(t, logs.String(), "peasant: the primary nonce "+
+			"service failed to consume, falling back: consume failed")
+	})
+
+	t.Run("Primary rejection isn't retried", func(t *testing.T) {
+		primary.stage = ""
+		assert.Equal(t, http.StatusForbidden, consume("fallback-nonce"))
+		assert.Equal(t, 1, fallback.Outstanding())
+	})
+
+	t.Run("Provided falls back", func(t *testing.T) {
+		primary.stage = StageProvided
+		res := httptest.NewRecorder()
+		err := s.Provided(res, httptest.NewRequest(http.MethodPost,
+			"/do-nonced-something", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+}
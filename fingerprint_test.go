@@ -0,0 +1,78 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	fingerprint := func(method, url, body string) string {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		fp, err := RequestFingerprint(req)
+		if err != nil {
+			t.Error(err)
+		}
+		return fp
+	}
+
+	t.Run("Identical requests hash equal", func(t *testing.T) {
+		assert.Equal(t,
+			fingerprint(http.MethodPost, "http://bastion/orders?a=1&b=2",
+				`{"id":1}`),
+			fingerprint(http.MethodPost, "http://BASTION/orders?b=2&a=1",
+				`{"id":1}`))
+	})
+
+	t.Run("Differing requests hash differently", func(t *testing.T) {
+		fp := fingerprint(http.MethodPost, "http://bastion/orders",
+			`{"id":1}`)
+		assert.NotEqual(t, fp, fingerprint(http.MethodPost,
+			"http://bastion/orders", `{"id":2}`))
+		assert.NotEqual(t, fp, fingerprint(http.MethodPut,
+			"http://bastion/orders", `{"id":1}`))
+		assert.NotEqual(t, fp, fingerprint(http.MethodPost,
+			"http://bastion/accounts", `{"id":1}`))
+	})
+
+	t.Run("Body readable after fingerprinting", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "http://bastion/orders",
+			strings.NewReader(`{"id":1}`))
+		_, err := RequestFingerprint(req)
+		if err != nil {
+			t.Error(err)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, `{"id":1}`, string(body))
+		rc, err := req.GetBody()
+		if err != nil {
+			t.Error(err)
+		}
+		body, err = io.ReadAll(rc)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, `{"id":1}`, string(body))
+	})
+}
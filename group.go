@@ -0,0 +1,111 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// PeasantGroup holds named Peasants, one per bastion, routing each operation
+// to the bastion chosen by name. Each Peasant keeps its own transport,
+// directory and nonce pool. It is safe for concurrent use.
+type PeasantGroup struct {
+	mu       sync.RWMutex
+	peasants map[string]*Peasant
+}
+
+// NewPeasantGroup initializes a new empty PeasantGroup.
+func NewPeasantGroup() *PeasantGroup {
+	return &PeasantGroup{
+		peasants: make(map[string]*Peasant),
+	}
+}
+
+// Add adds the Peasant under the given bastion name, replacing any Peasant
+// already added under it.
+func (g *PeasantGroup) Add(bastion string, p *Peasant) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.peasants[bastion] = p
+}
+
+// Get returns the Peasant added under the given bastion name.
+func (g *PeasantGroup) Get(bastion string) (*Peasant, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	p, ok := g.peasants[bastion]
+	if !ok {
+		return nil, errors.New("unknown bastion " + bastion)
+	}
+	return p, nil
+}
+
+// Names returns the sorted bastion names of the group.
+func (g *PeasantGroup) Names() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	names := make([]string, 0, len(g.peasants))
+	for name := range g.peasants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewNonce generates a new nonce from the given bastion.
+func (g *PeasantGroup) NewNonce(bastion string) (string, error) {
+	p, err := g.Get(bastion)
+	if err != nil {
+		return "", err
+	}
+	return p.NewNonce()
+}
+
+// Do sends the request to the given bastion with a fresh nonce from it,
+// placed by the transport NonceInjector. The request goes through the
+// transport interceptors and retries, and the nonce of the response is
+// harvested into its Pool, like the ones sent by NoncedDo. The bastion
+// Peasant must be backed by an HttpTransport, otherwise ErrTransportCast is
+// returned.
+func (g *PeasantGroup) Do(bastion string,
+	req *http.Request) (*http.Response, error) {
+	p, err := g.Get(bastion)
+	if err != nil {
+		return nil, err
+	}
+	ht, ok := p.Transport.(*HttpTransport)
+	if !ok {
+		return nil, fmt.Errorf("bastion %s: %w", bastion, ErrTransportCast)
+	}
+	return ht.sendNonced(req.Context(), req, "")
+}
+
+// Close closes every Peasant in the group, returning the first error.
+func (g *PeasantGroup) Close() error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var first error
+	for _, p := range g.peasants {
+		err := p.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
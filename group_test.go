@@ -0,0 +1,152 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeasantGroup(t *testing.T) {
+	east := NewServer(t)
+	defer east.Close()
+	west := NewServer(t)
+	defer west.Close()
+
+	g := NewPeasantGroup()
+	defer g.Close()
+	for name, server := range map[string]string{
+		"east": east.URL,
+		"west": west.URL,
+	} {
+		p, err := NewHTTPPeasant(server + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Add(name, p)
+	}
+	assert.Equal(t, []string{"east", "west"}, g.Names())
+
+	doSomething := func(bastion, url, nonce string) int {
+		req, err := http.NewRequest(http.MethodGet,
+			url+"/nonce/do-nonced-something", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(DefaultNonceHeader, nonce)
+		p, _ := g.Get(bastion)
+		res, err := p.Transport.(*HttpTransport).Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("Nonces are isolated per bastion", func(t *testing.T) {
+		nonce, err := g.NewNonce("east")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden,
+			doSomething("west", west.URL, nonce))
+
+		nonce, err = g.NewNonce("east")
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, doSomething("east", east.URL, nonce))
+	})
+
+	t.Run("Do routes to the bastion", func(t *testing.T) {
+		for name, url := range map[string]string{
+			"east": east.URL,
+			"west": west.URL,
+		} {
+			req, err := http.NewRequest(http.MethodGet,
+				url+"/nonce/do-nonced-something", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := g.Do(name, req)
+			if err != nil {
+				t.Error(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+		}
+	})
+
+	t.Run("Do places the nonce with the injector", func(t *testing.T) {
+		s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute),
+			dummy.WithExtractor(NonceFromQuery("nonce")))
+		h := http.NewServeMux()
+		h.HandleFunc("/new-nonce", NewNonceHandler(s).GetNonce)
+		h.HandleFunc("/do-nonced-something", NoncedHandlerFunc(s,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("done"))
+			}))
+		server := httptest.NewServer(h)
+		defer server.Close()
+		intercepted := 0
+		pool := NewNoncePool()
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithNonceInjector(NonceInQuery("nonce")),
+			WithInterceptors(func(r *http.Request) error {
+				intercepted++
+				return nil
+			}),
+			WithDirectoryProvider(NewMemoryDirectoryProvider(
+				map[string]interface{}{
+					"newNonce": server.URL + "/new-nonce",
+				})))
+		ht.Pool = pool
+		g.Add("north", NewPeasant(ht))
+		req, err := http.NewRequest(http.MethodGet,
+			server.URL+"/do-nonced-something", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := g.Do("north", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, 2, intercepted)
+		assert.Equal(t, 1, pool.Len())
+		assert.Equal(t, "", req.URL.RawQuery)
+	})
+
+	t.Run("Do requires an HttpTransport", func(t *testing.T) {
+		g := NewPeasantGroup()
+		g.Add("west", NewPeasant(&SwitchTransport{}))
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		_, err := g.Do("west", req)
+		assert.True(t, errors.Is(err, ErrTransportCast))
+	})
+
+	t.Run("Unknown bastion", func(t *testing.T) {
+		_, err := g.NewNonce("south")
+		assert.EqualError(t, err, "unknown bastion south")
+	})
+}
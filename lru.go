@@ -0,0 +1,208 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const lruNonceSize = 24
+
+// LRUNonceService implements the NonceService interface keeping the
+// outstanding nonces in a least recently used cache with a TTL. Memory is
+// bounded by Capacity, as the least recently used nonce is evicted to make
+// room for a new one, and nonces expire after the TTL without a sweeper, as
+// expired entries are dropped when found. It also satisfies NonceStore, so it
+// can be used as a shard of a ShardedNonceService.
+type LRUNonceService struct {
+	// Capacity is the maximum number of outstanding nonces.
+	Capacity int
+	// Clock provides the time used to check expiries.
+	Clock Clock
+	// Extractor reads the nonce from the request. If nil the nonce is read
+	// from the HeaderKey header.
+	Extractor NonceExtractor
+	// HeaderKey is the header the nonce is read from.
+	HeaderKey string
+	// SkipFunc reports if a request should not be nonced. If nil no request
+	// is skipped.
+	SkipFunc func(*http.Request) bool
+	// TTL is how long a nonce is valid after being issued.
+	TTL time.Duration
+
+	entries map[string]*list.Element
+	// recency keeps the nonces ordered from the least to the most recently
+	// used.
+	recency *list.List
+	mu      sync.Mutex
+}
+
+// lruEntry is an outstanding nonce and its expiry.
+type lruEntry struct {
+	nonce  string
+	expiry time.Time
+}
+
+// NewLRUNonceService initializes a new LRUNonceService holding up to capacity
+// nonces, valid for the given ttl.
+func NewLRUNonceService(capacity int, ttl time.Duration) *LRUNonceService {
+	return &LRUNonceService{
+		Capacity:  capacity,
+		Clock:     systemClock{},
+		HeaderKey: DefaultNonceHeader,
+		TTL:       ttl,
+		entries:   make(map[string]*list.Element),
+		recency:   list.New(),
+	}
+}
+
+func (s *LRUNonceService) Block(w http.ResponseWriter,
+	r *http.Request) error {
+	return nil
+}
+
+// Clear removes the nonce.
+func (s *LRUNonceService) Clear(nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(nonce)
+	return nil
+}
+
+// Consume removes the nonce if present in a single step, so it can't be
+// consumed twice. Missing, unknown and expired nonces are rejected with
+// a forbidden status.
+func (s *LRUNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	ok, err := s.Take(s.nonce(r))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return nil
+}
+
+// GetNonce generates and stores a new nonce.
+func (s *LRUNonceService) GetNonce(r *http.Request) (string, error) {
+	b := make([]byte, lruNonceSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	err = s.Put(nonce)
+	if err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// Len returns the number of nonces held, including expired ones not dropped
+// yet.
+func (s *LRUNonceService) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recency.Len()
+}
+
+// Provided checks the request carries a nonce, otherwise the response status
+// is set to forbidden.
+func (s *LRUNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	if s.nonce(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return nil
+}
+
+// Put stores the nonce as valid for the TTL, evicting the least recently
+// used nonces above Capacity.
+func (s *LRUNonceService) Put(nonce string) error {
+	expiry := s.Clock.Now().Add(s.TTL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(nonce)
+	s.entries[nonce] = s.recency.PushBack(&lruEntry{
+		nonce:  nonce,
+		expiry: expiry,
+	})
+	for s.Capacity > 0 && s.recency.Len() > s.Capacity {
+		s.remove(s.recency.Front().Value.(*lruEntry).nonce)
+	}
+	return nil
+}
+
+// Skip reports if the request should not be nonced according to SkipFunc.
+func (s *LRUNonceService) Skip(r *http.Request) bool {
+	if s.SkipFunc == nil {
+		return false
+	}
+	return s.SkipFunc(r)
+}
+
+// Take removes the nonce, reporting if it was held and not expired.
+func (s *LRUNonceService) Take(nonce string) (bool, error) {
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.remove(nonce)
+	return ok && now.Before(e.expiry), nil
+}
+
+// Verify reports if the nonce provided in the request is held and not
+// expired, without consuming it. A verified nonce becomes the most recently
+// used, and an expired one is dropped.
+func (s *LRUNonceService) Verify(r *http.Request) (bool, error) {
+	nonce := s.nonce(r)
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[nonce]
+	if !ok {
+		return false, nil
+	}
+	if !now.Before(e.Value.(*lruEntry).expiry) {
+		s.remove(nonce)
+		return false, nil
+	}
+	s.recency.MoveToBack(e)
+	return true, nil
+}
+
+func (s *LRUNonceService) nonce(r *http.Request) string {
+	if s.Extractor != nil {
+		return s.Extractor(r)
+	}
+	return r.Header.Get(s.HeaderKey)
+}
+
+// remove removes the nonce returning its entry and if it was held. It must
+// be called with the mutex held.
+func (s *LRUNonceService) remove(nonce string) (*lruEntry, bool) {
+	e, ok := s.entries[nonce]
+	if !ok {
+		return nil, false
+	}
+	delete(s.entries, nonce)
+	s.recency.Remove(e)
+	return e.Value.(*lruEntry), true
+}
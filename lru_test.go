@@ -0,0 +1,104 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUNonceService(t *testing.T) {
+	get := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+	request := func(nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		return req
+	}
+	consume := func(s *LRUNonceService, nonce string) int {
+		res := httptest.NewRecorder()
+		err := s.Consume(res, request(nonce))
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		return res.Code
+	}
+
+	t.Run("Consume once", func(t *testing.T) {
+		s := NewLRUNonceService(10, time.Minute)
+		nonce, err := s.GetNonce(get)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+		assert.Equal(t, http.StatusForbidden, consume(s, nonce))
+		assert.Equal(t, http.StatusForbidden, consume(s, ""))
+		assert.Equal(t, 0, s.Len())
+	})
+
+	t.Run("Evict under capacity pressure", func(t *testing.T) {
+		s := NewLRUNonceService(2, time.Minute)
+		nonces := []string{}
+		for i := 0; i < 2; i++ {
+			nonce, err := s.GetNonce(get)
+			if err != nil {
+				t.Error(err)
+			}
+			nonces = append(nonces, nonce)
+		}
+		// Verifying the oldest nonce makes it the most recently used.
+		valid, err := s.Verify(request(nonces[0]))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, valid)
+		nonce, err := s.GetNonce(get)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 2, s.Len())
+		assert.Equal(t, http.StatusForbidden, consume(s, nonces[1]))
+		assert.Equal(t, http.StatusOK, consume(s, nonces[0]))
+		assert.Equal(t, http.StatusOK, consume(s, nonce))
+	})
+
+	t.Run("Expire after the TTL", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewLRUNonceService(10, time.Minute)
+		s.Clock = clock
+		nonces := []string{}
+		for i := 0; i < 2; i++ {
+			nonce, err := s.GetNonce(get)
+			if err != nil {
+				t.Error(err)
+			}
+			nonces = append(nonces, nonce)
+		}
+		clock.Advance(time.Minute)
+		valid, err := s.Verify(request(nonces[0]))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.False(t, valid)
+		assert.Equal(t, 1, s.Len())
+		assert.Equal(t, http.StatusForbidden, consume(s, nonces[1]))
+		assert.Equal(t, 0, s.Len())
+	})
+}
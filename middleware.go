@@ -15,13 +15,29 @@
 package peasant
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// DefaultRequestIDHeader is the header used by RequestID when no header is
+// given.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// requestIDKey is the context key the request ID is stored under.
+type requestIDKey struct{}
+
+// nonceServiceKey is the context key the nonce service is stored under.
+type nonceServiceKey struct{}
+
 // Nonced is a middleware that verifies the presence of a valid nonce in a
 // request.
 // If the nonce is not provided or is invalid, it prevents the request from
-// proceeding.
+// proceeding. Use NonceMiddleware to configure the chain.
 func Nonced(next http.Handler, s NonceService) http.Handler {
 	return http.HandlerFunc(NoncedHandlerFunc(s,
 		func(w http.ResponseWriter, r *http.Request) {
@@ -29,3 +45,211 @@ func Nonced(next http.Handler, s NonceService) http.Handler {
 		}),
 	)
 }
+
+// NonceMiddleware returns a middleware protecting handlers with the nonce
+// chain of NoncedHandlerFunc, configured by the given options: the issued
+// nonce header with WithNonceHeader, the reject status with WithRejectStatus,
+// the logger with WithLogger, the skip strategy with WithSkip, the error
+// handler with WithErrorHandler and the issue policy with WithIssuePolicy.
+// It is the recommended way to protect handlers.
+func NonceMiddleware(s NonceService,
+	opts ...NonceOption) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(NoncedHandlerFunc(s, next.ServeHTTP,
+			opts...))
+	}
+}
+
+// NonceServed is a middleware storing the nonce service in the request
+// context, so handlers down the chain can reach it. The service can be
+// retrieved from the context with NonceServiceFromContext.
+func NonceServed(next http.Handler, s NonceService) http.Handler {
+	return NonceServedWithKey(next, s, nil)
+}
+
+// NonceServedWithKey works like NonceServed, also storing the service under
+// the given key, for handlers still looking it up by a key of their own. A nil
+// key stores the service only under the typed key.
+func NonceServedWithKey(next http.Handler, s NonceService,
+	key any) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), nonceServiceKey{}, s)
+		if key != nil {
+			ctx = context.WithValue(ctx, key, s)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NonceServiceFromContext returns the nonce service stored in the context by
+// the NonceServed middleware and if it was found.
+func NonceServiceFromContext(ctx context.Context) (NonceService, bool) {
+	s, ok := ctx.Value(nonceServiceKey{}).(NonceService)
+	return s, ok
+}
+
+// Chain composes the given middlewares into one. The first middleware is the
+// outermost, so it sees the request first:
+//
+//	Chain(RateLimiting, WithNonce(s))(h)
+//
+// is the same as RateLimiting(WithNonce(s)(h)).
+func Chain(middlewares ...func(http.Handler) http.Handler,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// WithNonce returns a middleware protecting the handler with Nonced, wrapped
+// by NonceServed so the service is in the request context by the time the
+// nonce chain and the handler run.
+func WithNonce(s NonceService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return NonceServed(Nonced(next, s), s)
+	}
+}
+
+// NonceEpoch is a middleware setting the NonceEpochHeader to the current
+// epoch in every response, so peasants flush their pooled nonces when the
+// epoch changes.
+func NonceEpoch(next http.Handler, epoch func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(NonceEpochHeader, epoch())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestID is a middleware that reads the request ID from the given header,
+// or generates one with gen if the header is missing, stores it in the request
+// context and echoes it in the response header. If header is empty
+// DefaultRequestIDHeader is used, and if gen is nil a random 128 bit hex ID is
+// generated.
+//
+// The ID can be retrieved from the context with RequestIDFromContext.
+func RequestID(next http.Handler, header string,
+	gen func() string) http.Handler {
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	if gen == nil {
+		gen = randomRequestID
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = gen()
+		}
+		w.Header().Set(header, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext returns the request ID stored in the context by the
+// RequestID middleware, or an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func randomRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Limiter decides if a request may proceed. It is satisfied by
+// *golang.org/x/time/rate.Limiter.
+type Limiter interface {
+	Allow() bool
+}
+
+// MaxNonceAge is a middleware rejecting with 403 Forbidden the requests
+// carrying a nonce older than maxAge, even if it didn't expire from the
+// service yet, limiting the window a captured but unused nonce can be
+// replayed in. Skipped requests and unknown nonces are passed through to be
+// handled by the nonce chain.
+func MaxNonceAge(next http.Handler, s AgingNonceService,
+	maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Skip(r) {
+			age, ok := s.NonceAge(r)
+			if ok && age > maxAge {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimit is a middleware shedding load globally, answering with 429 Too
+// Many Requests when the limiter doesn't allow the request. Placed in front of
+// the nonce chain it protects the bastion regardless of nonce validity.
+func RateLimit(next http.Handler, l Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow() {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NormalizeNonceHeader is a middleware moving the nonce from the source
+// header, as rewritten by a proxy, to DefaultNonceHeader before the nonce
+// chain runs. The source header is removed, and if the nonce arrives with
+// duplicate values only the first non-empty one is kept. A nonce already set
+// in DefaultNonceHeader takes precedence over the source header.
+func NormalizeNonceHeader(next http.Handler, source string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		values := r.Header.Values(DefaultNonceHeader)
+		if source != "" {
+			values = append(values, r.Header.Values(source)...)
+			r.Header.Del(source)
+		}
+		r.Header.Del(DefaultNonceHeader)
+		for _, value := range values {
+			if value != "" {
+				r.Header.Set(DefaultNonceHeader, value)
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Decompress is a middleware decompressing the request bodies sent with
+// a gzip Content-Encoding, like the ones sent by a client using
+// WithRequestCompression, so the nonce chain and the handler read them
+// decompressed. Placed in front of the nonce chain, nonces carried in the body
+// are extracted from the decompressed body. Bodies that aren't valid gzip are
+// answered with 400 Bad Request, other encodings are passed through.
+func Decompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+		r = r.Clone(r.Context())
+		r.Body = body
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		next.ServeHTTP(w, r)
+	})
+}
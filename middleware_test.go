@@ -15,7 +15,13 @@
 package peasant
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -59,7 +65,8 @@ func TestNoncedServer(t *testing.T) {
 			nonce := res.Header.Get("nonce")
 
 			res, err = runner.WithPath(
-				"/do-nonced-something").WithHeader("nonce", nonce).Get()
+				"/do-nonced-something").WithHeader("nonce", nonce).
+				ClearHeaderAfter().Get()
 			if err != nil {
 				t.Error(err)
 			}
@@ -78,7 +85,8 @@ func TestNoncedServer(t *testing.T) {
 
 			time.Sleep(250 * time.Millisecond)
 			res, err = runner.WithPath(
-				"/do-nonced-something").WithHeader("nonce", nonce).Get()
+				"/do-nonced-something").WithHeader("nonce", nonce).
+				ClearHeaderAfter().Get()
 			if err != nil {
 				t.Error(err)
 			}
@@ -87,3 +95,358 @@ func TestNoncedServer(t *testing.T) {
 		})
 	})
 }
+
+func TestRequestID(t *testing.T) {
+	var fromContext string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fromContext = RequestIDFromContext(r.Context())
+	})
+
+	t.Run("Generate a request ID", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		RequestID(h, "", nil).ServeHTTP(res,
+			httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Len(t, fromContext, 32)
+		assert.Equal(t, fromContext, res.Header().Get(DefaultRequestIDHeader))
+	})
+
+	t.Run("Keep the provided request ID", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Trace-Id", "provided-id")
+		RequestID(h, "Trace-Id", func() string {
+			return "generated-id"
+		}).ServeHTTP(res, req)
+
+		assert.Equal(t, "provided-id", fromContext)
+		assert.Equal(t, "provided-id", res.Header().Get("Trace-Id"))
+	})
+
+	t.Run("Custom generator through the nonced chain", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+		RequestID(Nonced(h, dummy.NewDummyInMemoryNonceService()), "",
+			func() string {
+				return "generated-id"
+			}).ServeHTTP(res, req)
+
+		assert.Equal(t, "generated-id", fromContext)
+		assert.Equal(t, "generated-id",
+			res.Header().Get(DefaultRequestIDHeader))
+	})
+
+	t.Run("No request ID in the context", func(t *testing.T) {
+		assert.Empty(t, RequestIDFromContext(
+			httptest.NewRequest(http.MethodGet, "/", nil).Context()))
+	})
+}
+
+type legacyServiceKey string
+
+func TestNonceServed(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+
+	t.Run("Retrieve the service from the context", func(t *testing.T) {
+		var found NonceService
+		var ok bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			found, ok = NonceServiceFromContext(r.Context())
+		})
+		NonceServed(h, s).ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.True(t, ok)
+		assert.Equal(t, s, found)
+	})
+
+	t.Run("Store the service under a custom key", func(t *testing.T) {
+		var legacy any
+		var ok bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			legacy = r.Context().Value(legacyServiceKey("nonce-service"))
+			_, ok = NonceServiceFromContext(r.Context())
+		})
+		NonceServedWithKey(h, s, legacyServiceKey("nonce-service")).ServeHTTP(
+			httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.True(t, ok)
+		assert.Equal(t, s, legacy)
+	})
+
+	t.Run("No service in the context", func(t *testing.T) {
+		_, ok := NonceServiceFromContext(
+			httptest.NewRequest(http.MethodGet, "/", nil).Context())
+		assert.False(t, ok)
+	})
+}
+
+func TestNonceMiddleware(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	logs := &bytes.Buffer{}
+	h := NonceMiddleware(s,
+		WithNonceHeader("Replay-Nonce"),
+		WithRejectStatus(http.StatusBadRequest),
+		WithLogger(log.New(logs, "", 0)),
+		WithSkip(func(r *http.Request) bool {
+			return r.URL.Path == "/open"
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("done"))
+	}))
+	request := func(path, nonce string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if nonce != "" {
+			req.Header.Set(DefaultNonceHeader, nonce)
+		}
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Custom reject status", func(t *testing.T) {
+		res := request("/do-nonced-something", "")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		res = request("/do-nonced-something", "unknown-nonce")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("Custom header key", func(t *testing.T) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		res := request("/do-nonced-something", "seeded-nonce")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Len(t, res.Header().Get("Replay-Nonce"), 32)
+		assert.Empty(t, res.Header().Get(DefaultNonceHeader))
+	})
+
+	t.Run("Handler statuses untouched", func(t *testing.T) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		res := request("/forbidden", "seeded-nonce")
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Custom skip strategy", func(t *testing.T) {
+		res := request("/open", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Empty(t, logs.String())
+	})
+}
+
+func TestChain(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	order := []string{}
+	tag := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					order = append(order, name)
+					next.ServeHTTP(w, r)
+				})
+		}
+	}
+	var found NonceService
+	h := Chain(tag("first"), tag("second"), WithNonce(s))(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			found, _ = NonceServiceFromContext(r.Context())
+			w.Write([]byte("done"))
+		}))
+
+	t.Run("Enforce nonces", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodGet,
+			"/do-nonced-something", nil))
+		assert.Equal(t, http.StatusForbidden, res.Code)
+		assert.Nil(t, found)
+		assert.Equal(t, []string{"first", "second"}, order)
+	})
+
+	t.Run("Read the service from the context", func(t *testing.T) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, "seeded-nonce")
+		h.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, s, found)
+		assert.Len(t, res.Header().Get(DefaultNonceHeader), 32)
+	})
+}
+
+type CountingLimiter struct {
+	limit int
+	count int
+}
+
+func (l *CountingLimiter) Allow() bool {
+	l.count++
+	return l.count <= l.limit
+}
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(NewNoncedServeMux(t), &CountingLimiter{limit: 3})
+	codes := []int{}
+	for i := 0; i < 5; i++ {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodHead, "/new-nonce",
+			nil))
+		codes = append(codes, res.Code)
+	}
+	assert.Equal(t, []int{
+		http.StatusOK,
+		http.StatusOK,
+		http.StatusOK,
+		http.StatusTooManyRequests,
+		http.StatusTooManyRequests,
+	}, codes)
+}
+
+func TestNormalizeNonceHeader(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	var received http.Header
+	h := NormalizeNonceHeader(Nonced(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+		}), s), "X-Forwarded-Nonce")
+
+	t.Run("Nonce from the source header", func(t *testing.T) {
+		s.Seed("forwarded-nonce")
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+		req.Header.Set("X-Forwarded-Nonce", "forwarded-nonce")
+		h.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, []string{"forwarded-nonce"},
+			received.Values(DefaultNonceHeader))
+		assert.Empty(t, received.Get("X-Forwarded-Nonce"))
+	})
+
+	t.Run("Duplicate values collapsed", func(t *testing.T) {
+		s.Seed("first-nonce")
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+		req.Header.Add(DefaultNonceHeader, "")
+		req.Header.Add(DefaultNonceHeader, "first-nonce")
+		req.Header.Add("X-Forwarded-Nonce", "second-nonce")
+		h.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, []string{"first-nonce"},
+			received.Values(DefaultNonceHeader))
+	})
+}
+
+func TestDecompress(t *testing.T) {
+	handler := Decompress(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}))
+
+	t.Run("Gzipped body", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte("a payload"))
+		zw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/", &buf)
+		req.Header.Set("Content-Encoding", "gzip")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "a payload", res.Body.String())
+	})
+
+	t.Run("Invalid gzip body", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader("a payload"))
+		req.Header.Set("Content-Encoding", "gzip")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("Uncompressed body passed through", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader("a payload"))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, "a payload", res.Body.String())
+	})
+}
+
+func TestMaxNonceAge(t *testing.T) {
+	done := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})
+	serve := func(h http.Handler, nonce string) int {
+		req := httptest.NewRequest(http.MethodPost, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+	newNonce := func(s NonceService) string {
+		nonce, err := s.GetNonce(httptest.NewRequest(http.MethodHead,
+			"/new-nonce", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		return nonce
+	}
+
+	t.Run("Stored nonces", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := dummy.NewDummyInMemoryNonceService(dummy.WithClock(clock),
+			dummy.WithTTL(time.Minute))
+		h := MaxNonceAge(Nonced(done, s), s, 10*time.Second)
+		fresh := newNonce(s)
+		old := newNonce(s)
+		clock.Advance(5 * time.Second)
+		assert.Equal(t, http.StatusOK, serve(h, fresh))
+		clock.Advance(15 * time.Second)
+		assert.Equal(t, http.StatusForbidden, serve(h, old))
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set(DefaultNonceHeader, old)
+		age, ok := s.NonceAge(req)
+		assert.True(t, ok)
+		assert.Equal(t, 20*time.Second, age)
+	})
+
+	t.Run("Signed nonces", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewSignedNonceService([]byte("a-key"), time.Minute)
+		s.Clock = clock
+		s.ClockSkew = 5 * time.Second
+		h := MaxNonceAge(Nonced(done, s), s, 10*time.Second)
+		fresh := newNonce(s)
+		old := newNonce(s)
+		clock.Advance(5 * time.Second)
+		assert.Equal(t, http.StatusOK, serve(h, fresh))
+		clock.Advance(15 * time.Second)
+		assert.Equal(t, http.StatusForbidden, serve(h, old))
+		valid, err := s.Verify(func() *http.Request {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set(DefaultNonceHeader, old)
+			return req
+		}())
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, valid)
+	})
+}
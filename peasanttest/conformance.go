@@ -0,0 +1,155 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	peasant "github.com/candango/gopeasant"
+)
+
+// ConformanceOption configures RunConformance.
+type ConformanceOption func(*conformance)
+
+type conformance struct {
+	expire  func()
+	header  string
+	skipped *http.Request
+}
+
+// WithExpire sets the function making the issued nonces expire, like
+// advancing the service fake clock past its TTL. Without it the expiry
+// contract isn't checked.
+func WithExpire(expire func()) ConformanceOption {
+	return func(c *conformance) {
+		c.expire = expire
+	}
+}
+
+// WithNonceHeader sets the header the nonces are sent in. It defaults to
+// peasant.DefaultNonceHeader.
+func WithNonceHeader(header string) ConformanceOption {
+	return func(c *conformance) {
+		c.header = header
+	}
+}
+
+// WithSkippedRequest sets a request the service must skip, like a new nonce
+// request. Without it only the nonced requests are checked not to be
+// skipped.
+func WithSkippedRequest(r *http.Request) ConformanceOption {
+	return func(c *conformance) {
+		c.skipped = r
+	}
+}
+
+// RunConformance runs subtests checking the service honors the NonceService
+// contract: nonced requests aren't skipped, issued nonces are unique, and
+// a nonce is consumed once, while missing, unknown, consumed and expired
+// nonces are rejected with an error status. The service must not share
+// nonces with other tests while it runs.
+func RunConformance(t *testing.T, s peasant.NonceService,
+	opts ...ConformanceOption) {
+	c := &conformance{
+		header: peasant.DefaultNonceHeader,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	newNonce := func(t *testing.T) string {
+		nonce, err := s.GetNonce(httptest.NewRequest(http.MethodHead,
+			"/new-nonce", nil))
+		if err != nil {
+			t.Fatalf("GetNonce failed: %v", err)
+		}
+		if nonce == "" {
+			t.Fatal("GetNonce returned an empty nonce")
+		}
+		return nonce
+	}
+	request := func(nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/do-nonced-something",
+			nil)
+		if nonce != "" {
+			req.Header.Set(c.header, nonce)
+		}
+		return req
+	}
+	call := func(t *testing.T, name string,
+		f func(http.ResponseWriter, *http.Request) error, nonce string) int {
+		res := httptest.NewRecorder()
+		err := f(res, request(nonce))
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		return res.Code
+	}
+	accepted := func(t *testing.T, name string, code int) {
+		if code > 299 {
+			t.Errorf("%s rejected a valid nonce with %d", name, code)
+		}
+	}
+	rejected := func(t *testing.T, name string, code int) {
+		if code < 400 {
+			t.Errorf("%s accepted an invalid nonce with %d", name, code)
+		}
+	}
+
+	t.Run("Skip", func(t *testing.T) {
+		if s.Skip(request("")) {
+			t.Error("a nonced request was skipped")
+		}
+		if c.skipped != nil && !s.Skip(c.skipped) {
+			t.Errorf("the request to %s wasn't skipped", c.skipped.URL)
+		}
+	})
+
+	t.Run("Issuance", func(t *testing.T) {
+		if newNonce(t) == newNonce(t) {
+			t.Error("GetNonce issued the same nonce twice")
+		}
+	})
+
+	t.Run("Provided", func(t *testing.T) {
+		accepted(t, "Provided", call(t, "Provided", s.Provided, newNonce(t)))
+		rejected(t, "Provided", call(t, "Provided", s.Provided, ""))
+	})
+
+	t.Run("Single-use consume", func(t *testing.T) {
+		nonce := newNonce(t)
+		accepted(t, "Consume", call(t, "Consume", s.Consume, nonce))
+		rejected(t, "Consume", call(t, "Consume", s.Consume, nonce))
+	})
+
+	t.Run("Missing nonce", func(t *testing.T) {
+		rejected(t, "Consume", call(t, "Consume", s.Consume, ""))
+	})
+
+	t.Run("Unknown nonce", func(t *testing.T) {
+		rejected(t, "Consume", call(t, "Consume", s.Consume,
+			"a-nonce-never-issued"))
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		if c.expire == nil {
+			t.Skip("no expire function set with WithExpire")
+		}
+		nonce := newNonce(t)
+		c.expire()
+		rejected(t, "Consume", call(t, "Consume", s.Consume, nonce))
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	peasant "github.com/candango/gopeasant"
+	"github.com/candango/gopeasant/dummy"
+)
+
+func TestRunConformance(t *testing.T) {
+	t.Run("Dummy in memory nonce service", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := dummy.NewDummyInMemoryNonceService(dummy.WithClock(clock),
+			dummy.WithTTL(time.Minute))
+		RunConformance(t, s,
+			WithExpire(func() {
+				clock.Advance(time.Minute)
+			}),
+			WithSkippedRequest(httptest.NewRequest(http.MethodHead,
+				"/new-nonce", nil)))
+	})
+
+	t.Run("Signed nonce service", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := peasant.NewSignedNonceService([]byte("a-key"), time.Minute)
+		s.Clock = clock
+		RunConformance(t, s, WithExpire(func() {
+			clock.Advance(time.Minute)
+		}))
+	})
+}
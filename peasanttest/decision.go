@@ -0,0 +1,65 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"sync"
+
+	peasant "github.com/candango/gopeasant"
+)
+
+// DecisionRecorder records the decisions taken by a nonce chain, so tests can
+// assert which stage handled a request. Pass Option to NoncedHandlerFunc or
+// NoncedReadHandlerFunc to install it. It is safe for concurrent use.
+type DecisionRecorder struct {
+	decisions []peasant.NonceDecision
+	mu        sync.Mutex
+}
+
+// NewDecisionRecorder initializes a new empty DecisionRecorder.
+func NewDecisionRecorder() *DecisionRecorder {
+	return &DecisionRecorder{}
+}
+
+// Decisions returns the recorded decisions, in order.
+func (r *DecisionRecorder) Decisions() []peasant.NonceDecision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]peasant.NonceDecision{}, r.decisions...)
+}
+
+// Last returns the last recorded decision as "stage:outcome", or an empty
+// string if none was recorded.
+func (r *DecisionRecorder) Last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.decisions) == 0 {
+		return ""
+	}
+	return r.decisions[len(r.decisions)-1].String()
+}
+
+// Option returns the NonceOption installing the recorder as the chain
+// decision sink.
+func (r *DecisionRecorder) Option() peasant.NonceOption {
+	return peasant.WithDecisionSink(r.Record)
+}
+
+// Record records the decision.
+func (r *DecisionRecorder) Record(d peasant.NonceDecision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decisions = append(r.decisions, d)
+}
@@ -0,0 +1,86 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"net/http"
+	"testing"
+
+	peasant "github.com/candango/gopeasant"
+	"github.com/candango/gopeasant/dummy"
+	"github.com/candango/httpok/testrunner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionRecorder(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	rec := NewDecisionRecorder()
+	done := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+	h := http.NewServeMux()
+	h.HandleFunc("/new-nonce", peasant.NoncedHandlerFunc(s, done,
+		rec.Option()))
+	h.HandleFunc("/do-nonced-something", peasant.NoncedHandlerFunc(s, done,
+		rec.Option()))
+	h.HandleFunc("/verify-nonced-something", peasant.NoncedReadHandlerFunc(
+		s, done, rec.Option()))
+	runner := testrunner.NewHttpTestRunner(t).WithHandler(h)
+
+	t.Run("Missing nonce", func(t *testing.T) {
+		res, err := runner.WithPath("/do-nonced-something").Get()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		assert.Equal(t, "provided:forbidden", rec.Last())
+	})
+
+	t.Run("Skipped request", func(t *testing.T) {
+		_, err := runner.WithPath("/new-nonce").Head()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "skip:pass", rec.Last())
+	})
+
+	t.Run("Consumed and replayed nonce", func(t *testing.T) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		for _, expected := range []string{"consume:pass",
+			"consume:forbidden"} {
+			_, err = runner.WithPath("/do-nonced-something").WithHeader(
+				peasant.DefaultNonceHeader, "seeded-nonce").
+				ClearHeaderAfter().Get()
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, expected, rec.Last())
+		}
+	})
+
+	t.Run("Verified nonce", func(t *testing.T) {
+		_, err := runner.WithPath("/verify-nonced-something").WithHeader(
+			peasant.DefaultNonceHeader, "unknown-nonce").
+			ClearHeaderAfter().Get()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "verify:forbidden", rec.Last())
+		assert.Len(t, rec.Decisions(), 5)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"sync"
+
+	peasant "github.com/candango/gopeasant"
+)
+
+// FailFirst returns a failure schedule failing the first n calls.
+func FailFirst(n int) func(call int) bool {
+	return func(call int) bool {
+		return call <= n
+	}
+}
+
+// FailEvery returns a failure schedule failing every nth call, simulating
+// intermittent failures.
+func FailEvery(n int) func(call int) bool {
+	return func(call int) bool {
+		return n > 0 && call%n == 0
+	}
+}
+
+// FailingDirectoryProvider decorates a peasant.DirectoryProvider failing its
+// Directory calls according to a schedule, to test the client directory
+// retry and fallback logic. GetUrl and SetTransport are passed through to the
+// wrapped provider. It is safe for concurrent use.
+type FailingDirectoryProvider struct {
+	peasant.DirectoryProvider
+	// Err is the error returned by the failed calls. ErrInjectedFault is
+	// returned if nil.
+	Err error
+	// Schedule reports if the call, numbered from 1, fails. No call fails if
+	// nil.
+	Schedule func(call int) bool
+
+	calls int
+	mu    sync.Mutex
+}
+
+// NewFailingDirectoryProvider initializes a new FailingDirectoryProvider
+// wrapping the given provider and failing by the given schedule.
+func NewFailingDirectoryProvider(dp peasant.DirectoryProvider,
+	schedule func(call int) bool) *FailingDirectoryProvider {
+	return &FailingDirectoryProvider{
+		DirectoryProvider: dp,
+		Schedule:          schedule,
+	}
+}
+
+// Calls returns the number of Directory calls made.
+func (p *FailingDirectoryProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// Directory returns the wrapped provider directory or an error if the call is
+// scheduled to fail.
+func (p *FailingDirectoryProvider) Directory() (map[string]interface{},
+	error) {
+	p.mu.Lock()
+	p.calls++
+	fail := p.Schedule != nil && p.Schedule(p.calls)
+	p.mu.Unlock()
+	if fail {
+		if p.Err != nil {
+			return nil, p.Err
+		}
+		return nil, ErrInjectedFault
+	}
+	return p.DirectoryProvider.Directory()
+}
@@ -0,0 +1,73 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	peasant "github.com/candango/gopeasant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailingDirectoryProvider(t *testing.T) {
+	directory := map[string]interface{}{
+		"newNonce": "http://bastion/nonce/new-nonce",
+	}
+
+	t.Run("Fail twice then recover with caching and retry", func(t *testing.T) {
+		dp := NewFailingDirectoryProvider(
+			peasant.NewMemoryDirectoryProvider(directory), FailFirst(2))
+		cached := peasant.NewCachingDirectoryProvider(dp, time.Minute)
+		var d map[string]interface{}
+		var err error
+		attempts := 0
+		for attempts < 5 {
+			attempts++
+			d, err = cached.Directory()
+			if err == nil {
+				break
+			}
+			assert.ErrorIs(t, err, ErrInjectedFault)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, directory, d)
+		_, err = cached.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 3, dp.Calls())
+	})
+
+	t.Run("Fail intermittently", func(t *testing.T) {
+		unavailable := errors.New("unavailable")
+		dp := NewFailingDirectoryProvider(
+			peasant.NewMemoryDirectoryProvider(directory), FailEvery(2))
+		dp.Err = unavailable
+		_, err := dp.Directory()
+		assert.NoError(t, err)
+		_, err = dp.Directory()
+		assert.Equal(t, unavailable, err)
+		_, err = dp.Directory()
+		assert.NoError(t, err)
+		_, err = dp.Directory()
+		assert.Equal(t, unavailable, err)
+		assert.Equal(t, 4, dp.Calls())
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package peasanttest provides utilities for testing peasants and bastions.
+package peasanttest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	peasant "github.com/candango/gopeasant"
+)
+
+// ErrInjectedFault is the error returned by a FaultInjectingTransport when
+// a call fails and no other error is configured.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultOption configures a FaultInjectingTransport.
+type FaultOption func(*FaultInjectingTransport)
+
+// WithError sets the error returned by the failed calls.
+func WithError(err error) FaultOption {
+	return func(t *FaultInjectingTransport) {
+		t.err = err
+	}
+}
+
+// WithFailFirstN makes the first n calls fail.
+func WithFailFirstN(n int) FaultOption {
+	return func(t *FaultInjectingTransport) {
+		t.failFirstN = n
+	}
+}
+
+// WithFailureRate makes the given fraction of the calls, from 0 to 1, fail.
+func WithFailureRate(rate float64) FaultOption {
+	return func(t *FaultInjectingTransport) {
+		t.failureRate = rate
+	}
+}
+
+// WithLatency adds the given delay to every call.
+func WithLatency(d time.Duration) FaultOption {
+	return func(t *FaultInjectingTransport) {
+		t.latency = d
+	}
+}
+
+// WithRand sets the random source deciding which calls fail, so the failures
+// are reproducible.
+func WithRand(r *rand.Rand) FaultOption {
+	return func(t *FaultInjectingTransport) {
+		t.rand = r
+	}
+}
+
+// FaultInjectingTransport decorates a peasant.Transport injecting latency and
+// failures in the NewNonce and Directory calls, to test the client
+// resilience. It is safe for concurrent use.
+type FaultInjectingTransport struct {
+	peasant.Transport
+
+	calls       int
+	err         error
+	failFirstN  int
+	failureRate float64
+	latency     time.Duration
+	mu          sync.Mutex
+	rand        *rand.Rand
+}
+
+// NewFaultInjectingTransport initializes a new FaultInjectingTransport
+// wrapping the given transport.
+func NewFaultInjectingTransport(tr peasant.Transport,
+	opts ...FaultOption) *FaultInjectingTransport {
+	t := &FaultInjectingTransport{
+		Transport: tr,
+		err:       ErrInjectedFault,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Calls returns the number of NewNonce and Directory calls made.
+func (t *FaultInjectingTransport) Calls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+
+// Close closes the wrapped transport if it implements io.Closer. No fault is
+// injected.
+func (t *FaultInjectingTransport) Close() error {
+	c, ok := t.Transport.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+// Directory returns the wrapped transport directory or an injected fault.
+func (t *FaultInjectingTransport) Directory() (map[string]interface{},
+	error) {
+	err := t.inject()
+	if err != nil {
+		return nil, err
+	}
+	return t.Transport.Directory()
+}
+
+// NewNonce returns a nonce from the wrapped transport or an injected fault.
+func (t *FaultInjectingTransport) NewNonce() (string, error) {
+	err := t.inject()
+	if err != nil {
+		return "", err
+	}
+	return t.Transport.NewNonce()
+}
+
+func (t *FaultInjectingTransport) inject() error {
+	t.mu.Lock()
+	t.calls++
+	fail := t.calls <= t.failFirstN || t.rand.Float64() < t.failureRate
+	t.mu.Unlock()
+	if t.latency > 0 {
+		time.Sleep(t.latency)
+	}
+	if fail {
+		return t.err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type StaticTransport struct{}
+
+func (StaticTransport) Directory() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"newNonce": "http://bastion/nonce/new-nonce",
+	}, nil
+}
+
+func (StaticTransport) NewNonce() (string, error) {
+	return "a-nonce", nil
+}
+
+// ClosingTransport is a StaticTransport counting the Close calls.
+type ClosingTransport struct {
+	StaticTransport
+	closed int
+}
+
+func (t *ClosingTransport) Close() error {
+	t.closed++
+	return nil
+}
+
+func TestFaultInjectingTransport(t *testing.T) {
+	t.Run("No faults by default", func(t *testing.T) {
+		tr := NewFaultInjectingTransport(StaticTransport{})
+		nonce, err := tr.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "a-nonce", nonce)
+		_, err = tr.Directory()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, tr.Calls())
+	})
+
+	t.Run("Fail the first calls", func(t *testing.T) {
+		unavailable := errors.New("unavailable")
+		tr := NewFaultInjectingTransport(StaticTransport{},
+			WithFailFirstN(2), WithError(unavailable))
+		_, err := tr.NewNonce()
+		assert.Equal(t, unavailable, err)
+		_, err = tr.Directory()
+		assert.Equal(t, unavailable, err)
+		_, err = tr.NewNonce()
+		assert.NoError(t, err)
+	})
+
+	t.Run("Failure rate", func(t *testing.T) {
+		tr := NewFaultInjectingTransport(StaticTransport{},
+			WithFailureRate(0.3), WithRand(rand.New(rand.NewSource(1))))
+		failures := 0
+		for i := 0; i < 1000; i++ {
+			_, err := tr.NewNonce()
+			if errors.Is(err, ErrInjectedFault) {
+				failures++
+			}
+		}
+		assert.InDelta(t, 300, failures, 50)
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		tr := NewFaultInjectingTransport(StaticTransport{},
+			WithLatency(20*time.Millisecond))
+		start := time.Now()
+		_, err := tr.NewNonce()
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	})
+
+	t.Run("Close the wrapped transport", func(t *testing.T) {
+		inner := &ClosingTransport{}
+		tr := NewFaultInjectingTransport(inner, WithFailureRate(1))
+		assert.NoError(t, tr.Close())
+		assert.Equal(t, 1, inner.closed)
+		assert.NoError(t, NewFaultInjectingTransport(StaticTransport{}).Close())
+	})
+}
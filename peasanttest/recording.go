@@ -0,0 +1,142 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// RecordingTransport implements the peasant.Transport interface without
+// touching the network. It records every call and answers with canned
+// responses: the directory it was created with and the given nonces in
+// order. It is safe for concurrent use.
+type RecordingTransport struct {
+	calls     []string
+	directory map[string]interface{}
+	mu        sync.Mutex
+	nonces    []string
+}
+
+// NewRecordingTransport initializes a new RecordingTransport answering with
+// the given directory and nonces.
+func NewRecordingTransport(directory map[string]interface{},
+	nonces ...string) *RecordingTransport {
+	return &RecordingTransport{
+		directory: directory,
+		nonces:    nonces,
+	}
+}
+
+// Calls returns the names of the calls made, in order.
+func (t *RecordingTransport) Calls() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.calls...)
+}
+
+// Directory records the call and returns a copy of the canned directory.
+func (t *RecordingTransport) Directory() (map[string]interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = append(t.calls, "Directory")
+	d := make(map[string]interface{}, len(t.directory))
+	for key, value := range t.directory {
+		d[key] = value
+	}
+	return d, nil
+}
+
+// NewNonce records the call and returns the next canned nonce. It returns an
+// error when no canned nonce is left.
+func (t *RecordingTransport) NewNonce() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = append(t.calls, "NewNonce")
+	if len(t.nonces) == 0 {
+		return "", errors.New("no canned nonce left")
+	}
+	nonce := t.nonces[0]
+	t.nonces = t.nonces[1:]
+	return nonce, nil
+}
+
+// RecordedRequest is a request captured by a RecordingRoundTripper.
+type RecordedRequest struct {
+	Body   string
+	Header http.Header
+	Method string
+	Url    string
+}
+
+// RecordingRoundTripper implements http.RoundTripper recording the requests
+// instead of sending them. Each request is answered by Responder, or with an
+// empty 200 OK response if Responder is nil. It is safe for concurrent use.
+type RecordingRoundTripper struct {
+	// Responder returns the canned response to a request.
+	Responder func(*http.Request) *http.Response
+
+	mu       sync.Mutex
+	requests []RecordedRequest
+}
+
+// Requests returns the recorded requests, in order.
+func (rt *RecordingRoundTripper) Requests() []RecordedRequest {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]RecordedRequest{}, rt.requests...)
+}
+
+// RoundTrip records the request and returns the canned response.
+func (rt *RecordingRoundTripper) RoundTrip(
+	r *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, RecordedRequest{
+		Body:   string(body),
+		Header: r.Header.Clone(),
+		Method: r.Method,
+		Url:    r.URL.String(),
+	})
+	rt.mu.Unlock()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var res *http.Response
+	if rt.Responder != nil {
+		res = rt.Responder(r)
+	}
+	if res == nil {
+		res = &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     http.Header{},
+		}
+	}
+	if res.Body == nil {
+		res.Body = http.NoBody
+	}
+	res.Request = r
+	return res, nil
+}
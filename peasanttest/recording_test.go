@@ -0,0 +1,82 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasanttest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	peasant "github.com/candango/gopeasant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingTransport(t *testing.T) {
+	tr := NewRecordingTransport(map[string]interface{}{
+		"newNonce": "http://bastion/nonce/new-nonce",
+	}, "first-nonce", "second-nonce")
+	p := peasant.NewPeasant(tr)
+
+	d, err := p.Directory()
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, "http://bastion/nonce/new-nonce", d["newNonce"])
+	for _, expected := range []string{"first-nonce", "second-nonce"} {
+		nonce, err := p.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, expected, nonce)
+	}
+	_, err = p.NewNonce()
+	assert.EqualError(t, err, "no canned nonce left")
+	assert.Equal(t, []string{"Directory", "NewNonce", "NewNonce", "NewNonce"},
+		tr.Calls())
+}
+
+func TestRecordingRoundTripper(t *testing.T) {
+	rt := &RecordingRoundTripper{
+		Responder: func(r *http.Request) *http.Response {
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Status:     "200 OK",
+				Header:     http.Header{},
+			}
+			res.Header.Set(peasant.DefaultNonceHeader, "a-nonce")
+			return res
+		},
+	}
+	ht := peasant.MustNewHttpTransport("http://bastion",
+		peasant.DefaultNonceHeader)
+	ht.Client.Transport = rt
+	ht.Pool = nil
+
+	res, err := ht.NoncedPost("newNonce", strings.NewReader("a body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	requests := rt.Requests()
+	assert.Len(t, requests, 2)
+	assert.Equal(t, http.MethodHead, requests[0].Method)
+	assert.Equal(t, "http://bastion/nonce/new-nonce", requests[0].Url)
+	assert.Equal(t, http.MethodPost, requests[1].Method)
+	assert.Equal(t, "http://bastion/nonce/new-nonce", requests[1].Url)
+	assert.Equal(t, "a-nonce",
+		requests[1].Header.Get(peasant.DefaultNonceHeader))
+	assert.Equal(t, "a body", requests[1].Body)
+}
@@ -0,0 +1,104 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"strings"
+)
+
+// NonceExtractor returns the nonce carried by a request, or an empty string
+// if there is none.
+type NonceExtractor func(*http.Request) string
+
+// NonceFromHeader returns a NonceExtractor reading the nonce from the given
+// header.
+func NonceFromHeader(key string) NonceExtractor {
+	return func(r *http.Request) string {
+		return r.Header.Get(key)
+	}
+}
+
+// NonceFromQuery returns a NonceExtractor reading the nonce from the given
+// query parameter.
+func NonceFromQuery(param string) NonceExtractor {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	}
+}
+
+// NonceFromCookie returns a NonceExtractor reading the nonce from the given
+// cookie, like the one issued with a NonceCookie.
+func NonceFromCookie(name string) NonceExtractor {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// NonceFromPath returns a NonceExtractor reading the nonce from the path
+// segment right after the given prefix, like the nonce in
+// /do-nonced-something/<nonce> for the /do-nonced-something/ prefix.
+func NonceFromPath(prefix string) NonceExtractor {
+	return func(r *http.Request) string {
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			return ""
+		}
+		segment, _, _ := strings.Cut(rest, "/")
+		return segment
+	}
+}
+
+// NonceInjector places a nonce in a request.
+type NonceInjector func(r *http.Request, nonce string)
+
+// NonceInHeader returns a NonceInjector setting the nonce in the given
+// header.
+func NonceInHeader(key string) NonceInjector {
+	return func(r *http.Request, nonce string) {
+		r.Header.Set(key, nonce)
+	}
+}
+
+// NonceInQuery returns a NonceInjector setting the nonce in the given query
+// parameter.
+func NonceInQuery(param string) NonceInjector {
+	return func(r *http.Request, nonce string) {
+		q := r.URL.Query()
+		q.Set(param, nonce)
+		r.URL.RawQuery = q.Encode()
+	}
+}
+
+// NonceInCookie returns a NonceInjector sending the nonce in the given
+// cookie, matching NonceFromCookie.
+func NonceInCookie(name string) NonceInjector {
+	return func(r *http.Request, nonce string) {
+		r.AddCookie(&http.Cookie{Name: name, Value: nonce})
+	}
+}
+
+// NonceInPath returns a NonceInjector appending the nonce as the last path
+// segment, matching NonceFromPath with the original path as prefix.
+func NonceInPath() NonceInjector {
+	return func(r *http.Request, nonce string) {
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + "/" + nonce
+		r.URL.RawPath = ""
+	}
+}
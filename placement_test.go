@@ -0,0 +1,105 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewPlacementServer(t *testing.T,
+	extractor NonceExtractor) *httptest.Server {
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithExtractor(extractor),
+		dummy.WithTTL(time.Minute))
+	nonced := NewNoncedHandler(s)
+	h := http.NewServeMux()
+	h.HandleFunc("/nonce/new-nonce", NoncedHandlerFunc(s, nonced.GetNonce))
+	h.HandleFunc("/nonce/do-nonced-something/",
+		NoncedHandlerFunc(s, nonced.DoNoncedFunc))
+	return httptest.NewServer(h)
+}
+
+func TestNoncePlacement(t *testing.T) {
+	cases := []struct {
+		name      string
+		extractor NonceExtractor
+		injector  NonceInjector
+	}{
+		{"Header", NonceFromHeader("X-Nonce"), NonceInHeader("X-Nonce")},
+		{"Query", NonceFromQuery("nonce"), NonceInQuery("nonce")},
+		{"Path", NonceFromPath("/nonce/do-nonced-something/"),
+			NonceInPath()},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run("Nonce in the "+c.name, func(t *testing.T) {
+			server := NewPlacementServer(t, c.extractor)
+			defer server.Close()
+			ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+				WithNonceInjector(c.injector))
+
+			req, err := ht.NewNoncedRequest(context.Background(),
+				http.MethodGet, server.URL+"/nonce/do-nonced-something/",
+				nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := c.extractor(req)
+			assert.Len(t, nonce, 32)
+			res, err := ht.Client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			res, err = ht.Client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		})
+	}
+
+	t.Run("Missing nonce", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/other/path", nil)
+		assert.Empty(t, NonceFromHeader("X-Nonce")(req))
+		assert.Empty(t, NonceFromQuery("nonce")(req))
+		assert.Empty(t, NonceFromPath("/do-nonced-something/")(req))
+	})
+
+	t.Run("Signed service extractor", func(t *testing.T) {
+		s := NewSignedNonceService([]byte("key"), time.Minute)
+		s.Extractor = NonceFromQuery("nonce")
+		nonce, err := s.GetNonce(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		NonceInQuery("nonce")(req, nonce)
+		valid, err := s.Verify(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, valid)
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PolicyMode is the nonce rule applied to a route.
+type PolicyMode int
+
+const (
+	// PolicyConsume requires a nonce and consumes it, like NoncedHandlerFunc.
+	PolicyConsume PolicyMode = iota
+	// PolicySkip doesn't check nonces.
+	PolicySkip
+	// PolicyVerify requires a nonce without consuming it, like
+	// NoncedReadHandlerFunc.
+	PolicyVerify
+)
+
+// NoncePolicy is the nonce configuration of a route.
+type NoncePolicy struct {
+	// Mode is the nonce rule applied to the route.
+	Mode PolicyMode
+	// Options configure the nonce chain of the consume and verify modes.
+	Options []NonceOption
+}
+
+// NoncePolicyRouter maps route patterns to nonce policies, so a single
+// http.ServeMux can mix consumed, verified and open endpoints. Patterns follow
+// the http.ServeMux path rules: a pattern ending in a slash matches the whole
+// subtree, any other pattern matches the exact path, and the longest matching
+// pattern wins. Requests matching no pattern get the Default policy.
+type NoncePolicyRouter struct {
+	// Default is the policy of requests matching no pattern.
+	Default NoncePolicy
+	// Service checks, consumes and issues the nonces.
+	Service VerifyingNonceService
+
+	mu       sync.RWMutex
+	policies map[string]NoncePolicy
+}
+
+// NewNoncePolicyRouter initializes a new NoncePolicyRouter using the given
+// service. The default policy consumes nonces.
+func NewNoncePolicyRouter(s VerifyingNonceService) *NoncePolicyRouter {
+	return &NoncePolicyRouter{
+		Service:  s,
+		policies: make(map[string]NoncePolicy),
+	}
+}
+
+// Handle sets the policy of the given route pattern.
+func (pr *NoncePolicyRouter) Handle(pattern string, p NoncePolicy) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.policies[pattern] = p
+}
+
+// Policy returns the policy matching the request path.
+func (pr *NoncePolicyRouter) Policy(r *http.Request) NoncePolicy {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	path := r.URL.Path
+	match := ""
+	p := pr.Default
+	for pattern, policy := range pr.policies {
+		if len(pattern) <= len(match) {
+			continue
+		}
+		if pattern == path || (strings.HasSuffix(pattern, "/") &&
+			strings.HasPrefix(path, pattern)) {
+			match = pattern
+			p = policy
+		}
+	}
+	return p
+}
+
+// Wrap is a middleware applying the policy matching each request before
+// calling next.
+func (pr *NoncePolicyRouter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := pr.Policy(r)
+		switch p.Mode {
+		case PolicySkip:
+			next.ServeHTTP(w, r)
+		case PolicyVerify:
+			NoncedReadHandlerFunc(pr.Service, next.ServeHTTP,
+				p.Options...)(w, r)
+		default:
+			NoncedHandlerFunc(pr.Service, next.ServeHTTP, p.Options...)(w, r)
+		}
+	})
+}
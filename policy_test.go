@@ -0,0 +1,83 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoncePolicyRouter(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	done := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/open", done)
+	mux.HandleFunc("/read/", done)
+	mux.HandleFunc("/write", done)
+	pr := NewNoncePolicyRouter(s)
+	pr.Handle("/open", NoncePolicy{Mode: PolicySkip})
+	pr.Handle("/read/", NoncePolicy{Mode: PolicyVerify})
+	h := pr.Wrap(mux)
+	request := func(path, nonce string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if nonce != "" {
+			req.Header.Set(DefaultNonceHeader, nonce)
+		}
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Skip", func(t *testing.T) {
+		res := request("/open", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Empty(t, res.Header().Get(DefaultNonceHeader))
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden,
+			request("/read/something", "").Code)
+		s.Seed("read-nonce")
+		for i := 0; i < 2; i++ {
+			res := request("/read/something", "read-nonce")
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.Empty(t, res.Header().Get(DefaultNonceHeader))
+		}
+	})
+
+	t.Run("Consume by default", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, request("/write", "").Code)
+		s.Seed("write-nonce")
+		res := request("/write", "write-nonce")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Len(t, res.Header().Get(DefaultNonceHeader), 32)
+		assert.Equal(t, http.StatusForbidden,
+			request("/write", "write-nonce").Code)
+	})
+
+	t.Run("Longest pattern wins", func(t *testing.T) {
+		pr.Handle("/read/private", NoncePolicy{Mode: PolicyConsume})
+		assert.Equal(t, PolicyConsume, pr.Policy(
+			httptest.NewRequest(http.MethodGet, "/read/private", nil)).Mode)
+		assert.Equal(t, PolicyVerify, pr.Policy(
+			httptest.NewRequest(http.MethodGet, "/read/public", nil)).Mode)
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultRefillInterval is how often the refill loop checks the Pool when
+// RefillInterval isn't set.
+const DefaultRefillInterval = time.Second
+
+// NoncePool buffers nonces fetched ahead of time. Nonces are served in the
+// order they were put. It is safe for concurrent use.
+type NoncePool struct {
+	mu     sync.Mutex
+	nonces []string
+}
+
+// NewNoncePool initializes a new empty NoncePool.
+func NewNoncePool() *NoncePool {
+	return &NoncePool{}
+}
+
+// Clear drops all the buffered nonces.
+func (p *NoncePool) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonces = nil
+}
+
+// Get removes and returns the oldest buffered nonce. It returns false if the
+// pool is empty.
+func (p *NoncePool) Get() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nonces) == 0 {
+		return "", false
+	}
+	nonce := p.nonces[0]
+	p.nonces = p.nonces[1:]
+	return nonce, true
+}
+
+// Len returns the number of buffered nonces.
+func (p *NoncePool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.nonces)
+}
+
+// Put buffers the given nonces.
+func (p *NoncePool) Put(nonces ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonces = append(p.nonces, nonces...)
+}
+
+// StartNonceRefill starts a background loop keeping the Pool warm. Every
+// RefillInterval, and whenever NewNonce takes a nonce from the Pool, the loop
+// fetches RefillBatch nonces with NewNonces if the Pool holds fewer than
+// RefillLowWater. Failed fetches are reported to OnRefillError and retried
+// on the next check. A nil Pool is initialized before the loop starts.
+//
+// The loop runs until the context is cancelled, StopNonceRefill or Close is
+// called. Starting the loop again stops the running one.
+func (ht *HttpTransport) StartNonceRefill(ctx context.Context) {
+	ht.StopNonceRefill()
+	if ht.Pool == nil {
+		ht.Pool = NewNoncePool()
+	}
+	interval := ht.RefillInterval
+	if interval <= 0 {
+		interval = DefaultRefillInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	refill := make(chan struct{}, 1)
+	done := make(chan struct{})
+	ht.refillMu.Lock()
+	ht.refill = refill
+	ht.refillDone = done
+	ht.stopRefill = cancel
+	ht.refillMu.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if ht.Pool.Len() < ht.RefillLowWater {
+				_, err := ht.newNonces(ctx, ht.RefillBatch)
+				if err != nil && ctx.Err() == nil {
+					ht.refillFailed(err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-refill:
+			}
+		}
+	}()
+}
+
+// StopNonceRefill stops the loop started by StartNonceRefill, if running,
+// and waits for it to exit.
+func (ht *HttpTransport) StopNonceRefill() {
+	ht.refillMu.Lock()
+	done := ht.refillDone
+	if ht.stopRefill != nil {
+		ht.stopRefill()
+		ht.stopRefill = nil
+		ht.refill = nil
+		ht.refillDone = nil
+	}
+	ht.refillMu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// refillFailed reports an error of the refill loop.
+func (ht *HttpTransport) refillFailed(err error) {
+	if ht.OnRefillError != nil {
+		ht.OnRefillError(err)
+		return
+	}
+	logf(nil, "peasant: the nonce refill failed: %v", err)
+}
+
+// wakeRefill signals the refill loop, if running, to check the Pool without
+// blocking the caller.
+func (ht *HttpTransport) wakeRefill() {
+	ht.refillMu.Lock()
+	defer ht.refillMu.Unlock()
+	if ht.refill == nil {
+		return
+	}
+	select {
+	case ht.refill <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoncePool(t *testing.T) {
+	t.Run("Nonces served in order", func(t *testing.T) {
+		p := NewNoncePool()
+		p.Put("first", "second")
+		p.Put("third")
+		assert.Equal(t, 3, p.Len())
+		for _, expected := range []string{"first", "second", "third"} {
+			nonce, ok := p.Get()
+			assert.True(t, ok)
+			assert.Equal(t, expected, nonce)
+		}
+		_, ok := p.Get()
+		assert.False(t, ok)
+	})
+
+	t.Run("Clear the pool", func(t *testing.T) {
+		p := NewNoncePool()
+		p.Put("first", "second")
+		p.Clear()
+		assert.Equal(t, 0, p.Len())
+	})
+}
+
+func TestNonceRefill(t *testing.T) {
+	server := NewServer(t)
+	defer server.Close()
+
+	newTransport := func() *HttpTransport {
+		p, err := NewHTTPPeasant(server.URL + "/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ht := p.Transport.(*HttpTransport)
+		ht.RefillBatch = 4
+		ht.RefillInterval = 10 * time.Millisecond
+		ht.RefillLowWater = 3
+		return ht
+	}
+
+	t.Run("Pool kept above the low water mark", func(t *testing.T) {
+		ht := newTransport()
+		defer ht.Close()
+		ht.StartNonceRefill(context.Background())
+		for i := 0; i < 10; i++ {
+			assert.Eventually(t, func() bool {
+				return ht.Pool.Len() >= ht.RefillLowWater
+			}, time.Second, time.Millisecond)
+			_, err := ht.NewNonce()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("Stop when the context is cancelled", func(t *testing.T) {
+		ht := newTransport()
+		defer ht.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		ht.StartNonceRefill(ctx)
+		assert.Eventually(t, func() bool {
+			return ht.Pool.Len() >= ht.RefillLowWater
+		}, time.Second, time.Millisecond)
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		ht.Pool.Clear()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 0, ht.Pool.Len())
+	})
+
+	t.Run("Stop waits for the loop", func(t *testing.T) {
+		ht := newTransport()
+		defer ht.Close()
+		ht.StartNonceRefill(context.Background())
+		ht.refillMu.Lock()
+		done := ht.refillDone
+		ht.refillMu.Unlock()
+		ht.StopNonceRefill()
+		select {
+		case <-done:
+		default:
+			t.Error("the refill loop is still running")
+		}
+	})
+
+	t.Run("Transport without a pool", func(t *testing.T) {
+		ht := newTransport()
+		defer ht.Close()
+		ht.Pool = nil
+		ht.StartNonceRefill(context.Background())
+		assert.Eventually(t, func() bool {
+			return ht.Pool.Len() >= ht.RefillLowWater
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("Default interval", func(t *testing.T) {
+		ht := newTransport()
+		defer ht.Close()
+		ht.RefillInterval = 0
+		ht.StartNonceRefill(context.Background())
+		assert.Eventually(t, func() bool {
+			return ht.Pool.Len() >= ht.RefillLowWater
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("Refill errors reported", func(t *testing.T) {
+		ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+			WithDirectoryProvider(NewMemoryDirectoryProvider(
+				map[string]interface{}{
+					"newNonce": server.URL + "/nonce/new-nonce",
+				})))
+		defer ht.Close()
+		ht.RefillInterval = 10 * time.Millisecond
+		errs := make(chan error, 10)
+		ht.OnRefillError = func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+		ht.StartNonceRefill(context.Background())
+		select {
+		case err := <-errs:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Error("no refill error reported")
+		}
+	})
+}
+
+func TestNonceEpoch(t *testing.T) {
+	var epoch atomic.Value
+	epoch.Store("1")
+	count := 0
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonces",
+		func(w http.ResponseWriter, r *http.Request) {
+			nonces := []string{}
+			for i := 0; i < 3; i++ {
+				count++
+				nonces = append(nonces, fmt.Sprintf("nonce-%d", count))
+			}
+			json.NewEncoder(w).Encode(nonces)
+		})
+	handler.HandleFunc("/do-something",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(DefaultNonceHeader, "harvested-nonce")
+		})
+	server := httptest.NewServer(NonceEpoch(handler, func() string {
+		return epoch.Load().(string)
+	}))
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonces":   server.URL + "/new-nonces",
+				"doSomething": server.URL + "/do-something",
+			})))
+
+	t.Run("Same epoch keeps the pool", func(t *testing.T) {
+		_, err := ht.NewNonces(3)
+		if err != nil {
+			t.Error(err)
+		}
+		res, err := ht.NoncedGet("doSomething")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, 3, ht.Pool.Len())
+	})
+
+	t.Run("Epoch change flushes the pool", func(t *testing.T) {
+		epoch.Store("2")
+		res, err := ht.NoncedGet("doSomething")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, 1, ht.Pool.Len())
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "harvested-nonce", nonce)
+	})
+
+	t.Run("Epoch change on a batch fetch", func(t *testing.T) {
+		_, err := ht.NewNonces(3)
+		if err != nil {
+			t.Error(err)
+		}
+		epoch.Store("3")
+		nonces, err := ht.NewNonces(3)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 3, ht.Pool.Len())
+		nonce, err := ht.NewNonce()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, nonces[0], nonce)
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader flags a request as idempotent, so it is retried
+	// even if its method isn't.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// RetrySafeHeader is set to "true" by a bastion answering a request that
+	// failed before any side effect, so it is retried even if it isn't
+	// idempotent.
+	RetrySafeHeader = "Retry-Safe"
+)
+
+// MinRetryDelay is the delay before the first retry when the bastion doesn't
+// set Retry-After. It doubles with each following retry.
+const MinRetryDelay = 50 * time.Millisecond
+
+// maxRetryShift caps the doubling of MinRetryDelay.
+const maxRetryShift = 6
+
+// idempotent reports if the request can be sent again without applying it
+// twice, either by its method or by carrying an IdempotencyKeyHeader.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// transientStatus reports if the status signals a failure that may go away
+// by retrying.
+func transientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryNonce fetches a new nonce with NewNonce, retrying up to MaxRetries
+// times on network errors and transient statuses. Fetching a nonce has no
+// side effects, so it is retried for any operation.
+func (ht *HttpTransport) retryNonce(ctx context.Context) (string, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := ht.NewNonce()
+		if err == nil || attempt >= ht.MaxRetries || ctx.Err() != nil {
+			return nonce, err
+		}
+		statusErr := &StatusError{}
+		if errors.Is(err, ErrInvalidNonce) || errors.As(err, &statusErr) &&
+			!transientStatus(statusErr.StatusCode) {
+			return "", err
+		}
+		err = sleep(ctx, retryDelay(attempt, statusErr.RetryAfter))
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// retryOperation reports if the operation sent with the request can be
+// retried after the given response or error. Idempotent requests are retried
+// after network errors and transient statuses. Other requests are only
+// retried after transient statuses marked safe with RetrySafeHeader, as
+// a network error doesn't tell if the bastion applied them. Requests whose
+// body can't be replayed aren't retried.
+func retryOperation(req *http.Request, res *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return idempotent(req)
+	}
+	if !transientStatus(res.StatusCode) {
+		return false
+	}
+	return idempotent(req) || res.Header.Get(RetrySafeHeader) == "true"
+}
+
+// retryDelay returns the delay before the retry following the given attempt,
+// counted from zero. The Retry-After delay is honored when it is longer than
+// the backoff.
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if attempt > maxRetryShift {
+		attempt = maxRetryShift
+	}
+	d := MinRetryDelay << attempt
+	if retryAfter > d {
+		return retryAfter
+	}
+	return d
+}
+
+// sleep waits for the given duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
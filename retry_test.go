@@ -0,0 +1,196 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetries(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	nonced := NewNoncedHandler(s)
+	var nonceFailures, failures, hits atomic.Int32
+	var safe atomic.Bool
+	handler := http.NewServeMux()
+	handler.HandleFunc("/new-nonce",
+		func(w http.ResponseWriter, r *http.Request) {
+			if nonceFailures.Add(-1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			nonced.GetNonce(w, r)
+		})
+	handler.HandleFunc("/operation", NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			if failures.Add(-1) >= 0 {
+				if safe.Load() {
+					w.Header().Set(RetrySafeHeader, "true")
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			w.Write([]byte("done " + string(b)))
+		}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ht := MustNewHttpTransport(server.URL, DefaultNonceHeader, WithRetries(2),
+		WithDirectoryProvider(NewMemoryDirectoryProvider(
+			map[string]interface{}{
+				"newNonce":  server.URL + "/new-nonce",
+				"operation": server.URL + "/operation",
+			})))
+	reset := func(nonceFails, fails int32, retrySafe bool) {
+		nonceFailures.Store(nonceFails)
+		failures.Store(fails)
+		hits.Store(0)
+		safe.Store(retrySafe)
+	}
+	send := func(method string, body io.Reader) (int, string) {
+		res, err := ht.NoncedDo(method, "operation", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := BodyAsString(res)
+		if err != nil {
+			t.Error(err)
+		}
+		return res.StatusCode, b
+	}
+
+	t.Run("Idempotent request retried", func(t *testing.T) {
+		reset(0, 1, false)
+		code, body := send(http.MethodGet, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "done ", body)
+		assert.Equal(t, int32(2), hits.Load())
+	})
+
+	t.Run("Non-idempotent request not retried", func(t *testing.T) {
+		reset(0, 1, false)
+		code, _ := send(http.MethodPost, strings.NewReader("a body"))
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, int32(1), hits.Load())
+	})
+
+	t.Run("Non-idempotent request retried when safe", func(t *testing.T) {
+		reset(0, 1, true)
+		code, body := send(http.MethodPost, strings.NewReader("a body"))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "done a body", body)
+		assert.Equal(t, int32(2), hits.Load())
+	})
+
+	t.Run("Request with an idempotency key retried", func(t *testing.T) {
+		reset(0, 1, false)
+		ht.Interceptors = []func(*http.Request) error{
+			func(r *http.Request) error {
+				r.Header.Set(IdempotencyKeyHeader, "an-operation")
+				return nil
+			},
+		}
+		defer func() {
+			ht.Interceptors = nil
+		}()
+		code, body := send(http.MethodPost, strings.NewReader("a body"))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "done a body", body)
+		assert.Equal(t, int32(2), hits.Load())
+	})
+
+	t.Run("Nonce fetch retried for any request", func(t *testing.T) {
+		reset(1, 0, false)
+		code, body := send(http.MethodPost, strings.NewReader("a body"))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "done a body", body)
+		assert.Equal(t, int32(1), hits.Load())
+	})
+
+	t.Run("Retries exhausted", func(t *testing.T) {
+		reset(0, 3, false)
+		code, _ := send(http.MethodGet, nil)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, int32(3), hits.Load())
+	})
+}
+
+func TestRetryNoncePlacement(t *testing.T) {
+	placements := []struct {
+		name      string
+		extractor NonceExtractor
+		injector  NonceInjector
+	}{
+		{"Path", NonceFromPath("/operation/"), NonceInPath()},
+		{"Query", NonceFromQuery("nonce"), NonceInQuery("nonce")},
+		{"Cookie", NonceFromCookie("nonce"), NonceInCookie("nonce")},
+	}
+	for _, placement := range placements {
+		t.Run(placement.name, func(t *testing.T) {
+			s := dummy.NewDummyInMemoryNonceService(
+				dummy.WithTTL(time.Minute),
+				dummy.WithExtractor(placement.extractor))
+			var hits atomic.Int32
+			handler := http.NewServeMux()
+			handler.HandleFunc("/new-nonce", NewNonceHandler(s).GetNonce)
+			handler.HandleFunc("/operation/", NoncedHandlerFunc(s,
+				func(w http.ResponseWriter, r *http.Request) {
+					if hits.Add(1) == 1 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.Write([]byte("done"))
+				}))
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			ht := MustNewHttpTransport(server.URL, DefaultNonceHeader,
+				WithRetries(2), WithNonceInjector(placement.injector),
+				WithDirectoryProvider(NewMemoryDirectoryProvider(
+					map[string]interface{}{
+						"newNonce":  server.URL + "/new-nonce",
+						"operation": server.URL + "/operation/",
+					})))
+			res, err := ht.NoncedDo(http.MethodGet, "operation", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := BodyAsString(res)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "done", body)
+			assert.Equal(t, int32(2), hits.Load())
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, MinRetryDelay, retryDelay(0, 0))
+	assert.Equal(t, 4*MinRetryDelay, retryDelay(2, 0))
+	assert.Equal(t, MinRetryDelay<<maxRetryShift, retryDelay(100, 0))
+	assert.Equal(t, 3*time.Second, retryDelay(1, 3*time.Second))
+}
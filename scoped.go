@@ -0,0 +1,185 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// scopeKey is the context key the nonce scope is stored under.
+type scopeKey struct{}
+
+// ScopeExtractor returns the scope, or audience, of a request, or an empty
+// string if the request is unscoped.
+type ScopeExtractor func(*http.Request) string
+
+// WithScope returns a copy of the context carrying the nonce scope, read by
+// ScopeFromContext.
+func WithScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
+
+// ScopeFromContext is a ScopeExtractor reading the scope set in the request
+// context by WithScope.
+func ScopeFromContext(r *http.Request) string {
+	scope, _ := r.Context().Value(scopeKey{}).(string)
+	return scope
+}
+
+// ScopeFromQuery returns a ScopeExtractor reading the scope from the given
+// query parameter, like the scope of /new-nonce?scope=billing.
+func ScopeFromQuery(param string) ScopeExtractor {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	}
+}
+
+// ScopedNonceService decorates a NonceService recording the scope each nonce
+// was issued for, so a nonce issued for the "billing" resources can't be
+// used for the "admin" ones. The scope of the issuing request and of the
+// request presenting the nonce are read by the Scope extractor, and
+// a presented nonce whose scope doesn't match is rejected with 403 without
+// being consumed.
+//
+// Nonces issued without a scope are only accepted by unscoped requests.
+// Scopes are dropped when the nonce is consumed or cleared, or when the TTL
+// elapses. A nonce whose scope is unknown, because it was issued by the
+// wrapped service directly or outlived its scope, is rejected with 403 while
+// the wrapped service holds it.
+type ScopedNonceService struct {
+	NonceService
+	// Clock provides the time scopes expire by.
+	Clock Clock
+	// Extractor reads the nonce from the request. If nil the nonce is read
+	// from the HeaderKey header.
+	Extractor NonceExtractor
+	// HeaderKey is the header the presented nonce is read from.
+	HeaderKey string
+	// Scope reads the scope of the request.
+	Scope ScopeExtractor
+	// TTL is how long the scope of a nonce is kept. It should be at least
+	// the TTL of the wrapped service, otherwise a nonce outliving its scope
+	// is rejected.
+	TTL time.Duration
+
+	scopes *nonceTracker[string]
+	mu     sync.Mutex
+}
+
+// NewScopedNonceService initializes a new ScopedNonceService wrapping the
+// given service and reading the request scopes with the given extractor.
+func NewScopedNonceService(s NonceService,
+	scope ScopeExtractor) *ScopedNonceService {
+	return &ScopedNonceService{
+		NonceService: s,
+		Clock:        systemClock{},
+		HeaderKey:    DefaultNonceHeader,
+		Scope:        scope,
+		TTL:          DefaultTrackingTTL,
+		scopes:       newNonceTracker[string](),
+	}
+}
+
+// Clear clears the nonce in the wrapped service and drops its scope.
+func (s *ScopedNonceService) Clear(nonce string) error {
+	s.unscope(nonce)
+	return s.NonceService.Clear(nonce)
+}
+
+// Consume rejects the nonce with 403 if it was issued for a different scope,
+// otherwise it is consumed by the wrapped service and its scope dropped.
+func (s *ScopedNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	nonce := s.nonce(r)
+	if !s.InScope(nonce, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	s.unscope(nonce)
+	return s.NonceService.Consume(w, r)
+}
+
+// GetNonce generates a new nonce with the wrapped service, recording the
+// scope of the issuing request, empty if unscoped.
+func (s *ScopedNonceService) GetNonce(r *http.Request) (string, error) {
+	nonce, err := s.NonceService.GetNonce(r)
+	if err != nil {
+		return "", err
+	}
+	now := s.Clock.Now()
+	s.mu.Lock()
+	s.scopes.put(nonce, s.Scope(r), now, s.TTL)
+	s.mu.Unlock()
+	return nonce, nil
+}
+
+// InScope reports if the nonce was issued for the scope of the request.
+// Missing nonces are reported in scope, leaving their rejection to the
+// wrapped service. A nonce whose scope is unknown is reported out of scope,
+// unless the wrapped service is a VerifyingNonceService reporting the nonce
+// isn't valid anymore.
+func (s *ScopedNonceService) InScope(nonce string, r *http.Request) bool {
+	if nonce == "" {
+		return true
+	}
+	now := s.Clock.Now()
+	s.mu.Lock()
+	scope, ok := s.scopes.get(nonce, now)
+	s.mu.Unlock()
+	if !ok {
+		return !s.held(r)
+	}
+	return scope == s.Scope(r)
+}
+
+// Provided rejects the nonce with 403 if it was issued for a different scope,
+// otherwise its presence is verified by the wrapped service.
+func (s *ScopedNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	if !s.InScope(s.nonce(r), r) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	return s.NonceService.Provided(w, r)
+}
+
+// held reports if the wrapped service may still accept the nonce carried by
+// the request. Services unable to verify a nonce are assumed to hold it.
+func (s *ScopedNonceService) held(r *http.Request) bool {
+	v, ok := s.NonceService.(VerifyingNonceService)
+	if !ok {
+		return true
+	}
+	valid, err := v.Verify(r)
+	return err != nil || valid
+}
+
+// unscope drops the scope of the nonce.
+func (s *ScopedNonceService) unscope(nonce string) {
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scopes.take(nonce, now)
+}
+
+func (s *ScopedNonceService) nonce(r *http.Request) string {
+	if s.Extractor != nil {
+		return s.Extractor(r)
+	}
+	return r.Header.Get(s.HeaderKey)
+}
@@ -0,0 +1,176 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewScopedServeMux(t *testing.T) (*http.ServeMux, *ScopedNonceService) {
+	query := ScopeFromQuery("scope")
+	s := NewScopedNonceService(dummy.NewDummyInMemoryNonceService(),
+		func(r *http.Request) string {
+			if scope := query(r); scope != "" {
+				return scope
+			}
+			return ScopeFromContext(r)
+		})
+	done := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+	scoped := func(scope string) http.HandlerFunc {
+		h := NoncedHandlerFunc(s, done)
+		return func(w http.ResponseWriter, r *http.Request) {
+			h(w, r.WithContext(WithScope(r.Context(), scope)))
+		}
+	}
+	h := http.NewServeMux()
+	h.HandleFunc("/new-nonce", NewNonceHandler(s).GetNonce)
+	h.HandleFunc("/billing", scoped("billing"))
+	h.HandleFunc("/admin", scoped("admin"))
+	h.HandleFunc("/unscoped", NoncedHandlerFunc(s, done))
+	return h, s
+}
+
+func TestScopedNonceService(t *testing.T) {
+	h, s := NewScopedServeMux(t)
+	issue := func(target string) string {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodHead, target, nil))
+		assert.Equal(t, http.StatusOK, res.Code)
+		return res.Header().Get(DefaultNonceHeader)
+	}
+	present := func(path, nonce string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Nonce used in its scope", func(t *testing.T) {
+		nonce := issue("/new-nonce?scope=billing")
+		res := present("/billing", nonce)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "done", res.Body.String())
+		assert.Equal(t, http.StatusForbidden, present("/billing", nonce).Code)
+	})
+
+	t.Run("Nonce rejected out of its scope", func(t *testing.T) {
+		nonce := issue("/new-nonce?scope=billing")
+		assert.Equal(t, http.StatusForbidden, present("/admin", nonce).Code)
+		assert.Equal(t, http.StatusForbidden,
+			present("/unscoped", nonce).Code)
+		// The rejection doesn't consume the nonce.
+		assert.Equal(t, http.StatusOK, present("/billing", nonce).Code)
+	})
+
+	t.Run("Unscoped nonce rejected by scoped requests", func(t *testing.T) {
+		nonce := issue("/new-nonce")
+		assert.Equal(t, http.StatusForbidden, present("/admin", nonce).Code)
+		assert.Equal(t, http.StatusOK, present("/unscoped", nonce).Code)
+	})
+
+	t.Run("Reissued nonce keeps the scope", func(t *testing.T) {
+		res := present("/admin", issue("/new-nonce?scope=admin"))
+		assert.Equal(t, http.StatusOK, res.Code)
+		nonce := res.Header().Get(DefaultNonceHeader)
+		assert.NotEqual(t, "", nonce)
+		assert.Equal(t, http.StatusForbidden,
+			present("/billing", nonce).Code)
+		assert.Equal(t, http.StatusOK, present("/admin", nonce).Code)
+	})
+
+	t.Run("Scopes expire", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewScopedNonceService(dummy.NewDummyInMemoryNonceService(),
+			ScopeFromQuery("scope"))
+		s.Clock = clock
+		s.TTL = time.Minute
+		req := httptest.NewRequest(http.MethodHead, "/new-nonce?scope=admin",
+			nil)
+		for i := 0; i < 3; i++ {
+			_, err := s.GetNonce(req)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		assert.Equal(t, 3, s.scopes.len())
+		clock.Advance(time.Minute)
+		_, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 1, s.scopes.len())
+	})
+
+	t.Run("Nonce with an expired scope rejected", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewScopedNonceService(dummy.NewDummyInMemoryNonceService(
+			dummy.WithTTL(time.Hour)), ScopeFromQuery("scope"))
+		s.Clock = clock
+		s.TTL = time.Minute
+		nonce, err := s.GetNonce(httptest.NewRequest(http.MethodHead,
+			"/new-nonce?scope=admin", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/unscoped", nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		err = s.Consume(res, req)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Nonce issued by the wrapped service rejected", func(t *testing.T) {
+		inner := dummy.NewDummyInMemoryNonceService()
+		s := NewScopedNonceService(inner, ScopeFromQuery("scope"))
+		nonce, err := inner.GetNonce(httptest.NewRequest(http.MethodHead,
+			"/new-nonce", nil))
+		if err != nil {
+			t.Error(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/unscoped", nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		assert.False(t, s.InScope(nonce, req))
+		err = inner.Clear(nonce)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, s.InScope(nonce, req))
+	})
+
+	t.Run("Clear drops the scope", func(t *testing.T) {
+		nonce := issue("/new-nonce?scope=billing")
+		err := s.Clear(nonce)
+		if err != nil {
+			t.Error(err)
+		}
+		_, ok := s.scopes.get(nonce, s.Clock.Now())
+		assert.False(t, ok)
+		assert.Equal(t, http.StatusForbidden,
+			present("/billing", nonce).Code)
+	})
+}
@@ -15,48 +15,685 @@
 package peasant
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/candango/httpok"
 )
 
+// DirectoryHandler returns a handler serving the given directory as JSON.
+func DirectoryHandler(dir map[string]any) http.Handler {
+	return DirectoryHandlerFunc(func(r *http.Request) (map[string]any,
+		error) {
+		return dir, nil
+	})
+}
+
+// DirectoryHandlerFunc returns a handler serving as JSON the directory built
+// by f for each request, so it can depend on the request host for example.
+// Errors returned by f or raised marshaling the directory are answered with
+// 500.
+func DirectoryHandlerFunc(
+	f func(*http.Request) (map[string]any, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir, err := f(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(dir)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// MaxChallengeSize is the maximum size of the challenge body posted to
+// NonceHandler.GetNonce.
+const MaxChallengeSize = 4096
+
+// DefaultMaxNonces is the default maximum number of nonces issued by
+// a single NonceHandler.GetNonces request.
+const DefaultMaxNonces = 100
+
+// NonceHandler serves the nonces issued by a NonceService.
+type NonceHandler struct {
+	// Cookie, if set, delivers the issued nonce in a cookie too, or only in
+	// the cookie if its OmitHeader is set.
+	Cookie *NonceCookie
+	// MaxNonces caps the number of nonces issued by a single request.
+	MaxNonces int
+	// Service issues the nonces.
+	Service NonceService
+}
+
+// NewNonceHandler initializes a new NonceHandler issuing nonces with the
+// given service, capped to DefaultMaxNonces per request.
+func NewNonceHandler(s NonceService) *NonceHandler {
+	return &NonceHandler{
+		MaxNonces: DefaultMaxNonces,
+		Service:   s,
+	}
+}
+
+// GetNonce issues a nonce in the DefaultNonceHeader header. HEAD requests are
+// answered with 200 and an explicit empty body, GET requests also carry the
+// nonce in a JSON body, for clients that can't read response headers.
+//
+// If the Service is a ChallengeNonceService, POST requests carrying a JSON
+// challenge, up to MaxChallengeSize, are answered like GET requests with
+// a nonce bound to the challenge. A missing or invalid challenge is answered
+// with 400. Other methods are answered with 405.
+//
+// If Cookie is set the nonce is also delivered in the cookie. If the cookie
+// OmitHeader is set, GET and POST requests are answered like HEAD requests,
+// so the nonce is readable only by the browser.
+func (h *NonceHandler) GetNonce(w http.ResponseWriter, r *http.Request) {
+	var nonce string
+	var err error
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		nonce, err = h.Service.GetNonce(r)
+	case http.MethodPost:
+		s, ok := h.Service.(ChallengeNonceService)
+		if !ok {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var challenge []byte
+		challenge, err = io.ReadAll(
+			http.MaxBytesReader(w, r.Body, MaxChallengeSize))
+		if err != nil || len(challenge) == 0 || !json.Valid(challenge) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		nonce, err = s.GetBoundNonce(r, challenge)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	omit := h.Cookie != nil && h.Cookie.OmitHeader
+	if h.Cookie != nil {
+		http.SetCookie(w, h.Cookie.Cookie(nonce))
+	}
+	if !omit {
+		w.Header().Set(DefaultNonceHeader, nonce)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead || omit {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"nonce": nonce})
+}
+
+// GetNonces issues the number of nonces set by the n query parameter and
+// writes them as a JSON array. If n is missing one nonce is issued, if it is
+// above MaxNonces MaxNonces are issued. An invalid n is answered with 400.
+func (h *NonceHandler) GetNonces(w http.ResponseWriter, r *http.Request) {
+	n := 1
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if h.MaxNonces > 0 && n > h.MaxNonces {
+		n = h.MaxNonces
+	}
+	nonces := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		nonce, err := h.Service.GetNonce(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		nonces = append(nonces, nonce)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nonces)
+}
+
+// Stages of the nonce chain reported to a NonceErrorHandler.
+const (
+	StageConsume  = "consume"
+	StageGetNonce = "get-nonce"
+	StageProvided = "provided"
+	StageSkip     = "skip"
+	StageVerify   = "verify"
+)
+
+// NonceDecision is the decision taken by the nonce chain for a request: the
+// stage that decided and its outcome. The outcome is "pass" when the chain let
+// the request through, "error" when the service failed, or the status the
+// request was stopped with, like "forbidden".
+type NonceDecision struct {
+	Outcome string
+	Stage   string
+}
+
+// String returns the decision as "stage:outcome", like "provided:forbidden".
+func (d NonceDecision) String() string {
+	return d.Stage + ":" + d.Outcome
+}
+
+// statusOutcome returns the decision outcome for the status code, like
+// "forbidden" for 403.
+func statusOutcome(code int) string {
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(code), " ",
+		"-"))
+}
+
+// NonceErrorHandler handles an error returned by the nonce service at the
+// given stage of the chain. It is responsible for writing the response, so it
+// isn't called if the service already committed the response.
+type NonceErrorHandler func(w http.ResponseWriter, r *http.Request,
+	stage string, err error)
+
+// NonceOption configures the nonce chain of NoncedHandlerFunc and
+// NoncedReadHandlerFunc.
+type NonceOption func(*nonceConfig)
+
+// IssuePolicy defines when NoncedHandlerFunc issues the nonce returned in the
+// response.
+type IssuePolicy int
+
+const (
+	// IssueAlways issues a nonce before calling the handler. It is the
+	// default policy.
+	IssueAlways IssuePolicy = iota
+	// IssueOnSuccess issues a nonce only if the handler answers with
+	// a status below 400.
+	IssueOnSuccess
+	// IssueOnRequest issues a nonce only if the handler asks for it calling
+	// NoncedResponseWriter.IssueNonce.
+	IssueOnRequest
+)
+
+// nonceConfig holds the nonce chain configuration.
+type nonceConfig struct {
+	cookie       *NonceCookie
+	decisionSink func(NonceDecision)
+	errorHandler NonceErrorHandler
+	issuePolicy  IssuePolicy
+	logger       *log.Logger
+	nonceHeader  string
+	rejectStatus int
+	skip         func(*http.Request) bool
+	strictSkip   bool
+	trailer      bool
+}
+
+// skipCheckKey is the context key the strict skip check is stored under.
+type skipCheckKey struct{}
+
+// skipCheck records if a nonce was required downstream of a skipped request.
+type skipCheck struct {
+	required bool
+}
+
+// WithCookieNonce delivers the nonce issued in the response in the given
+// cookie too, or only in the cookie if its OmitHeader is set. Cookies can't
+// be sent as trailers, so it has no effect with WithTrailerNonce.
+func WithCookieNonce(cookie NonceCookie) NonceOption {
+	return func(c *nonceConfig) {
+		c.cookie = &cookie
+	}
+}
+
+// WithDecisionSink sets a function receiving the decision taken by the nonce
+// chain for each request, so tests can assert which stage stopped or let
+// a request through instead of inferring it from the status code.
+func WithDecisionSink(sink func(NonceDecision)) NonceOption {
+	return func(c *nonceConfig) {
+		c.decisionSink = sink
+	}
+}
+
+// decide reports the decision to the sink, if any.
+func (c *nonceConfig) decide(stage, outcome string) {
+	if c.decisionSink != nil {
+		c.decisionSink(NonceDecision{Outcome: outcome, Stage: stage})
+	}
+}
+
+// WithErrorHandler sets the handler called when the nonce service returns an
+// error, instead of answering with a bare 500.
+func WithErrorHandler(h NonceErrorHandler) NonceOption {
+	return func(c *nonceConfig) {
+		c.errorHandler = h
+	}
+}
+
+// WithIssuePolicy sets when the nonce returned in the response is issued, so
+// endpoints not followed by another nonced request don't waste nonces.
+func WithIssuePolicy(p IssuePolicy) NonceOption {
+	return func(c *nonceConfig) {
+		c.issuePolicy = p
+	}
+}
+
+// WithLogger sets the logger reporting the errors that can't be answered
+// because the response was already committed. If not set the standard logger
+// is used.
+func WithLogger(l *log.Logger) NonceOption {
+	return func(c *nonceConfig) {
+		c.logger = l
+	}
+}
+
+// WithNonceHeader sets the response header the issued nonce is set in,
+// instead of DefaultNonceHeader.
+func WithNonceHeader(key string) NonceOption {
+	return func(c *nonceConfig) {
+		c.nonceHeader = key
+	}
+}
+
+// WithRejectStatus sets the status answered when the service rejects
+// a request, instead of 403 Forbidden. ACME bastions answer with 400 Bad
+// Request, for example.
+func WithRejectStatus(code int) NonceOption {
+	return func(c *nonceConfig) {
+		c.rejectStatus = code
+	}
+}
+
+// WithSkip sets the function reporting if a request should not be nonced,
+// instead of the service Skip method.
+func WithSkip(skip func(*http.Request) bool) NonceOption {
+	return func(c *nonceConfig) {
+		c.skip = skip
+	}
+}
+
+// WithStrictSkip makes the chain check skipped requests don't reach another
+// nonce chain down the handler, as a request both skipped and requiring
+// a nonce points to a configuration mistake. A warning is logged when it
+// happens.
+func WithStrictSkip() NonceOption {
+	return func(c *nonceConfig) {
+		c.strictSkip = true
+	}
+}
+
+// WithTrailerNonce issues the response nonce as an HTTP trailer, using
+// http.TrailerPrefix, after the handler returns, instead of a header. It suits
+// streamed responses whose body is sent before the next nonce is known. The
+// issue policy still applies, IssueOnSuccess checking the handler status.
+func WithTrailerNonce() NonceOption {
+	return func(c *nonceConfig) {
+		c.trailer = true
+	}
+}
+
+// logf logs with the configured logger.
+func logf(l *log.Logger, format string, v ...any) {
+	if l == nil {
+		log.Printf(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// skipped reports if the request should not be nonced. A request that isn't
+// skipped is flagged as requiring a nonce to the strict skip check of an
+// upstream chain, if any.
+func (c *nonceConfig) skipped(s NonceService, r *http.Request) bool {
+	var skip bool
+	if c.skip != nil {
+		skip = c.skip(r)
+	} else {
+		skip = s.Skip(r)
+	}
+	if !skip {
+		if sc, ok := r.Context().Value(skipCheckKey{}).(*skipCheck); ok {
+			sc.required = true
+		}
+	}
+	return skip
+}
+
+// serveSkipped calls the handler for a skipped request, checking no nonce is
+// required down the handler if the strict skip is set.
+func (c *nonceConfig) serveSkipped(f func(http.ResponseWriter, *http.Request),
+	w http.ResponseWriter, r *http.Request) {
+	c.decide(StageSkip, "pass")
+	if !c.strictSkip {
+		f(w, r)
+		return
+	}
+	sc := &skipCheck{}
+	f(w, r.WithContext(context.WithValue(r.Context(), skipCheckKey{}, sc)))
+	if sc.required {
+		logf(c.logger, "peasant: the request to %s was skipped but a nonce "+
+			"was required by the handler", r.URL.Path)
+	}
+}
+
+// writers wraps the response writer for the chain, returning the writer
+// recording if the response was committed and the one replacing the reject
+// status, which must be deactivated before calling the handler.
+func (c *nonceConfig) writers(w http.ResponseWriter) (*CommitWriter,
+	*rejectWriter) {
+	rw := &rejectWriter{
+		ResponseWriter: w,
+		active:         true,
+		status:         c.rejectStatus,
+	}
+	return &CommitWriter{ResponseWriter: rw}, rw
+}
+
+// fail handles an error returned by the service at the given stage. If the
+// response was already committed no status can be written anymore, so the
+// error is logged instead of calling the error handler.
+func (c *nonceConfig) fail(cw *CommitWriter, w http.ResponseWriter,
+	r *http.Request, stage string, err error) {
+	c.decide(stage, "error")
+	if cw.Committed() {
+		logf(c.logger, "peasant: the nonce %s stage failed after the "+
+			"response was committed: %v", stage, err)
+		return
+	}
+	c.errorHandler(w, r, stage, err)
+}
+
+func newNonceConfig(opts []NonceOption) *nonceConfig {
+	c := &nonceConfig{
+		errorHandler: func(w http.ResponseWriter, r *http.Request,
+			stage string, err error) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+		nonceHeader:  DefaultNonceHeader,
+		rejectStatus: http.StatusForbidden,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NoncedHandlerFunc protects the handler with a nonce. The nonce provided in
+// the request is checked and consumed, and a new nonce is issued in the
+// response header, according to the policy set with WithIssuePolicy. Errors
+// returned by the service are answered with 500 unless an error handler is
+// set with WithErrorHandler.
 func NoncedHandlerFunc(
 	s NonceService, f func(http.ResponseWriter, *http.Request),
+	opts ...NonceOption,
 ) func(http.ResponseWriter, *http.Request) {
+	c := newNonceConfig(opts)
 	return func(w http.ResponseWriter, r *http.Request) {
-		if s.Skip(r) {
-			f(w, r)
+		if c.skipped(s, r) {
+			c.serveSkipped(f, w, r)
 			return
 		}
+		cw, rw := c.writers(w)
 		wrapped := &httpok.WrappedWriter{
-			ResponseWriter: w,
+			ResponseWriter: cw,
 			StatusCode:     http.StatusOK,
 		}
 		err := s.Provided(wrapped, r)
 		if err != nil {
-			wrapped.WriteHeader(http.StatusInternalServerError)
+			c.fail(cw, wrapped, r, StageProvided, err)
 			return
 		}
 		if wrapped.StatusCode >= 300 {
+			c.decide(StageProvided, statusOutcome(wrapped.StatusCode))
 			return
 		}
 		err = s.Consume(wrapped, r)
 		if err != nil {
-			wrapped.WriteHeader(http.StatusInternalServerError)
+			c.fail(cw, wrapped, r, StageConsume, err)
 			return
 		}
 		if wrapped.StatusCode >= 300 {
+			c.decide(StageConsume, statusOutcome(wrapped.StatusCode))
+			return
+		}
+		nw := &NoncedResponseWriter{
+			WrappedWriter: wrapped,
+			cookie:        c.cookie,
+			key:           c.nonceHeader,
+			logger:        c.logger,
+			policy:        c.issuePolicy,
+			getNonce: func() (string, error) {
+				return s.GetNonce(r)
+			},
+		}
+		if c.trailer {
+			nw.policy = IssueOnRequest
+		}
+		if c.issuePolicy == IssueAlways && !c.trailer {
+			_, err = nw.IssueNonce()
+			if err != nil {
+				c.fail(cw, wrapped, r, StageGetNonce, err)
+				return
+			}
+			if wrapped.StatusCode >= 300 {
+				c.decide(StageGetNonce, statusOutcome(wrapped.StatusCode))
+				return
+			}
+		}
+		c.decide(StageConsume, "pass")
+		rw.active = false
+		f(nw, r)
+		if !nw.wroteHeader {
+			nw.WriteHeader(http.StatusOK)
+		}
+		if c.trailer && nw.nonce == "" && (c.issuePolicy == IssueAlways ||
+			c.issuePolicy == IssueOnSuccess && wrapped.StatusCode < 400) {
+			nonce, err := s.GetNonce(r)
+			if err != nil {
+				logf(c.logger, "peasant: the nonce %s stage failed: %v",
+					StageGetNonce, err)
+				return
+			}
+			nw.nonce = nonce
+			nw.issued = true
+			w.Header().Set(http.TrailerPrefix+c.nonceHeader, nonce)
+		}
+	}
+}
+
+// CommitWriter wraps a ResponseWriter recording if the response was
+// committed, meaning its header was written and no other status can be set.
+type CommitWriter struct {
+	http.ResponseWriter
+	committed bool
+}
+
+// Committed reports if the response header was written.
+func (w *CommitWriter) Committed() bool {
+	return w.committed
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can
+// reach it.
+func (w *CommitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *CommitWriter) WriteHeader(code int) {
+	w.committed = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *CommitWriter) Write(b []byte) (int, error) {
+	w.committed = true
+	return w.ResponseWriter.Write(b)
+}
+
+// rejectWriter replaces the forbidden status written by the service with the
+// configured reject status while active.
+type rejectWriter struct {
+	http.ResponseWriter
+	active bool
+	status int
+}
+
+func (w *rejectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *rejectWriter) WriteHeader(code int) {
+	if w.active && code == http.StatusForbidden {
+		code = w.status
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// NoncedResponseWriter is the writer handed to handlers by NoncedHandlerFunc.
+// It sets the issued nonce header right before the response header is
+// written, so the handler can't drop or overwrite it, and records that the
+// nonce was issued.
+type NoncedResponseWriter struct {
+	*httpok.WrappedWriter
+	cookie      *NonceCookie
+	getNonce    func() (string, error)
+	issued      bool
+	key         string
+	logger      *log.Logger
+	nonce       string
+	policy      IssuePolicy
+	wroteHeader bool
+}
+
+// Committed reports if the response header was written.
+func (w *NoncedResponseWriter) Committed() bool {
+	return w.wroteHeader
+}
+
+// IssueNonce issues the nonce returned in the response, if it wasn't issued
+// yet, and returns it. Handlers protected with the IssueOnRequest policy call
+// it to opt in. It must be called before the response header is written.
+func (w *NoncedResponseWriter) IssueNonce() (string, error) {
+	if w.nonce != "" {
+		return w.nonce, nil
+	}
+	if w.wroteHeader {
+		return "", errors.New("the response header was already written")
+	}
+	nonce, err := w.getNonce()
+	if err != nil {
+		return "", err
+	}
+	w.nonce = nonce
+	w.setHeader()
+	return nonce, nil
+}
+
+// Nonce returns the nonce issued by the chain, or an empty string if none was
+// issued yet.
+func (w *NoncedResponseWriter) Nonce() string {
+	return w.nonce
+}
+
+// NonceIssued reports if the nonce header was written to the response by the
+// chain.
+func (w *NoncedResponseWriter) NonceIssued() bool {
+	return w.issued
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can
+// reach it, to flush a streamed response for example.
+func (w *NoncedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.WrappedWriter.ResponseWriter
+}
+
+func (w *NoncedResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		if w.policy == IssueOnSuccess && code < 400 {
+			_, err := w.IssueNonce()
+			if err != nil {
+				logf(w.logger, "peasant: the nonce %s stage failed: %v",
+					StageGetNonce, err)
+			}
+		}
+		w.wroteHeader = true
+		if w.nonce != "" {
+			w.setHeader()
+			if w.cookie != nil {
+				http.SetCookie(w, w.cookie.Cookie(w.nonce))
+			}
+			w.issued = true
+		}
+	}
+	w.WrappedWriter.WriteHeader(code)
+}
+
+// setHeader sets the nonce header, unless the nonce is only delivered in
+// a cookie.
+func (w *NoncedResponseWriter) setHeader() {
+	if w.cookie == nil || !w.cookie.OmitHeader {
+		w.Header().Set(w.key, w.nonce)
+	}
+}
+
+func (w *NoncedResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.WrappedWriter.Write(b)
+}
+
+// NoncedReadHandlerFunc protects read-only endpoints verifying the provided
+// nonce without consuming it, so the client can use the same nonce in
+// a subsequent mutating request. No new nonce is issued.
+func NoncedReadHandlerFunc(
+	s VerifyingNonceService, f func(http.ResponseWriter, *http.Request),
+	opts ...NonceOption,
+) func(http.ResponseWriter, *http.Request) {
+	c := newNonceConfig(opts)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.skipped(s, r) {
+			c.serveSkipped(f, w, r)
 			return
 		}
-		nonce, err := s.GetNonce(r)
+		cw, rw := c.writers(w)
+		wrapped := &httpok.WrappedWriter{
+			ResponseWriter: cw,
+			StatusCode:     http.StatusOK,
+		}
+		err := s.Provided(wrapped, r)
 		if err != nil {
-			wrapped.WriteHeader(http.StatusInternalServerError)
+			c.fail(cw, wrapped, r, StageProvided, err)
 			return
 		}
 		if wrapped.StatusCode >= 300 {
+			c.decide(StageProvided, statusOutcome(wrapped.StatusCode))
+			return
+		}
+		valid, err := s.Verify(r)
+		if err != nil {
+			c.fail(cw, wrapped, r, StageVerify, err)
+			return
+		}
+		if !valid {
+			c.decide(StageVerify, statusOutcome(http.StatusForbidden))
+			wrapped.WriteHeader(http.StatusForbidden)
 			return
 		}
-		wrapped.Header().Add("nonce", nonce)
+		c.decide(StageVerify, "pass")
+		rw.active = false
 		f(wrapped, r)
 	}
 }
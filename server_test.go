@@ -15,7 +15,15 @@
 package peasant
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -40,7 +48,7 @@ func (h *NoncedHandler) GetNonce(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Header().Add("nonce", nonce)
+	w.Header().Add(DefaultNonceHeader, nonce)
 }
 
 func (h *NoncedHandler) DoNoncedFunc(w http.ResponseWriter, r *http.Request) {
@@ -49,10 +57,23 @@ func (h *NoncedHandler) DoNoncedFunc(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	nonce := r.Header.Get("nonce")
+	nonce := r.Header.Get(DefaultNonceHeader)
 	w.Write([]byte("Func done with nonce " + nonce))
 }
 
+func (h *NoncedHandler) DoNoncedPost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Post done with " + string(body)))
+}
+
 func NewNoncedHandler(s NonceService) *NoncedHandler {
 	return &NoncedHandler{
 		s: s,
@@ -64,8 +85,13 @@ func NewNoncedFuncServeMux(t *testing.T) *http.ServeMux {
 	nonced := NewNoncedHandler(s)
 	h := http.NewServeMux()
 	h.HandleFunc("/new-nonce", NoncedHandlerFunc(s, nonced.GetNonce))
+	h.HandleFunc("/new-nonces", NewNonceHandler(s).GetNonces)
 	h.HandleFunc("/do-nonced-something",
 		NoncedHandlerFunc(s, nonced.DoNoncedFunc))
+	h.HandleFunc("/post-nonced-something",
+		NoncedHandlerFunc(s, nonced.DoNoncedPost))
+	h.HandleFunc("/verify-nonced-something",
+		NoncedReadHandlerFunc(s, nonced.DoNoncedFunc))
 	return h
 }
 
@@ -95,7 +121,8 @@ func TestNoncedFuncServer(t *testing.T) {
 			nonce := res.Header.Get("nonce")
 
 			res, err = runner.WithPath(
-				"/do-nonced-something").WithHeader("nonce", nonce).Get()
+				"/do-nonced-something").WithHeader("nonce", nonce).
+				ClearHeaderAfter().Get()
 			if err != nil {
 				t.Error(err)
 			}
@@ -114,12 +141,586 @@ func TestNoncedFuncServer(t *testing.T) {
 
 			time.Sleep(250 * time.Millisecond)
 			res, err = runner.WithPath(
-				"/do-nonced-something").WithHeader("nonce", nonce).Get()
+				"/do-nonced-something").WithHeader("nonce", nonce).
+				ClearHeaderAfter().Get()
+			if err != nil {
+				t.Error(err)
+			}
+
+			assert.Equal(t, "403 Forbidden", res.Status)
+		})
+	})
+
+	t.Run("Verify a nonce", func(t *testing.T) {
+		t.Run("Verify then consume", func(t *testing.T) {
+			res, err := runner.WithPath("/new-nonce").Head()
+			if err != nil {
+				t.Error(err)
+			}
+			nonce := res.Header.Get(DefaultNonceHeader)
+
+			res, err = runner.WithPath("/verify-nonced-something").WithHeader(
+				DefaultNonceHeader, nonce).ClearHeaderAfter().Get()
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, "200 OK", res.Status)
+			assert.Equal(t, "Func done with nonce "+nonce,
+				testrunner.BodyAsString(t, res))
+			assert.Empty(t, res.Header.Get(DefaultNonceHeader))
+
+			res, err = runner.WithPath("/do-nonced-something").WithHeader(
+				DefaultNonceHeader, nonce).ClearHeaderAfter().Get()
 			if err != nil {
 				t.Error(err)
 			}
+			assert.Equal(t, "200 OK", res.Status)
 
+			res, err = runner.WithPath("/verify-nonced-something").WithHeader(
+				DefaultNonceHeader, nonce).ClearHeaderAfter().Get()
+			if err != nil {
+				t.Error(err)
+			}
 			assert.Equal(t, "403 Forbidden", res.Status)
 		})
 	})
 }
+
+func TestNoncedResponseHeader(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	h := http.NewServeMux()
+	h.HandleFunc("/overwrite", NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(DefaultNonceHeader, "garbage")
+			w.Write([]byte("overwritten"))
+		}))
+	h.HandleFunc("/delete", NoncedHandlerFunc(s,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Del(DefaultNonceHeader)
+		}))
+	runner := testrunner.NewHttpTestRunner(t).WithHandler(h)
+	newNonce := func() string {
+		nonce, err := s.GetNonce(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		return nonce
+	}
+
+	t.Run("Handler overwrites the nonce header", func(t *testing.T) {
+		res, err := runner.WithPath("/overwrite").WithHeader(
+			DefaultNonceHeader, newNonce()).ClearHeaderAfter().Get()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "200 OK", res.Status)
+		assert.Equal(t, "overwritten", testrunner.BodyAsString(t, res))
+		assert.Equal(t, 32, len(res.Header.Get(DefaultNonceHeader)))
+	})
+
+	t.Run("Handler deletes the nonce header", func(t *testing.T) {
+		res, err := runner.WithPath("/delete").WithHeader(
+			DefaultNonceHeader, newNonce()).ClearHeaderAfter().Get()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "200 OK", res.Status)
+		nonce := res.Header.Get(DefaultNonceHeader)
+		assert.Equal(t, 32, len(nonce))
+
+		res, err = runner.WithPath("/delete").WithHeader(
+			DefaultNonceHeader, nonce).ClearHeaderAfter().Get()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "200 OK", res.Status)
+	})
+}
+
+func TestNoncedResponseWriter(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	var nw *NoncedResponseWriter
+	var issuedInHandler bool
+	h := NoncedHandlerFunc(s, func(w http.ResponseWriter, r *http.Request) {
+		nw = w.(*NoncedResponseWriter)
+		issuedInHandler = nw.NonceIssued()
+		w.Write([]byte("done"))
+	})
+	nonce, err := s.GetNonce(nil)
+	if err != nil {
+		t.Error(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+	req.Header.Set(DefaultNonceHeader, nonce)
+	h(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.False(t, issuedInHandler)
+	assert.True(t, nw.NonceIssued())
+	assert.Equal(t, nw.Nonce(), res.Header().Get(DefaultNonceHeader))
+}
+
+func TestNonceHandlerGetNonces(t *testing.T) {
+	h := NewNonceHandler(dummy.NewDummyInMemoryNonceService())
+	h.MaxNonces = 5
+	getNonces := func(query string) (*httptest.ResponseRecorder, []string) {
+		res := httptest.NewRecorder()
+		h.GetNonces(res, httptest.NewRequest(http.MethodGet,
+			"/new-nonces"+query, nil))
+		nonces := []string{}
+		json.Unmarshal(res.Body.Bytes(), &nonces)
+		return res, nonces
+	}
+
+	t.Run("Issue N nonces", func(t *testing.T) {
+		res, nonces := getNonces("?n=3")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+		assert.Len(t, nonces, 3)
+		assert.NotEqual(t, nonces[0], nonces[1])
+	})
+
+	t.Run("One nonce by default", func(t *testing.T) {
+		_, nonces := getNonces("")
+		assert.Len(t, nonces, 1)
+	})
+
+	t.Run("Capped to MaxNonces", func(t *testing.T) {
+		_, nonces := getNonces("?n=50")
+		assert.Len(t, nonces, 5)
+	})
+
+	t.Run("Invalid n", func(t *testing.T) {
+		res, _ := getNonces("?n=zero")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		res, _ = getNonces("?n=0")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+}
+
+func TestNonceHandlerGetNonce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		NewNonceHandler(dummy.NewDummyInMemoryNonceService()).GetNonce))
+	defer server.Close()
+
+	t.Run("HEAD without a body", func(t *testing.T) {
+		res, err := http.Head(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "0", res.Header.Get("Content-Length"))
+		assert.Empty(t, b)
+		assert.Len(t, res.Header.Get(DefaultNonceHeader), 32)
+	})
+
+	t.Run("GET with the nonce in the body and header", func(t *testing.T) {
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body := map[string]string{}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		assert.Len(t, body["nonce"], 32)
+		assert.Equal(t, body["nonce"], res.Header.Get(DefaultNonceHeader))
+	})
+
+	t.Run("Method not allowed", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPut, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	})
+
+	t.Run("POST with a challenge", func(t *testing.T) {
+		res, err := http.Post(server.URL, "application/json",
+			strings.NewReader(`{"identity":"peasant"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body := map[string]string{}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, body["nonce"], res.Header.Get(DefaultNonceHeader))
+	})
+
+	t.Run("POST without a valid challenge", func(t *testing.T) {
+		for _, challenge := range []string{"", "not json"} {
+			res, err := http.Post(server.URL, "application/json",
+				strings.NewReader(challenge))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		}
+	})
+
+	t.Run("POST to a service without challenges", func(t *testing.T) {
+		h := NewNonceHandler(struct{ NonceService }{
+			dummy.NewDummyInMemoryNonceService()})
+		res := httptest.NewRecorder()
+		h.GetNonce(res, httptest.NewRequest(http.MethodPost, "/new-nonce",
+			strings.NewReader(`{"identity":"peasant"}`)))
+		assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+	})
+}
+
+type FailingNonceService struct {
+	*dummy.DummyInMemoryNonceService
+	stage string
+}
+
+func (s *FailingNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	if s.stage == StageConsume {
+		return errors.New("consume failed")
+	}
+	return s.DummyInMemoryNonceService.Consume(w, r)
+}
+
+func (s *FailingNonceService) GetNonce(r *http.Request) (string, error) {
+	if s.stage == StageGetNonce {
+		return "", errors.New("get-nonce failed")
+	}
+	return s.DummyInMemoryNonceService.GetNonce(r)
+}
+
+func (s *FailingNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	if s.stage == StageProvided {
+		return errors.New("provided failed")
+	}
+	return s.DummyInMemoryNonceService.Provided(w, r)
+}
+
+func (s *FailingNonceService) Verify(r *http.Request) (bool, error) {
+	if s.stage == StageVerify {
+		return false, errors.New("verify failed")
+	}
+	return s.DummyInMemoryNonceService.Verify(r)
+}
+
+func TestWithErrorHandler(t *testing.T) {
+	done := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+	request := func(s *FailingNonceService) *http.Request {
+		s.Seed("a-nonce")
+		req := httptest.NewRequest(http.MethodPost, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, "a-nonce")
+		return req
+	}
+
+	t.Run("Bare 500 by default", func(t *testing.T) {
+		s := &FailingNonceService{
+			DummyInMemoryNonceService: dummy.NewDummyInMemoryNonceService(),
+			stage:                     StageConsume,
+		}
+		res := httptest.NewRecorder()
+		NoncedHandlerFunc(s, done)(res, request(s))
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+		assert.Empty(t, res.Body.String())
+	})
+
+	for _, stage := range []string{StageProvided, StageConsume,
+		StageGetNonce, StageVerify} {
+		stage := stage
+		t.Run("Error at the "+stage+" stage", func(t *testing.T) {
+			s := &FailingNonceService{
+				DummyInMemoryNonceService: dummy.NewDummyInMemoryNonceService(),
+				stage:                     stage,
+			}
+			var gotStage string
+			var gotErr error
+			eh := WithErrorHandler(func(w http.ResponseWriter,
+				r *http.Request, stage string, err error) {
+				gotStage = stage
+				gotErr = err
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(err.Error()))
+			})
+			h := NoncedHandlerFunc(s, done, eh)
+			if stage == StageVerify {
+				h = NoncedReadHandlerFunc(s, done, eh)
+			}
+			res := httptest.NewRecorder()
+			h(res, request(s))
+
+			assert.Equal(t, stage, gotStage)
+			assert.EqualError(t, gotErr, stage+" failed")
+			assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+			assert.Equal(t, stage+" failed", res.Body.String())
+		})
+	}
+}
+
+type CommittingNonceService struct {
+	*dummy.DummyInMemoryNonceService
+}
+
+func (s *CommittingNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	w.Write([]byte("partial response"))
+	return errors.New("provided failed")
+}
+
+func TestCommittedResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	handlerCalled := false
+	s := &CommittingNonceService{dummy.NewDummyInMemoryNonceService()}
+	h := NoncedHandlerFunc(s, func(w http.ResponseWriter, r *http.Request) {},
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request,
+			stage string, err error) {
+			handlerCalled = true
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+	res := httptest.NewRecorder()
+	h(res, httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil))
+
+	assert.False(t, handlerCalled)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "partial response", res.Body.String())
+	assert.Contains(t, buf.String(), "the nonce provided stage failed "+
+		"after the response was committed: provided failed")
+}
+
+func TestWithIssuePolicy(t *testing.T) {
+	request := func(s *dummy.DummyInMemoryNonceService,
+		h func(http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+		s.Seed("a-nonce")
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, "a-nonce")
+		h(res, req)
+		return res
+	}
+	fail := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	succeed := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+
+	t.Run("Issue only on success", func(t *testing.T) {
+		s := dummy.NewDummyInMemoryNonceService()
+		res := request(s, NoncedHandlerFunc(s, fail,
+			WithIssuePolicy(IssueOnSuccess)))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Empty(t, res.Header().Get(DefaultNonceHeader))
+		assert.Equal(t, uint64(0), s.Stats().Issued)
+
+		res = request(s, NoncedHandlerFunc(s, succeed,
+			WithIssuePolicy(IssueOnSuccess)))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Len(t, res.Header().Get(DefaultNonceHeader), 32)
+		assert.Equal(t, uint64(1), s.Stats().Issued)
+	})
+
+	t.Run("Issue only on request", func(t *testing.T) {
+		s := dummy.NewDummyInMemoryNonceService()
+		res := request(s, NoncedHandlerFunc(s, succeed,
+			WithIssuePolicy(IssueOnRequest)))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Empty(t, res.Header().Get(DefaultNonceHeader))
+		assert.Equal(t, uint64(0), s.Stats().Issued)
+
+		var issued string
+		res = request(s, NoncedHandlerFunc(s,
+			func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				issued, err = w.(*NoncedResponseWriter).IssueNonce()
+				if err != nil {
+					t.Error(err)
+				}
+				w.Write([]byte("done"))
+			}, WithIssuePolicy(IssueOnRequest)))
+		assert.Equal(t, issued, res.Header().Get(DefaultNonceHeader))
+		assert.Equal(t, uint64(1), s.Stats().Issued)
+	})
+
+	t.Run("Issue always by default", func(t *testing.T) {
+		s := dummy.NewDummyInMemoryNonceService()
+		res := request(s, NoncedHandlerFunc(s, fail))
+		assert.Len(t, res.Header().Get(DefaultNonceHeader), 32)
+		assert.Equal(t, uint64(1), s.Stats().Issued)
+	})
+}
+
+func TestWithTrailerNonce(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService(dummy.WithTTL(time.Minute))
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("chunk "))
+			err := http.NewResponseController(w).Flush()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(NoncedHandlerFunc(s,
+		stream, WithTrailerNonce(), WithIssuePolicy(IssueOnSuccess))))
+	defer server.Close()
+	get := func(query string) (*http.Response, string) {
+		err := s.Seed("seeded-nonce")
+		if err != nil {
+			t.Error(err)
+		}
+		req, err := http.NewRequest(http.MethodGet, server.URL+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(DefaultNonceHeader, "seeded-nonce")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		return res, string(b)
+	}
+
+	t.Run("Nonce in the trailer of a streamed response", func(t *testing.T) {
+		res, body := get("")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "chunk chunk chunk ", body)
+		assert.Empty(t, res.Header.Get(DefaultNonceHeader))
+		nonce := res.Trailer.Get(DefaultNonceHeader)
+		assert.Len(t, nonce, 32)
+		valid, err := s.Verify(func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(DefaultNonceHeader, nonce)
+			return req
+		}())
+		if err != nil {
+			t.Error(err)
+		}
+		assert.True(t, valid)
+	})
+
+	t.Run("No trailer on failure", func(t *testing.T) {
+		res, _ := get("?fail=true")
+		assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		assert.Empty(t, res.Trailer.Get(DefaultNonceHeader))
+	})
+}
+
+func TestWithStrictSkip(t *testing.T) {
+	s := dummy.NewDummyInMemoryNonceService()
+	logs := &bytes.Buffer{}
+	done := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}
+	skipAll := WithSkip(func(r *http.Request) bool {
+		return true
+	})
+	serve := func(h func(http.ResponseWriter, *http.Request)) int {
+		logs.Reset()
+		res := httptest.NewRecorder()
+		h(res, httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil))
+		return res.Code
+	}
+
+	t.Run("Warn when a skipped request requires a nonce", func(t *testing.T) {
+		h := NoncedHandlerFunc(s, NoncedHandlerFunc(s, done), skipAll,
+			WithStrictSkip(), WithLogger(log.New(logs, "", 0)))
+		assert.Equal(t, http.StatusForbidden, serve(h))
+		assert.Equal(t, "peasant: the request to /do-nonced-something was "+
+			"skipped but a nonce was required by the handler\n", logs.String())
+	})
+
+	t.Run("Skipped request not requiring a nonce", func(t *testing.T) {
+		h := NoncedHandlerFunc(s, done, skipAll, WithStrictSkip(),
+			WithLogger(log.New(logs, "", 0)))
+		assert.Equal(t, http.StatusOK, serve(h))
+		assert.Empty(t, logs.String())
+	})
+
+	t.Run("No check without the strict skip", func(t *testing.T) {
+		h := NoncedHandlerFunc(s, NoncedHandlerFunc(s, done), skipAll,
+			WithLogger(log.New(logs, "", 0)))
+		assert.Equal(t, http.StatusForbidden, serve(h))
+		assert.Empty(t, logs.String())
+	})
+}
+
+func TestDirectoryHandler(t *testing.T) {
+	serve := func(h http.Handler) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodGet,
+			"http://bastion/directory", nil))
+		return res
+	}
+
+	t.Run("Static directory", func(t *testing.T) {
+		res := serve(DirectoryHandler(map[string]any{
+			"newNonce": "http://bastion/new-nonce",
+		}))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"newNonce": "http://bastion/new-nonce"}`,
+			res.Body.String())
+	})
+
+	t.Run("Dynamic directory", func(t *testing.T) {
+		res := serve(DirectoryHandlerFunc(func(r *http.Request) (
+			map[string]any, error) {
+			return map[string]any{
+				"newNonce": "http://" + r.Host + "/dynamic-nonce",
+			}, nil
+		}))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.JSONEq(t, `{"newNonce": "http://bastion/dynamic-nonce"}`,
+			res.Body.String())
+	})
+
+	t.Run("Directory error", func(t *testing.T) {
+		res := serve(DirectoryHandlerFunc(func(r *http.Request) (
+			map[string]any, error) {
+			return nil, errors.New("directory unavailable")
+		}))
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+	})
+
+	t.Run("Marshal error", func(t *testing.T) {
+		res := serve(DirectoryHandler(map[string]any{
+			"newNonce": func() {},
+		}))
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+		assert.Empty(t, res.Header().Get("Content-Type"))
+	})
+}
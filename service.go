@@ -16,8 +16,33 @@ package peasant
 
 import (
 	"net/http"
+	"time"
 )
 
+// DefaultNonceHeader is the header used to exchange nonces between peasants
+// and bastions when no other key is configured. HTTP header names are
+// case-insensitive, Header.Get and Header.Set canonicalize them, so "nonce"
+// and "Nonce" refer to the same header.
+const DefaultNonceHeader = "Nonce"
+
+// NonceEpochHeader carries the bastion nonce epoch. Bastions change the epoch
+// when previously issued nonces become invalid, like after rotating the
+// SignedNonceService key, and peasants flush their Pool when they see it
+// change.
+const NonceEpochHeader = "Nonce-Epoch"
+
+// Clock provides the current time to services and providers, so expiry can be
+// tested deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
 // NonceService defines methods for managing nonces in HTTP requests.
 // It provides functionality for blocking, clearing, consuming, getting,
 // and checking the provision of nonces.
@@ -57,3 +82,50 @@ type NonceService interface {
 	// error code.
 	Provided(http.ResponseWriter, *http.Request) error
 }
+
+// VerifyingNonceService is a NonceService able to check a nonce without
+// consuming it.
+type VerifyingNonceService interface {
+	NonceService
+
+	// Verify reports if the nonce provided in the request is valid, without
+	// consuming it.
+	Verify(*http.Request) (bool, error)
+}
+
+// ChallengeNonceService is a NonceService able to issue nonces bound to
+// a challenge posted by the client, like its identity.
+type ChallengeNonceService interface {
+	NonceService
+
+	// GetBoundNonce generates a new nonce bound to the challenge, and stores
+	// it for a future validation.
+	GetBoundNonce(*http.Request, []byte) (string, error)
+}
+
+// AgingNonceService is a NonceService able to tell the age of the nonce
+// carried by a request, used by MaxNonceAge to reject old nonces.
+type AgingNonceService interface {
+	NonceService
+
+	// NonceAge returns the time since the nonce carried by the request was
+	// issued. It returns false if the nonce is unknown or invalid.
+	NonceAge(*http.Request) (time.Duration, bool)
+}
+
+// CheckingNonceService is a NonceService whose checks can run without a
+// response writer, letting the nonce logic be used out of an HTTP handler,
+// like in a message queue consumer. Provided and Consume wrap these methods,
+// translating their results into response statuses.
+type CheckingNonceService interface {
+	NonceService
+
+	// CheckProvided returns an error if the request doesn't carry a usable
+	// nonce.
+	CheckProvided(*http.Request) error
+
+	// TryConsume consumes the nonce carried by the request, reporting if it
+	// was consumed. An error is returned only if the request is malformed or
+	// the service fails.
+	TryConsume(*http.Request) (bool, error)
+}
@@ -0,0 +1,196 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+const shardedNonceSize = 24
+
+// NonceStore stores outstanding nonces. It is satisfied by
+// dummy.DummyInMemoryNonceService.
+type NonceStore interface {
+	// Put stores the nonce as outstanding.
+	Put(nonce string) error
+	// Take removes the nonce, reporting if it was outstanding and valid.
+	Take(nonce string) (bool, error)
+}
+
+// ShardedNonceService implements the NonceService interface spreading the
+// nonces over many NonceStore shards, distributing memory and lock
+// contention. The shard of a nonce is derived from the nonce itself with
+// rendezvous hashing, so Consume reaches the shard the nonce was stored in.
+//
+// Shards are hashed by index unless ShardIDs names them. Adding or removing
+// the last shard only moves the nonces of that shard, but removing another
+// one renumbers the following shards, moving their nonces too. Name the
+// shards with ShardIDs so any shard can be added or removed moving only its
+// nonces.
+type ShardedNonceService struct {
+	// Extractor reads the nonce from the request. If nil the nonce is read
+	// from the HeaderKey header.
+	Extractor NonceExtractor
+	// HeaderKey is the header the nonce is read from.
+	HeaderKey string
+	// ShardIDs, if set, are the stable ids of the Shards, by index, hashed
+	// instead of the shard indexes.
+	ShardIDs []string
+	// Shards store the nonces.
+	Shards []NonceStore
+	// SkipFunc reports if a request should not be nonced. If nil no request
+	// is skipped.
+	SkipFunc func(*http.Request) bool
+}
+
+// NewShardedNonceService initializes a new ShardedNonceService over the
+// given shards.
+func NewShardedNonceService(shards ...NonceStore) *ShardedNonceService {
+	return &ShardedNonceService{
+		HeaderKey: DefaultNonceHeader,
+		Shards:    shards,
+	}
+}
+
+func (s *ShardedNonceService) Block(w http.ResponseWriter,
+	r *http.Request) error {
+	return nil
+}
+
+// Clear removes the nonce from its shard.
+func (s *ShardedNonceService) Clear(nonce string) error {
+	shard, err := s.Shard(nonce)
+	if err != nil {
+		return err
+	}
+	_, err = shard.Take(nonce)
+	return err
+}
+
+// Consume takes the nonce from its shard. Unknown or expired nonces are
+// rejected with a forbidden status.
+func (s *ShardedNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	nonce := s.nonce(r)
+	if nonce == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	shard, err := s.Shard(nonce)
+	if err != nil {
+		return err
+	}
+	ok, err := shard.Take(nonce)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return nil
+}
+
+// GetNonce generates a new nonce and stores it in its shard.
+func (s *ShardedNonceService) GetNonce(r *http.Request) (string, error) {
+	if len(s.Shards) == 0 {
+		return "", ErrNoShards
+	}
+	b := make([]byte, shardedNonceSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	shard, err := s.Shard(nonce)
+	if err != nil {
+		return "", err
+	}
+	err = shard.Put(nonce)
+	if err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// Provided checks the request carries a nonce, otherwise the response status
+// is set to forbidden.
+func (s *ShardedNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	if s.nonce(r) == "" {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return nil
+}
+
+// Shard returns the shard the nonce is stored in, the one scoring the
+// highest hash of the nonce and the shard id, or index. It returns
+// ErrNoShards if there are no shards.
+func (s *ShardedNonceService) Shard(nonce string) (NonceStore, error) {
+	if len(s.Shards) == 0 {
+		return nil, ErrNoShards
+	}
+	if s.ShardIDs != nil && len(s.ShardIDs) != len(s.Shards) {
+		return nil, fmt.Errorf("the sharded nonce service has %d shard "+
+			"ids for %d shards", len(s.ShardIDs), len(s.Shards))
+	}
+	best := 0
+	var bestScore uint64
+	for i := range s.Shards {
+		h := fnv.New64a()
+		if s.ShardIDs != nil {
+			h.Write([]byte(s.ShardIDs[i]))
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte{byte(i >> 8), byte(i)})
+		}
+		h.Write([]byte(nonce))
+		score := mix(h.Sum64())
+		if i == 0 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return s.Shards[best], nil
+}
+
+// Skip reports if the request should not be nonced according to SkipFunc.
+func (s *ShardedNonceService) Skip(r *http.Request) bool {
+	if s.SkipFunc == nil {
+		return false
+	}
+	return s.SkipFunc(r)
+}
+
+// mix finalizes a hash with the splitmix64 finalizer, so the scores of keys
+// differing only in a prefix, like the shard id, aren't correlated.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func (s *ShardedNonceService) nonce(r *http.Request) string {
+	if s.Extractor != nil {
+		return s.Extractor(r)
+	}
+	return r.Header.Get(s.HeaderKey)
+}
@@ -0,0 +1,132 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedNonceService(t *testing.T) {
+	shards := []*dummy.DummyInMemoryNonceService{}
+	stores := []NonceStore{}
+	for i := 0; i < 4; i++ {
+		shard := dummy.NewDummyInMemoryNonceService(
+			dummy.WithTTL(time.Minute))
+		shards = append(shards, shard)
+		stores = append(stores, shard)
+	}
+	s := NewShardedNonceService(stores...)
+	get := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+	consume := func(nonce string) int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		err := s.Consume(res, req)
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		return res.Code
+	}
+
+	t.Run("Consume from the storing shard", func(t *testing.T) {
+		nonce, err := s.GetNonce(get)
+		if err != nil {
+			t.Error(err)
+		}
+		held := 0
+		for _, shard := range shards {
+			held += shard.Outstanding()
+		}
+		assert.Equal(t, 1, held)
+		shard, err := s.Shard(nonce)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, 1, shard.(*dummy.DummyInMemoryNonceService).
+			Outstanding())
+		assert.Equal(t, http.StatusOK, consume(nonce))
+		assert.Equal(t, http.StatusForbidden, consume(nonce))
+		assert.Equal(t, http.StatusForbidden, consume(""))
+	})
+
+	t.Run("Spread the load across shards", func(t *testing.T) {
+		for i := 0; i < 400; i++ {
+			_, err := s.GetNonce(get)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, shard := range shards {
+			assert.Greater(t, shard.Outstanding(), 50)
+		}
+	})
+
+	t.Run("No shards", func(t *testing.T) {
+		s := NewShardedNonceService()
+		_, err := s.GetNonce(get)
+		assert.ErrorIs(t, err, ErrNoShards)
+		req := httptest.NewRequest(http.MethodGet, "/do-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, "a-nonce")
+		assert.ErrorIs(t, s.Consume(httptest.NewRecorder(), req),
+			ErrNoShards)
+		assert.ErrorIs(t, s.Clear("a-nonce"), ErrNoShards)
+	})
+
+	t.Run("Mismatched shard ids", func(t *testing.T) {
+		s := NewShardedNonceService(stores...)
+		s.ShardIDs = []string{"a", "b"}
+		_, err := s.Shard("a-nonce")
+		assert.Error(t, err)
+	})
+}
+
+func TestShardIDs(t *testing.T) {
+	stores := []NonceStore{}
+	for i := 0; i < 4; i++ {
+		stores = append(stores, dummy.NewDummyInMemoryNonceService())
+	}
+	ids := []string{"a", "b", "c", "d"}
+	s := NewShardedNonceService(stores...)
+	s.ShardIDs = ids
+	removed := NewShardedNonceService(stores[0], stores[2], stores[3])
+	removed.ShardIDs = []string{"a", "c", "d"}
+	moved := 0
+	for i := 0; i < 400; i++ {
+		nonce := "nonce-" + strconv.Itoa(i)
+		before, err := s.Shard(nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := removed.Shard(nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before == stores[1] {
+			moved++
+			continue
+		}
+		assert.True(t, before == after)
+	}
+	assert.Greater(t, moved, 50)
+}
@@ -0,0 +1,209 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const signedNonceIdSize = 16
+
+// SignedNonceService implements the NonceService interface issuing HMAC
+// signed nonces that carry their own unique id and expiry. Any instance
+// sharing the Key validates a nonce without a shared store, only Consume
+// keeps a replay cache of the ids spent until they expire.
+type SignedNonceService struct {
+	// Clock provides the time used to stamp and check expiries.
+	Clock Clock
+	// ClockSkew is the tolerance added to the expiry when checking a nonce,
+	// so a nonce issued by an instance whose clock runs behind isn't
+	// rejected too early. Spent ids are kept until the tolerance passes too.
+	ClockSkew time.Duration
+	// Extractor reads the nonce from the request. If nil the nonce is read
+	// from the HeaderKey header.
+	Extractor NonceExtractor
+	// HeaderKey is the header the nonce is read from.
+	HeaderKey string
+	// Key is the HMAC key used to sign the nonces.
+	Key []byte
+	// SkipFunc reports if a request should not be nonced. If nil no request
+	// is skipped.
+	SkipFunc func(*http.Request) bool
+	// TTL is how long a nonce is valid after being issued.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	spent *nonceTracker[struct{}]
+}
+
+// NewSignedNonceService initializes a new SignedNonceService signing nonces
+// with the given key, valid for the given ttl.
+func NewSignedNonceService(key []byte,
+	ttl time.Duration) *SignedNonceService {
+	return &SignedNonceService{
+		Clock:     systemClock{},
+		HeaderKey: DefaultNonceHeader,
+		Key:       key,
+		TTL:       ttl,
+		spent:     newNonceTracker[struct{}](),
+	}
+}
+
+func (s *SignedNonceService) Block(w http.ResponseWriter,
+	r *http.Request) error {
+	return nil
+}
+
+// Clear marks the nonce as spent so it can't be consumed anymore. Invalid
+// nonces are ignored.
+func (s *SignedNonceService) Clear(nonce string) error {
+	id, expiry, err := s.verify(nonce)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spent.putUntil(id, struct{}{}, s.Clock.Now(), expiry)
+	return nil
+}
+
+// Consume validates the nonce signature and expiry and records its id in the
+// replay cache. Nonces already spent are rejected with a forbidden status.
+// The replay cache is kept in expiry order, so only the expired ids are
+// swept.
+func (s *SignedNonceService) Consume(w http.ResponseWriter,
+	r *http.Request) error {
+	id, expiry, err := s.verify(s.nonce(r))
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.spent.get(id, now)
+	if ok {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	s.spent.putUntil(id, struct{}{}, now, expiry)
+	return nil
+}
+
+// GetNonce issues a new signed nonce.
+func (s *SignedNonceService) GetNonce(r *http.Request) (string, error) {
+	payload := make([]byte, signedNonceIdSize+8)
+	_, err := rand.Read(payload[:signedNonceIdSize])
+	if err != nil {
+		return "", err
+	}
+	expiry := s.Clock.Now().Add(s.TTL)
+	binary.BigEndian.PutUint64(payload[signedNonceIdSize:],
+		uint64(expiry.UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.sign(payload)), nil
+}
+
+// Skip reports if the request should not be nonced according to SkipFunc.
+func (s *SignedNonceService) Skip(r *http.Request) bool {
+	if s.SkipFunc == nil {
+		return false
+	}
+	return s.SkipFunc(r)
+}
+
+// Provided checks the request carries a nonce with a valid signature that
+// didn't expire, otherwise the response status is set to forbidden.
+func (s *SignedNonceService) Provided(w http.ResponseWriter,
+	r *http.Request) error {
+	_, _, err := s.verify(s.nonce(r))
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return nil
+}
+
+// Verify reports if the nonce provided in the request has a valid signature,
+// didn't expire and wasn't spent, without consuming it.
+func (s *SignedNonceService) Verify(r *http.Request) (bool, error) {
+	id, _, err := s.verify(s.nonce(r))
+	if err != nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, spent := s.spent.get(id, s.Clock.Now())
+	return !spent, nil
+}
+
+// NonceAge returns the age of the valid nonce carried by the request. The
+// issue time is derived from the expiry signed in the nonce, so it is only
+// accurate if every instance shares the TTL.
+func (s *SignedNonceService) NonceAge(r *http.Request) (time.Duration,
+	bool) {
+	_, expiry, err := s.verify(s.nonce(r))
+	if err != nil {
+		return 0, false
+	}
+	return s.Clock.Now().Sub(expiry.Add(-s.ClockSkew - s.TTL)), true
+}
+
+func (s *SignedNonceService) nonce(r *http.Request) string {
+	if s.Extractor != nil {
+		return s.Extractor(r)
+	}
+	return r.Header.Get(s.HeaderKey)
+}
+
+func (s *SignedNonceService) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// verify checks the nonce signature and expiry, returning the nonce id and
+// expiry, extended by the ClockSkew.
+func (s *SignedNonceService) verify(nonce string) (string, time.Time,
+	error) {
+	encodedPayload, encodedSig, ok := strings.Cut(nonce, ".")
+	if !ok {
+		return "", time.Time{}, errors.New("malformed nonce")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) != signedNonceIdSize+8 {
+		return "", time.Time{}, errors.New("malformed nonce")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return "", time.Time{}, errors.New("invalid nonce signature")
+	}
+	expiry := time.Unix(0,
+		int64(binary.BigEndian.Uint64(payload[signedNonceIdSize:]))).Add(
+		s.ClockSkew)
+	if !s.Clock.Now().Before(expiry) {
+		return "", time.Time{}, errors.New("expired nonce")
+	}
+	return hex.EncodeToString(payload[:signedNonceIdSize]), expiry, nil
+}
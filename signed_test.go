@@ -0,0 +1,199 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/candango/gopeasant/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewSignedServeMux(t *testing.T, s NonceService) *http.ServeMux {
+	nonced := NewNoncedHandler(s)
+	h := http.NewServeMux()
+	h.HandleFunc("/do-nonced-something",
+		NoncedHandlerFunc(s, nonced.DoNoncedFunc))
+	return h
+}
+
+func doNoncedSomething(h http.Handler, nonce string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/do-nonced-something", nil)
+	req.Header.Set(DefaultNonceHeader, nonce)
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestSignedNonceService(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+
+	t.Run("Valid nonce", func(t *testing.T) {
+		s := NewSignedNonceService([]byte("secret"), time.Minute)
+		h := NewSignedServeMux(t, s)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		res := doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "Func done with nonce "+nonce, res.Body.String())
+		assert.NotEmpty(t, res.Header().Get(DefaultNonceHeader))
+	})
+
+	t.Run("Valid nonce on another instance", func(t *testing.T) {
+		s := NewSignedNonceService([]byte("secret"), time.Minute)
+		other := NewSignedNonceService([]byte("secret"), time.Minute)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		res := doNoncedSomething(NewSignedServeMux(t, other), nonce)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+
+	t.Run("Tampered nonce", func(t *testing.T) {
+		s := NewSignedNonceService([]byte("secret"), time.Minute)
+		h := NewSignedServeMux(t, s)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		tampered := []byte(nonce)
+		if tampered[0] == 'A' {
+			tampered[0] = 'B'
+		} else {
+			tampered[0] = 'A'
+		}
+		res := doNoncedSomething(h, string(tampered))
+		assert.Equal(t, http.StatusForbidden, res.Code)
+
+		other := NewSignedNonceService([]byte("other secret"), time.Minute)
+		nonce, err = other.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		res = doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Expired nonce", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewSignedNonceService([]byte("secret"), time.Minute)
+		s.Clock = clock
+		h := NewSignedServeMux(t, s)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute)
+		res := doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Replayed nonce", func(t *testing.T) {
+		s := NewSignedNonceService([]byte("secret"), time.Minute)
+		h := NewSignedServeMux(t, s)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		res := doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusOK, res.Code)
+		res = doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Replay cache drops expired ids", func(t *testing.T) {
+		clock := dummy.NewFakeClock(time.Now())
+		s := NewSignedNonceService([]byte("secret"), time.Minute)
+		s.Clock = clock
+		h := NewSignedServeMux(t, s)
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		doNoncedSomething(h, nonce)
+		assert.Equal(t, 1, s.spent.len())
+		clock.Advance(time.Minute)
+		nonce, err = s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		doNoncedSomething(h, nonce)
+		assert.Equal(t, 1, s.spent.len())
+	})
+}
+
+func TestSignedNonceServiceClockSkew(t *testing.T) {
+	req := httptest.NewRequest(http.MethodHead, "/new-nonce", nil)
+	clock := dummy.NewFakeClock(time.Now())
+	s := NewSignedNonceService([]byte("secret"), time.Minute)
+	s.Clock = clock
+	s.ClockSkew = 500 * time.Millisecond
+	h := NewSignedServeMux(t, s)
+
+	t.Run("Expired within the tolerance", func(t *testing.T) {
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute + 300*time.Millisecond)
+		res := doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusOK, res.Code)
+		res = doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Expired beyond the tolerance", func(t *testing.T) {
+		nonce, err := s.GetNonce(req)
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute + 500*time.Millisecond)
+		res := doNoncedSomething(h, nonce)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+}
+
+func TestSignedNonceServiceVerify(t *testing.T) {
+	s := NewSignedNonceService([]byte("secret"), time.Minute)
+	h := http.NewServeMux()
+	nonced := NewNoncedHandler(s)
+	h.HandleFunc("/do-nonced-something",
+		NoncedHandlerFunc(s, nonced.DoNoncedFunc))
+	h.HandleFunc("/verify-nonced-something",
+		NoncedReadHandlerFunc(s, nonced.DoNoncedFunc))
+	nonce, err := s.GetNonce(nil)
+	if err != nil {
+		t.Error(err)
+	}
+	verify := func() int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/verify-nonced-something",
+			nil)
+		req.Header.Set(DefaultNonceHeader, nonce)
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	assert.Equal(t, http.StatusOK, verify())
+	assert.Equal(t, http.StatusOK, verify())
+	assert.Equal(t, http.StatusOK, doNoncedSomething(h, nonce).Code)
+	assert.Equal(t, http.StatusForbidden, verify())
+}
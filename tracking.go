@@ -0,0 +1,124 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"container/list"
+	"time"
+)
+
+// DefaultTrackingTTL is how long the services decorating another one track
+// a nonce when no TTL is set. It should be at least the TTL of the nonces
+// issued by the wrapped service.
+const DefaultTrackingTTL = 5 * time.Minute
+
+// nonceTracker maps nonces to values until they expire, so the services
+// drop the state of the nonces never presented without scanning every
+// tracked one. It isn't safe for concurrent use.
+type nonceTracker[V any] struct {
+	entries map[string]*list.Element
+	// order keeps the entries ordered by expiry, so sweeping stops at the
+	// first entry not expired.
+	order *list.List
+}
+
+// trackedEntry is a tracked nonce, its value and expiry.
+type trackedEntry[V any] struct {
+	nonce  string
+	value  V
+	expiry time.Time
+}
+
+// newNonceTracker initializes a new empty nonceTracker.
+func newNonceTracker[V any]() *nonceTracker[V] {
+	return &nonceTracker[V]{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value of the nonce, if tracked and not expired.
+func (t *nonceTracker[V]) get(nonce string, now time.Time) (V, bool) {
+	t.sweep(now)
+	e, ok := t.entries[nonce]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return e.Value.(*trackedEntry[V]).value, true
+}
+
+// len returns the number of tracked nonces, including the expired ones not
+// swept yet.
+func (t *nonceTracker[V]) len() int {
+	return t.order.Len()
+}
+
+// put tracks the nonce with the value from now until the ttl elapses,
+// replacing any previous value.
+func (t *nonceTracker[V]) put(nonce string, value V, now time.Time,
+	ttl time.Duration) {
+	t.putUntil(nonce, value, now, now.Add(ttl))
+}
+
+// putUntil tracks the nonce with the value until the expiry, replacing any
+// previous value. The entry is inserted searching from the newest one, as
+// expiries are mostly put in order.
+func (t *nonceTracker[V]) putUntil(nonce string, value V, now time.Time,
+	expiry time.Time) {
+	t.sweep(now)
+	t.take(nonce, now)
+	entry := &trackedEntry[V]{
+		nonce:  nonce,
+		value:  value,
+		expiry: expiry,
+	}
+	for e := t.order.Back(); e != nil; e = e.Prev() {
+		if !expiry.Before(e.Value.(*trackedEntry[V]).expiry) {
+			t.entries[nonce] = t.order.InsertAfter(entry, e)
+			return
+		}
+	}
+	t.entries[nonce] = t.order.PushFront(entry)
+}
+
+// sweep drops the expired nonces.
+func (t *nonceTracker[V]) sweep(now time.Time) {
+	for e := t.order.Front(); e != nil; e = t.order.Front() {
+		entry := e.Value.(*trackedEntry[V])
+		if now.Before(entry.expiry) {
+			return
+		}
+		t.order.Remove(e)
+		delete(t.entries, entry.nonce)
+	}
+}
+
+// take stops tracking the nonce, returning its value if it was tracked and
+// not expired.
+func (t *nonceTracker[V]) take(nonce string, now time.Time) (V, bool) {
+	var zero V
+	e, ok := t.entries[nonce]
+	if !ok {
+		return zero, false
+	}
+	t.order.Remove(e)
+	delete(t.entries, nonce)
+	entry := e.Value.(*trackedEntry[V])
+	if !now.Before(entry.expiry) {
+		return zero, false
+	}
+	return entry.value, true
+}
@@ -0,0 +1,78 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceTracker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Get and take", func(t *testing.T) {
+		tr := newNonceTracker[string]()
+		tr.put("a-nonce", "billing", now, time.Minute)
+		v, ok := tr.get("a-nonce", now)
+		assert.True(t, ok)
+		assert.Equal(t, "billing", v)
+		v, ok = tr.take("a-nonce", now)
+		assert.True(t, ok)
+		assert.Equal(t, "billing", v)
+		_, ok = tr.get("a-nonce", now)
+		assert.False(t, ok)
+		assert.Equal(t, 0, tr.len())
+	})
+
+	t.Run("Expired nonces swept", func(t *testing.T) {
+		tr := newNonceTracker[struct{}]()
+		tr.put("old-nonce", struct{}{}, now, time.Minute)
+		tr.put("new-nonce", struct{}{}, now.Add(30*time.Second),
+			time.Minute)
+		_, ok := tr.get("old-nonce", now.Add(time.Minute))
+		assert.False(t, ok)
+		assert.Equal(t, 1, tr.len())
+		_, ok = tr.take("new-nonce", now.Add(time.Minute))
+		assert.True(t, ok)
+		tr.put("a-nonce", struct{}{}, now, time.Minute)
+		_, ok = tr.take("a-nonce", now.Add(time.Minute))
+		assert.False(t, ok)
+		assert.Equal(t, 0, tr.len())
+	})
+
+	t.Run("Put replaces the value", func(t *testing.T) {
+		tr := newNonceTracker[string]()
+		tr.put("a-nonce", "billing", now, time.Minute)
+		tr.put("a-nonce", "admin", now.Add(30*time.Second), time.Minute)
+		v, ok := tr.get("a-nonce", now.Add(time.Minute))
+		assert.True(t, ok)
+		assert.Equal(t, "admin", v)
+		assert.Equal(t, 1, tr.len())
+	})
+
+	t.Run("Put until keeps the expiry order", func(t *testing.T) {
+		tr := newNonceTracker[struct{}]()
+		tr.putUntil("late-nonce", struct{}{}, now, now.Add(2*time.Minute))
+		tr.putUntil("early-nonce", struct{}{}, now, now.Add(time.Minute))
+		tr.sweep(now.Add(time.Minute))
+		_, ok := tr.get("early-nonce", now.Add(time.Minute))
+		assert.False(t, ok)
+		_, ok = tr.get("late-nonce", now.Add(time.Minute))
+		assert.True(t, ok)
+		assert.Equal(t, 1, tr.len())
+	})
+}
@@ -0,0 +1,431 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsGuid           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxPayloadSize = 1 << 20
+)
+
+// WebSocketTransport implements the Transport interface receiving a stream of
+// pre-issued nonces from a bastion over a persistent WebSocket connection.
+// Each text message pushed by the bastion is a nonce. NewNonce is served from
+// a local buffer filled by the socket, so no request is made per nonce.
+//
+// The directory is resolved by the DirectoryProvider, usually an
+// HttpDirectoryProvider.
+type WebSocketTransport struct {
+	// DirectoryProvider resolves the bastion directory.
+	DirectoryProvider DirectoryProvider
+	// Url is the ws:// or wss:// URL nonces are pushed from.
+	Url string
+	// BufferSize is the number of nonces buffered locally.
+	BufferSize int
+	// DialTimeout bounds the connection and the WebSocket handshake. Zero
+	// means no timeout, the dial being only interrupted by Close.
+	DialTimeout time.Duration
+	// MinBackoff is the delay before the first reconnection attempt.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between reconnection attempts.
+	MaxBackoff time.Duration
+	// Timeout is how long NewNonce waits for a nonce to arrive.
+	Timeout time.Duration
+
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	conn      *wsConn
+	ctx       context.Context
+	done      <-chan struct{}
+	mu        sync.Mutex
+	nonces    chan string
+	setupOnce sync.Once
+	startOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewWebSocketTransport initializes a new WebSocketTransport with the given
+// WebSocket URL and the DirectoryProvider used to resolve the directory.
+func NewWebSocketTransport(url string,
+	dp DirectoryProvider) *WebSocketTransport {
+	return &WebSocketTransport{
+		DirectoryProvider: dp,
+		Url:               url,
+		BufferSize:        32,
+		DialTimeout:       10 * time.Second,
+		MinBackoff:        100 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+		Timeout:           30 * time.Second,
+	}
+}
+
+// setup initializes the state cancelled by Close, so a zero value transport
+// can be closed.
+func (wt *WebSocketTransport) setup() {
+	wt.setupOnce.Do(func() {
+		wt.ctx, wt.cancel = context.WithCancel(context.Background())
+		wt.done = wt.ctx.Done()
+	})
+}
+
+// Directory returns the directory resolved by the DirectoryProvider.
+func (wt *WebSocketTransport) Directory() (map[string]interface{}, error) {
+	if wt.DirectoryProvider == nil {
+		return nil, errors.New("websocket transport has no directory provider")
+	}
+	return wt.DirectoryProvider.Directory()
+}
+
+// NewNonce returns the next nonce pushed by the bastion. The connection is
+// opened on the first call and kept open, reconnecting with backoff if it
+// drops.
+func (wt *WebSocketTransport) NewNonce() (string, error) {
+	wt.setup()
+	select {
+	case <-wt.done:
+		return "", errors.New("websocket transport is closed")
+	default:
+	}
+	wt.startOnce.Do(func() {
+		wt.nonces = make(chan string, wt.BufferSize)
+		wt.wg.Add(1)
+		go wt.run()
+	})
+	timer := time.NewTimer(wt.Timeout)
+	defer timer.Stop()
+	select {
+	case nonce := <-wt.nonces:
+		return nonce, nil
+	case <-wt.done:
+		return "", errors.New("websocket transport is closed")
+	case <-timer.C:
+		return "", errors.New("timed out waiting for a nonce")
+	}
+}
+
+// Close closes the WebSocket connection, interrupting any dial in progress,
+// and stops reconnecting.
+func (wt *WebSocketTransport) Close() error {
+	wt.setup()
+	wt.closeOnce.Do(func() {
+		wt.cancel()
+		wt.mu.Lock()
+		if wt.conn != nil {
+			wt.conn.Close()
+		}
+		wt.mu.Unlock()
+	})
+	wt.wg.Wait()
+	return nil
+}
+
+func (wt *WebSocketTransport) run() {
+	defer wt.wg.Done()
+	backoff := wt.MinBackoff
+	for {
+		conn, err := dialWebSocket(wt.ctx, wt.Url, wt.DialTimeout)
+		if err == nil {
+			backoff = wt.MinBackoff
+			wt.receive(conn)
+		}
+		select {
+		case <-wt.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > wt.MaxBackoff {
+			backoff = wt.MaxBackoff
+		}
+	}
+}
+
+func (wt *WebSocketTransport) receive(conn *wsConn) {
+	wt.mu.Lock()
+	select {
+	case <-wt.done:
+		wt.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	wt.conn = conn
+	wt.mu.Unlock()
+	defer func() {
+		wt.mu.Lock()
+		wt.conn = nil
+		wt.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		op, msg, err := conn.readMessage()
+		if err != nil {
+			return
+		}
+		if op != wsText {
+			continue
+		}
+		nonce := strings.TrimSpace(string(msg))
+		if nonce == "" {
+			continue
+		}
+		select {
+		case wt.nonces <- nonce:
+		case <-wt.done:
+			return
+		}
+	}
+}
+
+// wsConn is a minimal client side WebSocket connection, enough to receive
+// text messages and answer control frames.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// dialWebSocket opens the WebSocket connection. The connection and the
+// handshake are bounded by the timeout, if positive, and interrupted when the
+// context is done.
+func dialWebSocket(ctx context.Context, rawUrl string,
+	timeout time.Duration) (*wsConn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.DialContext(ctx, "tcp", hostWithPort(u, "80"))
+	case "wss":
+		conn, err = (&tls.Dialer{
+			NetDialer: dialer,
+			Config:    &tls.Config{ServerName: u.Hostname()},
+		}).DialContext(ctx, "tcp", hostWithPort(u, "443"))
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	// The handshake isn't context aware, so the connection is closed if the
+	// context is done before it completes.
+	handshaken := make(chan struct{})
+	defer close(handshaken)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshaken:
+		}
+	}()
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, newStatusError(res)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, errors.New("invalid websocket accept key")
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn, br}, nil
+}
+
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// readMessage reads the next data message, answering pings and reassembling
+// fragmented messages along the way.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var msg []byte
+	var op byte
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsContinuation:
+			msg = append(msg, payload...)
+		default:
+			op = frameOp
+			msg = payload
+		}
+		if len(msg) > wsMaxPayloadSize {
+			return 0, nil, errors.New("websocket message too large")
+		}
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.br, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	op := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		b := make([]byte, 2)
+		_, err = io.ReadFull(c.br, b)
+		size = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		_, err = io.ReadFull(c.br, b)
+		size = binary.BigEndian.Uint64(b)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if size > wsMaxPayloadSize {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(c.br, mask)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(c.br, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes a single masked frame, as required for frames sent by
+// a client.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	size := len(payload)
+	switch {
+	case size < 126:
+		frame = append(frame, 0x80|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(size))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(size))
+	}
+	mask := make([]byte, 4)
+	_, err := rand.Read(mask)
+	if err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err = c.Conn.Write(frame)
+	return err
+}
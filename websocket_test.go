@@ -0,0 +1,200 @@
+// Copyright 2023-2024 Flavio Garcia
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peasant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// NewNoncePushServer returns a server pushing perConn nonces on each
+// WebSocket connection. If hangup is true the server closes the connection
+// after pushing, otherwise it keeps it open until the client goes away.
+func NewNoncePushServer(t *testing.T, perConn int, hangup bool,
+	conns *int32) *httptest.Server {
+	var sent int32
+	handler := http.NewServeMux()
+	handler.HandleFunc("/directory",
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"newNonce": "ws://bastion/nonces",
+			})
+		})
+	handler.HandleFunc("/nonces", func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(conns, 1)
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+		for i := 0; i < perConn; i++ {
+			nonce := fmt.Sprintf("nonce-%d", atomic.AddInt32(&sent, 1))
+			buf.Write([]byte{0x80 | wsText, byte(len(nonce))})
+			buf.WriteString(nonce)
+		}
+		buf.Flush()
+		if hangup {
+			return
+		}
+		io.Copy(io.Discard, buf)
+	})
+	return httptest.NewServer(handler)
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	t.Run("Nonces served from the socket buffer", func(t *testing.T) {
+		var conns int32
+		server := NewNoncePushServer(t, 3, false, &conns)
+		defer server.Close()
+
+		wt := NewWebSocketTransport(
+			"ws"+strings.TrimPrefix(server.URL, "http")+"/nonces", nil)
+		defer wt.Close()
+		for i := 1; i <= 3; i++ {
+			nonce, err := wt.NewNonce()
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, fmt.Sprintf("nonce-%d", i), nonce)
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+	})
+
+	t.Run("Reconnect when the connection drops", func(t *testing.T) {
+		var conns int32
+		server := NewNoncePushServer(t, 2, true, &conns)
+		defer server.Close()
+
+		wt := NewWebSocketTransport(
+			"ws"+strings.TrimPrefix(server.URL, "http")+"/nonces", nil)
+		wt.MinBackoff = 10 * time.Millisecond
+		defer wt.Close()
+		for i := 1; i <= 4; i++ {
+			nonce, err := wt.NewNonce()
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, fmt.Sprintf("nonce-%d", i), nonce)
+		}
+		assert.GreaterOrEqual(t, atomic.LoadInt32(&conns), int32(2))
+	})
+
+	t.Run("Directory from the fallback provider", func(t *testing.T) {
+		var conns int32
+		server := NewNoncePushServer(t, 0, false, &conns)
+		defer server.Close()
+
+		dp := NewHttpDirectoryProvider(server.URL + "/directory")
+		_, err := NewHttpTransport(server.URL, DefaultNonceHeader,
+			WithDirectoryProvider(dp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wt := NewWebSocketTransport(
+			"ws"+strings.TrimPrefix(server.URL, "http")+"/nonces", dp)
+		defer wt.Close()
+		d, err := wt.Directory()
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "ws://bastion/nonces", d["newNonce"])
+		assert.Equal(t, int32(0), atomic.LoadInt32(&conns))
+	})
+
+	t.Run("Closed transport", func(t *testing.T) {
+		wt := NewWebSocketTransport("ws://127.0.0.1:1/nonces", nil)
+		err := wt.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = wt.NewNonce()
+		assert.EqualError(t, err, "websocket transport is closed")
+	})
+
+	t.Run("Close a zero value transport", func(t *testing.T) {
+		wt := &WebSocketTransport{}
+		assert.NoError(t, wt.Close())
+		assert.NoError(t, wt.Close())
+	})
+
+	t.Run("Close interrupts a stalled handshake", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+		wt := NewWebSocketTransport("ws://"+l.Addr().String()+"/nonces",
+			nil)
+		wt.DialTimeout = 0
+		wt.Timeout = 10 * time.Millisecond
+		_, err = wt.NewNonce()
+		assert.Error(t, err)
+		conn := <-accepted
+		defer conn.Close()
+		closed := make(chan struct{})
+		go func() {
+			wt.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Error("close blocked by the stalled handshake")
+		}
+	})
+
+	t.Run("Handshake timeout", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(time.Second)
+			}
+		}()
+		start := time.Now()
+		_, err = dialWebSocket(context.Background(),
+			"ws://"+l.Addr().String()+"/nonces", 20*time.Millisecond)
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+}